@@ -0,0 +1,58 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"v.io/jiri"
+	"v.io/jiri/project"
+	"v.io/x/lib/cmdline"
+)
+
+// cmdCache represents the "jiri cache" command.
+var cmdCache = &cmdline.Command{
+	Name:  "cache",
+	Short: "Manage the mirror cache",
+	Long: `
+Manages the mirror cache in $JIRI_CACHE.  If $JIRI_CACHE is set, "jiri update"
+keeps a bare mirror of the remote of each git project in that directory, and
+clones new projects with the mirror as a reference, so that the objects shared
+with other jiri roots using the same cache are only downloaded once.
+
+Note that the projects cloned this way depend on the mirrors in the cache, so
+the cache must not be deleted while they are in use.  Concurrent updates of
+different jiri roots may share the cache, since each mirror is locked while it
+is fetched or cloned from.
+`,
+	Children: []*cmdline.Command{cmdCacheGc},
+}
+
+// cmdCacheGc represents the "jiri cache gc" command.
+var cmdCacheGc = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCacheGc),
+	Name:   "gc",
+	Short:  "Remove unused mirrors from the cache",
+	Long: `
+Removes the mirrors in $JIRI_CACHE that are not used by any project in the
+manifest of the current jiri root, or by any local project of the other jiri
+roots that use the cache.  Mirrors that a concurrent update is using are kept.
+Jiri roots that no longer exist are forgotten.
+`,
+}
+
+func runCacheGc(jirix *jiri.X, args []string) error {
+	if len(args) > 0 {
+		return jirix.UsageErrorf("unexpected arguments")
+	}
+	removed, err := project.PruneCache(jirix)
+	if err != nil {
+		return err
+	}
+	for _, mirror := range removed {
+		fmt.Fprintf(jirix.Stdout(), "Removed %v\n", mirror)
+	}
+	return nil
+}
@@ -27,7 +27,6 @@ import (
 
 const (
 	commitMessageFileName     = ".gerrit_commit_message"
-	dependencyPathFileName    = ".dependency_path"
 	multiPartMetaDataFileName = "multipart_index"
 )
 
@@ -108,7 +107,7 @@ func getDependencyPathFileName(jirix *jiri.X, branch string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(topLevel, jiri.ProjectMetaDir, branch, dependencyPathFileName), nil
+	return filepath.Join(topLevel, jiri.ProjectMetaDir, branch, project.DependencyPathFileName), nil
 }
 
 func getDependentCLs(jirix *jiri.X, branch string) ([]string, error) {
@@ -1375,7 +1374,7 @@ func newCL(jirix *jiri.X, args []string) error {
 
 	s := jirix.NewSeq()
 	// Record the dependent CLs for the new branch. The dependent CLs
-	// are recorded in a <dependencyPathFileName> file as a
+	// are recorded in a <project.DependencyPathFileName> file as a
 	// newline-separated list of branch names.
 	branches, err := getDependentCLs(jirix, originalBranch)
 	if err != nil {
@@ -40,8 +40,11 @@ Command jiri is a multi-purpose tool for multi-repo development.
 `,
 		LookPath: true,
 		Children: []*cmdline.Command{
+			cmdCache,
 			cmdCL,
 			cmdImport,
+			cmdLock,
+			cmdManifest,
 			cmdProfile,
 			cmdProject,
 			cmdRebuild,
@@ -51,7 +54,6 @@ Command jiri is a multi-purpose tool for multi-repo development.
 		},
 		Topics: []cmdline.Topic{
 			topicFileSystem,
-			topicManifest,
 		},
 	}
 }
@@ -120,120 +122,3 @@ binary directly.
 The jiri binary is located at [root]/.jiri_root/bin/jiri
 `,
 }
-
-var topicManifest = cmdline.Topic{
-	Name:  "manifest",
-	Short: "Description of manifest files",
-	Long: `
-Jiri manifest files describe the set of projects that get synced and tools that
-get built when running "jiri update".
-
-The first manifest file that jiri reads is in $JIRI_ROOT/.jiri_manifest.  This
-manifest **must** exist for the jiri tool to work.
-
-Usually the manifest in $JIRI_ROOT/.jiri_manifest will import other manifests
-from remote repositories via <import> tags, but it can contain its own list of
-projects and tools as well.
-
-Manifests have the following XML schema:
-
-<manifest>
-  <imports>
-    <import remote="https://vanadium.googlesource.com/manifest"
-            manifest="public"
-            name="manifest"
-    />
-    <localimport file="/path/to/local/manifest"/>
-    ...
-  </imports>
-  <projects>
-    <project name="my-project"
-             path="path/where/project/lives"
-             protocol="git"
-             remote="https://github.com/myorg/foo"
-             revision="ed42c05d8688ab23"
-             remotebranch="my-branch"
-             gerrithost="https://myorg-review.googlesource.com"
-             githooks="path/to/githooks-dir"
-             runhook="path/to/runhook-script"
-    />
-    ...
-  </projects>
-  <tools>
-    <tool name="jiri"
-          package="v.io/jiri"
-          project="release.go.jiri"
-    />
-    ...
-  </tools>
-</manifest>
-
-The <import> and <localimport> tags can be used to share common projects and
-tools across multiple manifests.
-
-A <localimport> tag should be used when the manifest being imported and the
-importing manifest are both in the same repository, or when neither one is in a
-repository.  The "file" attribute is the path to the manifest file being
-imported.  It can be absolute, or relative to the importing manifest file.
-
-If the manifest being imported and the importing manifest are in different
-repositories then an <import> tag must be used, with the following attributes:
-
-* remote (required) - The remote url of the repository containing the
-manifest to be imported
-
-* manifest (required) - The path of the manifest file to be imported,
-relative to the repository root.
-
-* name (optional) - The name of the project corresponding to the manifest
-repository.  If your manifest contains a <project> with the same remote as
-the manifest remote, then the "name" attribute of on the <import> tag should
-match the "name" attribute on the <project>.  Otherwise, jiri will clone the
-manifest repository on every update.
-
-The <project> tags describe the projects to sync, and what state they should
-sync to, accoring to the following attributes:
-
-* name (required) - The name of the project.
-
-* path (required) - The location where the project will be located, relative to
-the jiri root.
-
-* remote (required) - The remote url of the project repository.
-
-* protocol (optional) - The protocol to use when cloning and syncing the repo.
-Currently "git" is the default and only supported protocol.
-
-* remotebranch (optional) - The remote branch that the project will sync to.
-Defaults to "master".  The "remotebranch" attribute is ignored if "revision"
-is specified.
-
-* revision (optional) - The specific revision (usually a git SHA) that the
-project will sync to.  If "revision" is  specified then the "remotebranch"
-attribute is ignored.
-
-* gerrithost (optional) - The url of the Gerrit host for the project.  If
-specified, then running "jiri cl mail" will upload a CL to this Gerrit host.
-
-* githooks (optional) - The path (relative to $JIRI_ROOT) of a directory
-containing git hooks that will be installed in the projects .git/hooks
-directory during each update.
-
-* runhook (optional) - The path (relate to $JIRI_ROOT) of a script that will be
-run during each update.
-
-The <tool> tags describe the tools that will be compiled and installed in
-$JIRI_ROOT/.jiri_root/bin after each update.  The tools must be written in go,
-and are identified by their package name and the project that contains their
-code.  They are configured via the following attributes:
-
-* name (required) - The name of the binary that will be installed in
-  JIRI_ROOT/.jiri_root/bin
-
-* package (required) - The name of the Go package that will be passed to "go
-  build".
-
-* project (required) - The name of the project that contains the source code
-  for the tool.
-`,
-}
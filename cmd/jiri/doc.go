@@ -12,8 +12,11 @@ Usage:
    jiri [flags] <command>
 
 The jiri commands are:
+   cache       Manage the mirror cache
    cl          Manage changelists for multiple projects
    import      Adds imports to .jiri_manifest file
+   lock        Manage the manifest lock file
+   manifest    Describe and edit manifest files
    profile     Display information about installed profiles
    project     Manage the jiri projects
    rebuild     Rebuild all jiri tools
@@ -25,7 +28,6 @@ The jiri commands are:
 
 The jiri additional help topics are:
    filesystem  Description of jiri file system layout
-   manifest    Description of manifest files
 
 The jiri flags are:
  -color=true
@@ -39,6 +41,46 @@ The global flags are:
  -time=false
    Dump timing information to stderr before exiting the program.
 
+Jiri cache - Manage the mirror cache
+
+Manages the mirror cache in $JIRI_CACHE.  If $JIRI_CACHE is set, "jiri update"
+keeps a bare mirror of the remote of each git project in that directory, and
+clones new projects with the mirror as a reference, so that the objects shared
+with other jiri roots using the same cache are only downloaded once.
+
+Note that the projects cloned this way depend on the mirrors in the cache, so
+the cache must not be deleted while they are in use.  Concurrent updates of
+different jiri roots may share the cache, since each mirror is locked while it
+is fetched or cloned from.
+
+Usage:
+   jiri cache [flags] <command>
+
+The jiri cache commands are:
+   gc          Remove unused mirrors from the cache
+
+The jiri cache flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri cache gc - Remove unused mirrors from the cache
+
+Removes the mirrors in $JIRI_CACHE that are not used by any project in the
+manifest of the current jiri root, or by any local project of the other jiri
+roots that use the cache.  Mirrors that a concurrent update is using are kept.
+Jiri roots that no longer exist are forgotten.
+
+Usage:
+   jiri cache gc [flags]
+
+The jiri cache gc flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
 Jiri cl - Manage changelists for multiple projects
 
 Manage changelists for multiple projects.
@@ -227,6 +269,530 @@ The jiri import flags are:
  -v=false
    Print verbose output.
 
+Jiri lock - Manage the manifest lock file
+
+Manages $JIRI_ROOT/.jiri_manifest.lock, which pins every project resolved
+through the manifest and its imports, including the manifest projects, and every
+tool to an exact revision.  The lock file lives next to .jiri_manifest, so that
+it can be committed along with it.
+
+The lock file is written by "jiri lock refresh" and "jiri update -lock", and
+"jiri update -locked" checks out the projects and tools it pins.  Only the
+projects selected by groups are pinned.
+
+Usage:
+   jiri lock [flags] <command>
+
+The jiri lock commands are:
+   refresh     Recompute the manifest lock file
+
+The jiri lock flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri lock refresh - Recompute the manifest lock file
+
+Recomputes $JIRI_ROOT/.jiri_manifest.lock from the manifest, pinning projects
+that don't specify a revision to the current revision of their remote branch.
+The local projects are not updated; run "jiri update -locked" to check out the
+pinned revisions.
+
+Usage:
+   jiri lock refresh [flags]
+
+The jiri lock refresh flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest - Describe and edit manifest files
+
+Jiri manifest files describe the set of projects that get synced and tools that
+get built when running "jiri update".
+
+The first manifest file that jiri reads is in $JIRI_ROOT/.jiri_manifest.  This
+manifest **must** exist for the jiri tool to work.
+
+Usually the manifest in $JIRI_ROOT/.jiri_manifest will import other manifests
+from remote repositories via <import> tags, but it can contain its own list of
+projects and tools as well.
+
+Manifests have the following XML schema:
+
+<manifest>
+  <hosts>
+    <host name="vanadium"
+          remote="https://vanadium.googlesource.com"
+          gerrithost="https://vanadium-review.googlesource.com"
+          githooks="path/to/githooks-dir"
+          remotebranch="master"
+    />
+    ...
+  </hosts>
+  <defaults gerrithost="https://myorg-review.googlesource.com"
+            githooks="path/to/githooks-dir"
+            remotebranch="master"
+  />
+  <imports>
+    <import remote="https://vanadium.googlesource.com/manifest"
+            manifest="public"
+            name="manifest"
+            if="env:MYORG_INTERNAL"
+    />
+    <localimport file="/path/to/local/manifest"/>
+    ...
+  </imports>
+  <projects>
+    <project name="my-project"
+             path="path/where/project/lives"
+             protocol="git"
+             remote="https://github.com/myorg/foo"
+             revision="ed42c05d8688ab23"
+             remotebranch="my-branch"
+             gerrithost="https://myorg-review.googlesource.com"
+             githooks="path/to/githooks-dir"
+             runhook="path/to/runhook-script"
+             groups="mobile,server"
+             depth="1"
+             filter="blob:none"
+             nested="true"
+             if="os=linux|darwin"
+             formerly="my-old-project"
+             formerpath="path/where/project/lived">
+      <gitconfig key="core.autocrlf" value="input"/>
+      <remote name="upstream" url="https://github.com/upstream/foo"/>
+      <remote name="origin" pushurl="https://github.com/me/foo"/>
+    </project>
+    ...
+  </projects>
+  <tools>
+    <tool name="jiri"
+          package="v.io/jiri"
+          project="release.go.jiri"
+    />
+    ...
+  </tools>
+  <hooks>
+    <hook name="generate"
+          project="my-project"
+          action="scripts/generate.sh"
+    />
+    ...
+  </hooks>
+  <overrides>
+    <override project="my-project"
+              path="path/where/project/lives"
+              remote="https://github.com/me/foo"
+              remotebranch="my-branch"
+              revision="ed42c05d8688ab23"
+    />
+    ...
+  </overrides>
+  <retention keeplast="20"
+             keepwithin="168h"
+             keepweekly="8"
+  />
+</manifest>
+
+The <host> tags give names to remote hosts, so that the remote of a project or
+import on the host can be written as "name:path".  For example, with the host
+above, the remote "vanadium:go.ref" means
+"https://vanadium.googlesource.com/go.ref".  A host may also specify the default
+"gerrithost", "githooks" and "remotebranch" attributes of its projects.  The
+<defaults> tag specifies the default attributes of projects that are not set by
+their host.  Manifests inherit the hosts and defaults of the manifest importing
+them, and may override them with their own <host> and <defaults> tags.
+
+The <import> and <localimport> tags can be used to share common projects and
+tools across multiple manifests.
+
+A <localimport> tag should be used when the manifest being imported and the
+importing manifest are both in the same repository, or when neither one is in a
+repository.  The "file" attribute is the path to the manifest file being
+imported.  It can be absolute, or relative to the importing manifest file.
+
+If the manifest being imported and the importing manifest are in different
+repositories then an <import> tag must be used, with the following attributes:
+
+* remote (required) - The remote url of the repository containing the manifest
+to be imported
+
+* manifest (required) - The path of the manifest file to be imported, relative
+to the repository root.
+
+* name (optional) - The name of the project corresponding to the manifest
+repository.  If your manifest contains a <project> with the same remote as the
+manifest remote, then the "name" attribute of on the <import> tag should match
+the "name" attribute on the <project>.  Otherwise, jiri will clone the manifest
+repository on every update.
+
+* groups (optional) - A comma-separated list of groups that all projects in the
+imported manifest belong to, in addition to their own groups.
+
+* if (optional) - The condition under which the manifest is imported.  See the
+"if" attribute of <project> tags.
+
+The <project> tags describe the projects to sync, and what state they should
+sync to, accoring to the following attributes:
+
+* name (required) - The name of the project.
+
+* path (required) - The location where the project will be located, relative to
+the jiri root.
+
+* remote (required) - The remote url of the project repository, or
+"name:path" for a repository on a named host.
+
+* protocol (optional) - The protocol to use when cloning and syncing the repo.
+Currently "git" and "archive" are supported, and "git" is the default.  For
+the "archive" protocol, the remote is the URL of a .tar, .tar.gz, .tgz or .zip
+archive, and the revision is the hex-encoded sha256 of the archive.  The
+contents of archive projects are read-only.
+
+* remotebranch (optional) - The remote branch that the project will sync to.
+Defaults to "master".  The "remotebranch" attribute is ignored if "revision" is
+specified.
+
+* revision (optional) - The specific revision (usually a git SHA) that the
+project will sync to.  If "revision" is  specified then the "remotebranch"
+attribute is ignored.
+
+* gerrithost (optional) - The url of the Gerrit host for the project.  If
+specified, then running "jiri cl mail" will upload a CL to this Gerrit host.
+
+* githooks (optional) - The path (relative to $JIRI_ROOT) of a directory
+containing git hooks that will be installed in the projects .git/hooks directory
+during each update.
+
+* runhook (optional) - The path (relate to $JIRI_ROOT) of a script that will be
+run during each update.
+
+* groups (optional) - A comma-separated list of groups that the project belongs
+to.  The "groups" attribute on the <manifest> tag of $JIRI_ROOT/.jiri_manifest
+selects the projects that are checked out, as a comma-separated list of groups
+where groups prefixed with "-" are excluded.  If no groups are included, all
+projects that are not excluded are checked out.  Run "jiri help update" for
+details.
+
+* depth (optional) - The number of commits of history to fetch for a shallow
+clone of the project.  Defaults to the complete history.
+
+* filter (optional) - The filter spec for a partial clone of the project, such
+as "blob:none", which fetches file contents only as they are needed.
+
+* nested (optional) - Whether the project may be located within the working
+tree of another project.  Projects are not nested by default, and "jiri update"
+fails if the path of a project is within the path of another project, unless
+the inner project is marked as nested.  The path of a nested project is added
+to the .git/info/exclude file of the enclosing project.
+
+* if (optional) - The condition under which the project is used, which allows
+one manifest to serve different hosts and developers.  The condition is a
+comma-separated list of terms that must all hold: "os=<os>" and "arch=<arch>"
+match the operating system and architecture of the host, "target=<arch>-<os>"
+matches both, and "env:<name>" holds if the environment variable <name> is set
+and not empty.  Values may list alternatives separated by "|", e.g.
+"os=linux|darwin", and a term prefixed with "!" holds if the term doesn't.
+Projects and imports whose condition doesn't hold are skipped, along with the
+tools of skipped projects, and reported by "jiri project info".
+
+* formerly (optional) - The former name of the project.  If a project was
+renamed, "jiri update" renames the local project with the former name, rather
+than deleting it and creating the project anew.  The local project keeps its
+branches and all the state in its .jiri directory, such as CL dependencies and
+multipart metadata, and its metadata is updated to the new name.
+
+* formerpath (optional) - The former path of the project.  "jiri update" moves
+a local project at the former path to the new path, and renames it like for
+formerly, even if its name or remote changed too.
+
+The <gitconfig> and <remote> tags within a <project> tag describe the git
+configuration and remotes of the local repository of a git project, which
+"jiri update" applies whenever it creates or updates the project, e.g. to add
+the upstream remote of a fork, or to set "core.autocrlf" or "pull.rebase" for
+everyone.  Each <gitconfig> tag sets the git configuration "key" to "value".
+Each <remote> tag adds the remote with the given "name" and "url", and an
+optional "pushurl".  The "origin" remote is the remote of the project, so only
+its "pushurl" may be set.  Settings and remotes that are removed from the
+manifest are removed from the repository on the next update, while settings
+that are not declared in the manifest are left alone.  Run "jiri help project
+info" to show them.
+
+The <tool> tags describe the tools that will be compiled and installed in
+$JIRI_ROOT/.jiri_root/bin after each update.  The tools must be written in go,
+and are identified by their package name and the project that contains their
+code.  They are configured via the following attributes:
+
+* name (required) - The name of the binary that will be installed in
+  JIRI_ROOT/.jiri_root/bin
+
+* package (required) - The name of the Go package that will be passed to "go
+  build".
+
+* project (required) - The name of the project that contains the source code
+  for the tool.
+
+The <hook> tags describe scripts that "jiri update" runs once after all
+projects and tools have been updated, with the argument "post-update", unlike
+the runhook of a project, which runs whenever that project changes.  Each hook
+runs in the directory of its project, and is skipped if the project is not
+checked out.  They are configured via the following attributes:
+
+* name (required) - The name of the hook, which identifies it in the summary
+  of the hooks that ran.
+
+* project (required) - The name of the project that contains the hook.
+
+* action (required) - The path of the hook script, relative to the project.
+
+The <override> tags in $JIRI_ROOT/.jiri_manifest change the attributes of
+projects loaded from the manifest and its imports, without editing the shared
+manifests.  For example, an override can pin a project to a revision, or switch
+its remote to a fork, while testing a change.  The "project" attribute is the
+key or name of the overridden project, and any "path", "remote",
+"remotebranch" and "revision" attributes replace those of the project.  It is
+an error to override a project that doesn't exist.  Overridden projects are
+reported by "jiri project info" via the Overridden field.
+
+The <retention> tag in $JIRI_ROOT/.jiri_manifest is the retention policy of the
+update history in $JIRI_ROOT/.jiri_root/update_history, which "jiri update"
+applies after every update, and which "jiri snapshot prune" uses when no policy
+is given.  A snapshot is kept if any of the attributes keeps it:
+
+* keeplast (optional) - The number of newest snapshots to keep.
+
+* keepwithin (optional) - A duration, e.g. "168h", such that the snapshots
+newer than that are kept.
+
+* keepdaily (optional) - The number of most recent days with snapshots whose
+newest snapshot is kept.
+
+* keepweekly (optional) - The number of most recent weeks with snapshots whose
+newest snapshot is kept.
+
+The "latest" and "second-latest" snapshots are always kept.
+
+Manifests are validated against the schema above when they are loaded.  Unknown
+elements and attributes are errors, so that a misspelled attribute isn't
+silently ignored.  Project paths must be relative to the jiri root, and may not
+point outside of it, and no two projects may have the same path.  Projects
+with an "if" attribute may share a path, as long as their conditions never hold
+on the same host.
+
+Run "jiri manifest explain <project>" to see where the attributes of a project
+were defined.
+
+The other "jiri manifest" commands edit manifest files, and always write them in
+the canonical format, which is also produced by "jiri manifest fmt".  Since
+they only look at the given file, imports are not followed.
+
+Usage:
+   jiri manifest [flags] <command>
+
+The jiri manifest commands are:
+   add-project    Add a project to a manifest
+   add-tool       Add a tool to a manifest
+   explain        Explain where the attributes of a project were defined
+   fmt            Rewrite manifest files in the canonical format
+   remove-import  Remove an import from a manifest
+   remove-project Remove a project from a manifest
+   set-revision   Set the revision of a project in a manifest
+   validate       Check manifest files for errors
+
+The jiri manifest flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest add-project - Add a project to a manifest
+
+Adds a <project> element to the given manifest file.  It is an error to add a
+project with the name of a project that is already in the manifest.
+
+Usage:
+   jiri manifest add-project [flags] <manifest> <name> <remote>
+
+<manifest> is the manifest file to edit.
+
+<name> is the name of the project.
+
+<remote> is the remote url of the project, or "name:path" for a repository on a
+named host.
+
+The jiri manifest add-project flags are:
+ -gerrithost=
+   The Gerrit host of the project.
+ -githooks=
+   The git hooks directory of the project, relative to the jiri root.
+ -groups=
+   Comma-separated list of the groups of the project.
+ -path=
+   The path of the project, relative to the jiri root.  Defaults to the project
+   name.
+ -protocol=
+   The protocol of the project.
+ -remote-branch=
+   The remote branch of the project to track, without the leading "origin/".
+ -revision=
+   The revision of the project.
+ -runhook=
+   The hook script of the project, relative to the jiri root.
+
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest add-tool - Add a tool to a manifest
+
+Adds a <tool> element to the given manifest file.  It is an error to add a tool
+with the name of a tool that is already in the manifest.
+
+Usage:
+   jiri manifest add-tool [flags] <manifest> <name> <package> <project>
+
+<manifest> is the manifest file to edit.
+
+<name> is the name of the tool binary.
+
+<package> is the Go package of the tool.
+
+<project> is the name of the project that contains the tool.
+
+The jiri manifest add-tool flags are:
+ -data=
+   The data directory of the tool.
+
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest explain - Explain where the attributes of a project were defined
+
+Loads the manifest, and prints the manifest file and line that defines the given
+project, the chain of manifests that imported that file, and the source of each
+attribute of the project: the definition itself, the defaults, or an override in
+$JIRI_ROOT/.jiri_manifest.
+
+Usage:
+   jiri manifest explain [flags] <project>
+
+<project> is the key or name of the project.
+
+The jiri manifest explain flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest fmt - Rewrite manifest files in the canonical format
+
+Rewrites the given manifest files in the canonical format, which is the format
+written by jiri.  With -l, the files that aren't in the canonical format are
+listed instead.
+
+Usage:
+   jiri manifest fmt [flags] <manifest>...
+
+<manifest>... is a list of manifest files to format.
+
+The jiri manifest fmt flags are:
+ -l=false
+   List the files whose formatting differs from the canonical format, without
+   rewriting them.
+
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest remove-import - Remove an import from a manifest
+
+Removes the <import> elements with the given manifest, and the <localimport>
+elements with the given file, from the given manifest file.  It is an error if
+there are no such elements.
+
+Usage:
+   jiri manifest remove-import [flags] <manifest> <import>
+
+<manifest> is the manifest file to edit.
+
+<import> is the manifest of a remote import, or the file of a local import.
+
+The jiri manifest remove-import flags are:
+ -remote=
+   Only remove remote imports from the given remote.
+
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest remove-project - Remove a project from a manifest
+
+Removes a <project> element from the given manifest file.
+
+Usage:
+   jiri manifest remove-project [flags] <manifest> <project>
+
+<manifest> is the manifest file to edit.
+
+<project> is the key or name of the project to remove.
+
+The jiri manifest remove-project flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest set-revision - Set the revision of a project in a manifest
+
+Sets the revision of a <project> element in the given manifest file.  Setting
+the revision to "HEAD" makes the project track its remote branch.
+
+Usage:
+   jiri manifest set-revision [flags] <manifest> <project> <revision>
+
+<manifest> is the manifest file to edit.
+
+<project> is the key or name of the project.
+
+<revision> is the new revision of the project.
+
+The jiri manifest set-revision flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
+Jiri manifest validate - Check manifest files for errors
+
+Checks that the given manifest files are valid, and reports the errors of the
+files that are not.  Imports are not followed.
+
+Manifests are checked against the schema described by "jiri help manifest":
+unknown elements and attributes are errors, as are projects without a name or
+path, project paths that are absolute or outside the jiri root, projects
+without an "if" attribute that have the same path, and unsupported protocols.
+Each error is reported as "file:line:column: message", which makes the command
+suitable for presubmit checks.
+
+Usage:
+   jiri manifest validate [flags] <manifest>...
+
+<manifest>... is a list of manifest files to check.
+
+The jiri manifest validate flags are:
+ -color=true
+   Use color to format output.
+ -v=false
+   Print verbose output.
+
 Jiri profile - Display information about installed profiles
 
 Display information about installed profiles and their configuration.
@@ -527,9 +1093,21 @@ is specified using a go template, supplied via the -f flag, that is executed
 against the v.io/jiri/project.ProjectState structure. This structure currently
 has the following fields:
 project.ProjectState{Branches:[]project.BranchState(nil), CurrentBranch:"",
-HasUncommitted:false, HasUntracked:false, Project:project.Project{Name:"",
-Path:"", Protocol:"", Remote:"", RemoteBranch:"", Revision:"", GerritHost:"",
-GitHooks:"", RunHook:"", XMLName:struct {}{}}}
+HasUncommitted:false, HasUntracked:false, Overridden:false,
+Project:project.Project{Name:"", Path:"", Protocol:"", Remote:"",
+RemoteBranch:"", Revision:"", GerritHost:"", GitHooks:"", RunHook:"", Groups:"",
+Depth:0, Filter:"", Nested:false, If:"", Formerly:"", FormerPath:"",
+GitConfigs:[]project.GitConfig(nil), GitRemotes:[]project.GitRemote(nil),
+LocalBranch:"", LocalRevision:"", Bundle:"", Patch:"", XMLName:struct {}{}}}
+
+The git configuration settings and remotes that the manifest declares for a
+project, which "jiri update" applies to its repository, are in the GitConfigs
+and GitRemotes fields of the project, e.g. -f '{{.Project.Name}}
+{{.Project.GitConfigs}} {{.Project.GitRemotes}}'.
+
+Unless only the project that contains the current directory is used, the
+manifest imports, projects and tools that are skipped on this host, since their
+"if" condition doesn't hold, are reported on stderr along with the reason.
 
 Usage:
    jiri project info [flags] <project-keys>...
@@ -616,9 +1194,12 @@ Usage:
    jiri snapshot [flags] <command>
 
 The jiri snapshot commands are:
+   bisect      Find the first bad snapshot with a binary search
    checkout    Checkout a project snapshot
    create      Create a new project snapshot
+   diff        Compare two project snapshots
    list        List existing project snapshots
+   prune       Remove old project snapshots
 
 The jiri snapshot flags are:
  -dir=
@@ -629,19 +1210,87 @@ The jiri snapshot flags are:
  -v=false
    Print verbose output.
 
+Jiri snapshot bisect - Find the first bad snapshot with a binary search
+
+The "jiri snapshot bisect <good> <bad> -- <command>" command finds the first
+snapshot in which the command fails, among the snapshots from the good to the
+bad one.  Both must be snapshots of the same label, or of the update history,
+and are given like for "jiri snapshot diff".  The good snapshot is assumed to
+pass and the bad one to fail.
+
+Each step checks out the snapshot halfway between the last known good and the
+first known bad snapshot, like "jiri snapshot checkout", and runs the command
+in the current directory.  The snapshot is good if the command succeeds, and
+bad otherwise.  Finally, the first bad and last good snapshots are reported,
+along with the projects that changed between them, like "jiri snapshot diff".
+
+The projects must not have uncommitted changes.  Projects that are on another
+branch than master are switched to master while bisecting.  The original state
+of all projects, including their current branches, is restored at the end, even
+if the bisection fails or is interrupted.  The checkouts are not recorded in the
+update history, so "jiri update rollback" is not affected.
+
+Usage:
+   jiri snapshot bisect [flags] <good> <bad> -- <command> [<arg> ...]
+
+<good> and <bad> are the snapshots to search between, and <command> is the
+command that tests each snapshot, along with its arguments.
+
+The jiri snapshot bisect flags are:
+ -jobs=8
+   Number of projects to update concurrently.
+ -log=false
+   List the commits between the last good and first bad revision of each
+   changed project, read from its local clone.
+
+ -color=true
+   Use color to format output.
+ -dir=
+   Directory where snapshot are stored.  Defaults to $JIRI_ROOT/.snapshot.
+ -v=false
+   Print verbose output.
+
 Jiri snapshot checkout - Checkout a project snapshot
 
 The "jiri snapshot checkout <snapshot>" command restores local project state to
 the state in the given snapshot manifest.
 
+The snapshot is the path of a snapshot manifest file, a snapshot label, which
+stands for its latest snapshot, the name of a snapshot in the update history in
+$JIRI_ROOT/.jiri_root/update_history, e.g. "latest" or "second-latest", or a
+selector of a snapshot of a label.
+
+The branches and uncommitted changes recorded by "jiri snapshot create
+-include-branches -include-dirty" are restored once the projects have been
+updated.  A branch is created at its recorded revision, from the bundle of the
+snapshot if necessary, and checked out, and the recorded changes are applied on
+top of it.  Projects that have uncommitted changes, or whose branch already
+exists at another revision, are left as they are and reported.
+
+A snapshot of a label may also be selected as follows:
+
+ <label>@<time>                 The snapshot in effect at the given time, i.e.
+                                the newest one taken at or before that time.
+                                The time is either RFC3339, e.g.
+                                2016-03-01T15:04:05-08:00, or local time, e.g.
+                                2016-03-01T15:04, or a date, e.g. 2016-03-01,
+                                which stands for the end of that day.
+ <label>~<n>                    The nth most recent snapshot, where <label>~1
+                                is the latest one.
+ <label>:<project>=<revision>   The newest snapshot in which the project is at
+                                the revision or after it, as determined by the
+                                local clone of the project.
+
 Usage:
    jiri snapshot checkout [flags] <snapshot>
 
-<snapshot> is the snapshot manifest file.
+<snapshot> is the snapshot to check out.
 
 The jiri snapshot checkout flags are:
  -gc=false
    Garbage collect obsolete repositories.
+ -jobs=8
+   Number of projects to update concurrently.
 
  -color=true
    Use color to format output.
@@ -677,12 +1326,27 @@ Internally, snapshots are organized as follows:
 NOTE: Unlike the jiri tool commands, the above internal organization is not an
 API. It is an implementation and can change without notice.
 
+By default, a snapshot records the revision of the master branch of each
+project.  With -include-branches, it also records the current branch and
+revision of each project that is not on master, along with a git bundle of the
+commits of the branch that are not on master.  With -include-dirty, it records
+the uncommitted changes of each project as a patch, relative to the current
+branch if it is recorded, or to master otherwise.  Untracked files are not
+recorded.  The bundles and patches are stored in the <snapshot>.patches
+directory next to the snapshot, and "jiri snapshot checkout" restores the
+branches and changes onto the projects, so that a snapshot can hand over a work
+in progress.
+
 Usage:
    jiri snapshot create [flags] <label>
 
 <label> is the snapshot label.
 
 The jiri snapshot create flags are:
+ -include-branches=false
+   Record the current branch and revision of projects that are not on master.
+ -include-dirty=false
+   Record the uncommitted changes of projects as patches.
  -push-remote=false
    Commit and push snapshot upstream.
  -time-format=2006-01-02T15:04:05Z07:00
@@ -695,6 +1359,56 @@ The jiri snapshot create flags are:
  -v=false
    Print verbose output.
 
+Jiri snapshot diff - Compare two project snapshots
+
+The "jiri snapshot diff <old> <new>" command lists the projects that were added,
+removed, moved or changed from the old to the new snapshot, along with their old
+and new revisions.  Renamed projects are matched by their former name or path,
+like in "jiri update".
+
+Each snapshot is the path of a snapshot manifest file, a snapshot label, which
+stands for its latest snapshot, the name of a snapshot in the update history in
+$JIRI_ROOT/.jiri_root/update_history, e.g. "latest" or "second-latest", or a
+selector of a snapshot of a label.
+
+With -log, the commits from the old to the new revision of each changed project
+are listed as well.  They are read from the local clone of the project, so
+projects that are not checked out, or whose revisions haven't been fetched, are
+reported without their log.
+
+A snapshot of a label may also be selected as follows:
+
+ <label>@<time>                 The snapshot in effect at the given time, i.e.
+                                the newest one taken at or before that time.
+                                The time is either RFC3339, e.g.
+                                2016-03-01T15:04:05-08:00, or local time, e.g.
+                                2016-03-01T15:04, or a date, e.g. 2016-03-01,
+                                which stands for the end of that day.
+ <label>~<n>                    The nth most recent snapshot, where <label>~1
+                                is the latest one.
+ <label>:<project>=<revision>   The newest snapshot in which the project is at
+                                the revision or after it, as determined by the
+                                local clone of the project.
+
+Usage:
+   jiri snapshot diff [flags] <old> <new>
+
+<old> and <new> are the snapshots to compare.
+
+The jiri snapshot diff flags are:
+ -json=false
+   Print the differences in JSON format.
+ -log=false
+   List the commits between the old and new revision of each changed project,
+   read from its local clone.
+
+ -color=true
+   Use color to format output.
+ -dir=
+   Directory where snapshot are stored.  Defaults to $JIRI_ROOT/.snapshot.
+ -v=false
+   Print verbose output.
+
 Jiri snapshot list - List existing project snapshots
 
 The "snapshot list" command lists existing snapshots of the labels specified as
@@ -714,6 +1428,57 @@ The jiri snapshot list flags are:
  -v=false
    Print verbose output.
 
+Jiri snapshot prune - Remove old project snapshots
+
+The "jiri snapshot prune" command removes the snapshots of the given labels, or
+of all labels if none are given, that the retention policy doesn't keep.  With
+-history, it prunes the update history in $JIRI_ROOT/.jiri_root/update_history
+instead.
+
+A snapshot is kept if any of the -keep-last, -keep-within, -keep-daily and
+-keep-weekly rules keeps it.  If none of them is given, the retention policy in
+$JIRI_ROOT/.jiri_manifest is used, which "jiri update" also applies to the
+update history after every update.  The snapshots that the label symlinks, or
+the "latest" and "second-latest" symlinks of the update history, point to are
+always kept.  Snapshots are dated by their names if they use the default time
+format, and by their modification times otherwise.
+
+If the snapshot directory is a git repository, -push-remote commits and pushes
+the removal of snapshots upstream.  Without it, removing a committed snapshot
+is refused, rather than leaving the repository with uncommitted changes.
+
+Run "jiri help manifest" for details on the retention policy.
+
+Usage:
+   jiri snapshot prune [flags] <label ...>
+
+<label ...> is a list of snapshot labels.
+
+The jiri snapshot prune flags are:
+ -history=false
+   Prune the update history rather than snapshot labels.
+ -keep-daily=0
+   Keep the newest snapshot of each of the given number of most recent days with
+   snapshots.
+ -keep-last=0
+   Keep the given number of newest snapshots.
+ -keep-weekly=0
+   Keep the newest snapshot of each of the given number of most recent weeks
+   with snapshots.
+ -keep-within=0s
+   Keep the snapshots newer than the given duration, e.g. 720h.
+ -n=false
+   Show what would be removed, but don't remove anything.
+ -push-remote=false
+   Commit and push the removal of snapshots upstream.
+
+ -color=true
+   Use color to format output.
+ -dir=
+   Directory where snapshot are stored.  Defaults to $JIRI_ROOT/.snapshot.
+ -v=false
+   Print verbose output.
+
 Jiri update - Update all jiri tools and projects
 
 Updates all projects, builds the latest version of all tools, and installs the
@@ -722,24 +1487,183 @@ individual updates happen guarantees that we end up with a consistent set of
 tools and source code. The set of projects and tools to update is described in
 the manifest.
 
+With -n, the projects, hooks and tools are not updated.  Instead, the plan that
+would be carried out is printed: each project that would be created, moved,
+updated or deleted along with its old and new revision, the hooks that would
+run, and the tools that would be rebuilt.  With -json the plan is printed in
+JSON format.
+
+With -rollback-on-error, if the update fails, every project it touched is
+returned to its revision in the latest update history snapshot, and the tools
+are rebuilt to match.  Run "jiri update rollback" to return to the state before
+the latest successful update.
+
+With -groups, only the projects in the given groups are checked out, and the
+selection is saved in $JIRI_ROOT/.jiri_manifest for subsequent commands.  For
+example, -groups=+mobile,-experimental checks out the projects in the "mobile"
+group that are not also in the "experimental" group, and -groups=-server checks
+out all projects except those in the "server" group.  Use -groups= to check out
+all projects again.  Projects that are excluded by groups are left alone; in
+particular they are never deleted by -gc.
+
+With -depth and -filter, new projects are cloned shallow or partially, unless
+their manifest specifies otherwise.  Checking out a revision that is not in a
+shallow clone fetches it as needed.
+
+With -lock, the revisions of the projects and tools are pinned in
+$JIRI_ROOT/.jiri_manifest.lock after the update.  With -locked, the projects and
+tools pinned in the lock file are checked out, rather than those in the
+manifest, which reproduces the state of the update that wrote the lock file.
+Run "jiri help lock" for details.
+
+With -local, the update never contacts any remotes, which is useful without
+network access.  The manifest is resolved from the refs that were already
+fetched into the manifest projects, projects are reset to their revisions
+without fetching, and tools are rebuilt and hooks are run as usual.  The update
+fails before changing any project if a revision isn't available locally, or if
+a project would have to be created.  -local can be combined with -locked, and
+also applies to "jiri update rollback".
+
+With -rebase-tracked, the local branches of each project whose master branch
+advanced are brought up to date with it.  Branches that track master, or the
+remote branch of the project, are rebased onto master.  CL branches created by
+"jiri cl new" are brought up to date along their dependency path, as "jiri cl
+sync" does: master is merged into the first CL, which is merged into the next
+one, and so on.  With -rebase-all, all other local branches are rebased onto
+master as well.  A branch that can't be updated automatically, for example
+because of conflicts, is left as it was, along with the branches that depend
+on it, and the project is returned to its current branch.  A summary lists
+each branch as updated, up to date, or needing manual resolution.
+
+Hooks run after the projects are updated: the runhook of each project that was
+created, moved or updated, and then, once the tools are rebuilt, the
+post-update hooks of the manifest.  Every hook runs even if others fail, a
+summary lists the status and duration of each hook, and the update fails if any
+of them failed.  Hooks that run longer than -hook-timeout are killed and
+reported as timed out.  With -parallel-hooks, up to -jobs hooks run at the same
+time, with the output of each hook printed when it completes.  Snapshots and the
+lock file record the post-update hooks, which run after "jiri update -locked",
+"jiri update rollback" and "jiri snapshot checkout" too.
+
+If $JIRI_ROOT/.jiri_manifest has a <retention> policy, the update history
+snapshots that it doesn't keep are removed after every update, as by "jiri
+snapshot prune -history".
+
+If $JIRI_CACHE is set, new projects borrow objects from mirrors in that
+directory.  Run "jiri help cache" for details.
+
 Run "jiri help manifest" for details on manifests.
 
 Usage:
    jiri update [flags]
+   jiri update [flags] <command>
+
+The jiri update commands are:
+   rollback    Roll back to the state before the latest update
 
 The jiri update flags are:
  -attempts=1
    Number of attempts before failing.
+ -depth=0
+   Number of commits of history to fetch for shallow clones of new projects that
+   don't specify a depth.
+ -filter=
+   Filter spec for partial clones of new projects that don't specify a filter,
+   e.g. blob:none.
  -gc=false
    Garbage collect obsolete repositories.
+ -groups=
+   Comma-separated list of project groups to check out, where groups prefixed
+   with '-' are excluded.  The selection is saved in $JIRI_ROOT/.jiri_manifest.
+ -hook-timeout=5m0s
+   Maximum time each hook may run before it is killed, or 0 for no limit.
+ -jobs=8
+   Number of projects to update concurrently.
+ -json=false
+   Print the plan shown by -n in JSON format.
+ -lock=false
+   Pin the updated projects and tools in $JIRI_ROOT/.jiri_manifest.lock.
+ -locked=false
+   Check out the projects and tools pinned in $JIRI_ROOT/.jiri_manifest.lock.
+ -local=false
+   Update without contacting any remotes, using only the revisions that were
+   already fetched.
  -manifest=
    Name of the project manifest.
+ -n=false
+   Show what would be updated without updating anything.
+ -parallel-hooks=false
+   Run hooks concurrently, with at most -jobs hooks running at the same time.
+ -rebase-all=false
+   Like -rebase-tracked, but rebase all local branches.
+ -rebase-tracked=false
+   Rebase the local branches that track master, and merge master into CL
+   branches, once master is updated.
+ -rollback-on-error=false
+   Roll back the projects touched by a failed update to their previous
+   revisions.
 
  -color=true
    Use color to format output.
  -v=false
    Print verbose output.
 
+Jiri update rollback - Roll back to the state before the latest update
+
+Restores all projects and tools to the state they were in before the latest
+update, as recorded by the second latest update history snapshot.  The latest
+update history snapshot then refers to the restored state, so rolling back again
+has no further effect.
+
+Usage:
+   jiri update rollback [flags]
+
+The jiri update rollback flags are:
+ -attempts=1
+   Number of attempts before failing.
+ -color=true
+   Use color to format output.
+ -depth=0
+   Number of commits of history to fetch for shallow clones of new projects that
+   don't specify a depth.
+ -filter=
+   Filter spec for partial clones of new projects that don't specify a filter,
+   e.g. blob:none.
+ -gc=false
+   Garbage collect obsolete repositories.
+ -groups=
+   Comma-separated list of project groups to check out, where groups prefixed
+   with '-' are excluded.  The selection is saved in $JIRI_ROOT/.jiri_manifest.
+ -hook-timeout=5m0s
+   Maximum time each hook may run before it is killed, or 0 for no limit.
+ -jobs=8
+   Number of projects to update concurrently.
+ -json=false
+   Print the plan shown by -n in JSON format.
+ -lock=false
+   Pin the updated projects and tools in $JIRI_ROOT/.jiri_manifest.lock.
+ -locked=false
+   Check out the projects and tools pinned in $JIRI_ROOT/.jiri_manifest.lock.
+ -local=false
+   Update without contacting any remotes, using only the revisions that were
+   already fetched.
+ -manifest=
+   Name of the project manifest.
+ -n=false
+   Show what would be updated without updating anything.
+ -parallel-hooks=false
+   Run hooks concurrently, with at most -jobs hooks running at the same time.
+ -rebase-all=false
+   Like -rebase-tracked, but rebase all local branches.
+ -rebase-tracked=false
+   Rebase the local branches that track master, and merge master into CL
+   branches, once master is updated.
+ -rollback-on-error=false
+   Roll back the projects touched by a failed update to their previous
+   revisions.
+ -v=false
+   Print verbose output.
+
 Jiri which - Show path to the jiri tool
 
 Which behaves similarly to the unix commandline tool.  It is useful in
@@ -923,118 +1847,5 @@ logic.  This is the reason the shim script is recommended over running the
 binary directly.
 
 The jiri binary is located at [root]/.jiri_root/bin/jiri
-
-Jiri manifest - Description of manifest files
-
-Jiri manifest files describe the set of projects that get synced and tools that
-get built when running "jiri update".
-
-The first manifest file that jiri reads is in $JIRI_ROOT/.jiri_manifest.  This
-manifest **must** exist for the jiri tool to work.
-
-Usually the manifest in $JIRI_ROOT/.jiri_manifest will import other manifests
-from remote repositories via <import> tags, but it can contain its own list of
-projects and tools as well.
-
-Manifests have the following XML schema:
-
-<manifest>
-  <imports>
-    <import remote="https://vanadium.googlesource.com/manifest"
-            manifest="public"
-            name="manifest"
-    />
-    <localimport file="/path/to/local/manifest"/>
-    ...
-  </imports>
-  <projects>
-    <project name="my-project"
-             path="path/where/project/lives"
-             protocol="git"
-             remote="https://github.com/myorg/foo"
-             revision="ed42c05d8688ab23"
-             remotebranch="my-branch"
-             gerrithost="https://myorg-review.googlesource.com"
-             githooks="path/to/githooks-dir"
-             runhook="path/to/runhook-script"
-    />
-    ...
-  </projects>
-  <tools>
-    <tool name="jiri"
-          package="v.io/jiri"
-          project="release.go.jiri"
-    />
-    ...
-  </tools>
-</manifest>
-
-The <import> and <localimport> tags can be used to share common projects and
-tools across multiple manifests.
-
-A <localimport> tag should be used when the manifest being imported and the
-importing manifest are both in the same repository, or when neither one is in a
-repository.  The "file" attribute is the path to the manifest file being
-imported.  It can be absolute, or relative to the importing manifest file.
-
-If the manifest being imported and the importing manifest are in different
-repositories then an <import> tag must be used, with the following attributes:
-
-* remote (required) - The remote url of the repository containing the manifest
-to be imported
-
-* manifest (required) - The path of the manifest file to be imported, relative
-to the repository root.
-
-* name (optional) - The name of the project corresponding to the manifest
-repository.  If your manifest contains a <project> with the same remote as the
-manifest remote, then the "name" attribute of on the <import> tag should match
-the "name" attribute on the <project>.  Otherwise, jiri will clone the manifest
-repository on every update.
-
-The <project> tags describe the projects to sync, and what state they should
-sync to, accoring to the following attributes:
-
-* name (required) - The name of the project.
-
-* path (required) - The location where the project will be located, relative to
-the jiri root.
-
-* remote (required) - The remote url of the project repository.
-
-* protocol (optional) - The protocol to use when cloning and syncing the repo.
-Currently "git" is the default and only supported protocol.
-
-* remotebranch (optional) - The remote branch that the project will sync to.
-Defaults to "master".  The "remotebranch" attribute is ignored if "revision" is
-specified.
-
-* revision (optional) - The specific revision (usually a git SHA) that the
-project will sync to.  If "revision" is  specified then the "remotebranch"
-attribute is ignored.
-
-* gerrithost (optional) - The url of the Gerrit host for the project.  If
-specified, then running "jiri cl mail" will upload a CL to this Gerrit host.
-
-* githooks (optional) - The path (relative to $JIRI_ROOT) of a directory
-containing git hooks that will be installed in the projects .git/hooks directory
-during each update.
-
-* runhook (optional) - The path (relate to $JIRI_ROOT) of a script that will be
-run during each update.
-
-The <tool> tags describe the tools that will be compiled and installed in
-$JIRI_ROOT/.jiri_root/bin after each update.  The tools must be written in go,
-and are identified by their package name and the project that contains their
-code.  They are configured via the following attributes:
-
-* name (required) - The name of the binary that will be installed in
-  JIRI_ROOT/.jiri_root/bin
-
-* package (required) - The name of the Go package that will be passed to "go
-  build".
-
-* project (required) - The name of the project that contains the source code
-  for the tool.
 */
 package main
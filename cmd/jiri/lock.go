@@ -0,0 +1,48 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"v.io/jiri"
+	"v.io/jiri/project"
+	"v.io/x/lib/cmdline"
+)
+
+// cmdLock represents the "jiri lock" command.
+var cmdLock = &cmdline.Command{
+	Name:  "lock",
+	Short: "Manage the manifest lock file",
+	Long: `
+Manages $JIRI_ROOT/.jiri_manifest.lock, which pins every project resolved
+through the manifest and its imports, including the manifest projects, and every
+tool to an exact revision.  The lock file lives next to .jiri_manifest, so that
+it can be committed along with it.
+
+The lock file is written by "jiri lock refresh" and "jiri update -lock", and
+"jiri update -locked" checks out the projects and tools it pins.  Only the
+projects selected by groups are pinned.
+`,
+	Children: []*cmdline.Command{cmdLockRefresh},
+}
+
+// cmdLockRefresh represents the "jiri lock refresh" command.
+var cmdLockRefresh = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runLockRefresh),
+	Name:   "refresh",
+	Short:  "Recompute the manifest lock file",
+	Long: `
+Recomputes $JIRI_ROOT/.jiri_manifest.lock from the manifest, pinning projects
+that don't specify a revision to the current revision of their remote branch.
+The local projects are not updated; run "jiri update -locked" to check out the
+pinned revisions.
+`,
+}
+
+func runLockRefresh(jirix *jiri.X, args []string) error {
+	if len(args) > 0 {
+		return jirix.UsageErrorf("unexpected arguments")
+	}
+	return project.RefreshLockFile(jirix)
+}
@@ -0,0 +1,699 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"v.io/jiri"
+	"v.io/jiri/project"
+	"v.io/x/lib/cmdline"
+)
+
+var (
+	// Flags for configuring the attributes of added projects.
+	flagManifestPath, flagManifestProtocol, flagManifestRemoteBranch, flagManifestRevision string
+	flagManifestGroups, flagManifestGerritHost, flagManifestGitHooks, flagManifestRunHook  string
+	// Flags for configuring the attributes of added tools.
+	flagManifestToolData string
+	// Flags for selecting imports to remove.
+	flagManifestImportRemote string
+	// Flags for controlling the behavior of "jiri manifest fmt".
+	flagManifestList bool
+)
+
+func init() {
+	cmdManifestAddProject.Flags.StringVar(&flagManifestPath, "path", "", `The path of the project, relative to the jiri root.  Defaults to the project name.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestProtocol, "protocol", "", `The protocol of the project.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestRemoteBranch, "remote-branch", "", `The remote branch of the project to track, without the leading "origin/".`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestRevision, "revision", "", `The revision of the project.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestGroups, "groups", "", `Comma-separated list of the groups of the project.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestGerritHost, "gerrithost", "", `The Gerrit host of the project.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestGitHooks, "githooks", "", `The git hooks directory of the project, relative to the jiri root.`)
+	cmdManifestAddProject.Flags.StringVar(&flagManifestRunHook, "runhook", "", `The hook script of the project, relative to the jiri root.`)
+
+	cmdManifestAddTool.Flags.StringVar(&flagManifestToolData, "data", "", `The data directory of the tool.`)
+
+	cmdManifestRemoveImport.Flags.StringVar(&flagManifestImportRemote, "remote", "", `Only remove remote imports from the given remote.`)
+
+	cmdManifestFmt.Flags.BoolVar(&flagManifestList, "l", false, `List the files whose formatting differs from the canonical format, without rewriting them.`)
+}
+
+// cmdManifest represents the "jiri manifest" command.
+var cmdManifest = &cmdline.Command{
+	Name:  "manifest",
+	Short: "Describe and edit manifest files",
+	Long: `
+Jiri manifest files describe the set of projects that get synced and tools that
+get built when running "jiri update".
+
+The first manifest file that jiri reads is in $JIRI_ROOT/.jiri_manifest.  This
+manifest **must** exist for the jiri tool to work.
+
+Usually the manifest in $JIRI_ROOT/.jiri_manifest will import other manifests
+from remote repositories via <import> tags, but it can contain its own list of
+projects and tools as well.
+
+Manifests have the following XML schema:
+
+<manifest>
+  <hosts>
+    <host name="vanadium"
+          remote="https://vanadium.googlesource.com"
+          gerrithost="https://vanadium-review.googlesource.com"
+          githooks="path/to/githooks-dir"
+          remotebranch="master"
+    />
+    ...
+  </hosts>
+  <defaults gerrithost="https://myorg-review.googlesource.com"
+            githooks="path/to/githooks-dir"
+            remotebranch="master"
+  />
+  <imports>
+    <import remote="https://vanadium.googlesource.com/manifest"
+            manifest="public"
+            name="manifest"
+            if="env:MYORG_INTERNAL"
+    />
+    <localimport file="/path/to/local/manifest"/>
+    ...
+  </imports>
+  <projects>
+    <project name="my-project"
+             path="path/where/project/lives"
+             protocol="git"
+             remote="https://github.com/myorg/foo"
+             revision="ed42c05d8688ab23"
+             remotebranch="my-branch"
+             gerrithost="https://myorg-review.googlesource.com"
+             githooks="path/to/githooks-dir"
+             runhook="path/to/runhook-script"
+             groups="mobile,server"
+             depth="1"
+             filter="blob:none"
+             nested="true"
+             if="os=linux|darwin"
+             formerly="my-old-project"
+             formerpath="path/where/project/lived">
+      <gitconfig key="core.autocrlf" value="input"/>
+      <remote name="upstream" url="https://github.com/upstream/foo"/>
+      <remote name="origin" pushurl="https://github.com/me/foo"/>
+    </project>
+    ...
+  </projects>
+  <tools>
+    <tool name="jiri"
+          package="v.io/jiri"
+          project="release.go.jiri"
+    />
+    ...
+  </tools>
+  <hooks>
+    <hook name="generate"
+          project="my-project"
+          action="scripts/generate.sh"
+    />
+    ...
+  </hooks>
+  <overrides>
+    <override project="my-project"
+              path="path/where/project/lives"
+              remote="https://github.com/me/foo"
+              remotebranch="my-branch"
+              revision="ed42c05d8688ab23"
+    />
+    ...
+  </overrides>
+  <retention keeplast="20"
+             keepwithin="168h"
+             keepweekly="8"
+  />
+</manifest>
+
+The <host> tags give names to remote hosts, so that the remote of a project or
+import on the host can be written as "name:path".  For example, with the host
+above, the remote "vanadium:go.ref" means
+"https://vanadium.googlesource.com/go.ref".  A host may also specify the default
+"gerrithost", "githooks" and "remotebranch" attributes of its projects.  The
+<defaults> tag specifies the default attributes of projects that are not set by
+their host.  Manifests inherit the hosts and defaults of the manifest importing
+them, and may override them with their own <host> and <defaults> tags.
+
+The <import> and <localimport> tags can be used to share common projects and
+tools across multiple manifests.
+
+A <localimport> tag should be used when the manifest being imported and the
+importing manifest are both in the same repository, or when neither one is in a
+repository.  The "file" attribute is the path to the manifest file being
+imported.  It can be absolute, or relative to the importing manifest file.
+
+If the manifest being imported and the importing manifest are in different
+repositories then an <import> tag must be used, with the following attributes:
+
+* remote (required) - The remote url of the repository containing the
+manifest to be imported
+
+* manifest (required) - The path of the manifest file to be imported,
+relative to the repository root.
+
+* name (optional) - The name of the project corresponding to the manifest
+repository.  If your manifest contains a <project> with the same remote as
+the manifest remote, then the "name" attribute of on the <import> tag should
+match the "name" attribute on the <project>.  Otherwise, jiri will clone the
+manifest repository on every update.
+
+* groups (optional) - A comma-separated list of groups that all projects in the
+imported manifest belong to, in addition to their own groups.
+
+* if (optional) - The condition under which the manifest is imported.  See the
+"if" attribute of <project> tags.
+
+The <project> tags describe the projects to sync, and what state they should
+sync to, accoring to the following attributes:
+
+* name (required) - The name of the project.
+
+* path (required) - The location where the project will be located, relative to
+the jiri root.
+
+* remote (required) - The remote url of the project repository, or
+"name:path" for a repository on a named host.
+
+* protocol (optional) - The protocol to use when cloning and syncing the repo.
+Currently "git" and "archive" are supported, and "git" is the default.  For
+the "archive" protocol, the remote is the URL of a .tar, .tar.gz, .tgz or .zip
+archive, and the revision is the hex-encoded sha256 of the archive.  The
+contents of archive projects are read-only.
+
+* remotebranch (optional) - The remote branch that the project will sync to.
+Defaults to "master".  The "remotebranch" attribute is ignored if "revision"
+is specified.
+
+* revision (optional) - The specific revision (usually a git SHA) that the
+project will sync to.  If "revision" is  specified then the "remotebranch"
+attribute is ignored.
+
+* gerrithost (optional) - The url of the Gerrit host for the project.  If
+specified, then running "jiri cl mail" will upload a CL to this Gerrit host.
+
+* githooks (optional) - The path (relative to $JIRI_ROOT) of a directory
+containing git hooks that will be installed in the projects .git/hooks
+directory during each update.
+
+* runhook (optional) - The path (relate to $JIRI_ROOT) of a script that will be
+run during each update.
+
+* groups (optional) - A comma-separated list of groups that the project belongs
+to.  The "groups" attribute on the <manifest> tag of $JIRI_ROOT/.jiri_manifest
+selects the projects that are checked out, as a comma-separated list of groups
+where groups prefixed with "-" are excluded.  If no groups are included, all
+projects that are not excluded are checked out.  Run "jiri help update" for
+details.
+
+* depth (optional) - The number of commits of history to fetch for a shallow
+clone of the project.  Defaults to the complete history.
+
+* filter (optional) - The filter spec for a partial clone of the project, such
+as "blob:none", which fetches file contents only as they are needed.
+
+* nested (optional) - Whether the project may be located within the working
+tree of another project.  Projects are not nested by default, and "jiri update"
+fails if the path of a project is within the path of another project, unless
+the inner project is marked as nested.  The path of a nested project is added
+to the .git/info/exclude file of the enclosing project.
+
+* if (optional) - The condition under which the project is used, which allows
+one manifest to serve different hosts and developers.  The condition is a
+comma-separated list of terms that must all hold: "os=<os>" and "arch=<arch>"
+match the operating system and architecture of the host, "target=<arch>-<os>"
+matches both, and "env:<name>" holds if the environment variable <name> is set
+and not empty.  Values may list alternatives separated by "|", e.g.
+"os=linux|darwin", and a term prefixed with "!" holds if the term doesn't.
+Projects and imports whose condition doesn't hold are skipped, along with the
+tools of skipped projects, and reported by "jiri project info".
+
+* formerly (optional) - The former name of the project.  If a project was
+renamed, "jiri update" renames the local project with the former name, rather
+than deleting it and creating the project anew.  The local project keeps its
+branches and all the state in its .jiri directory, such as CL dependencies and
+multipart metadata, and its metadata is updated to the new name.
+
+* formerpath (optional) - The former path of the project.  "jiri update" moves
+a local project at the former path to the new path, and renames it like for
+formerly, even if its name or remote changed too.
+
+The <gitconfig> and <remote> tags within a <project> tag describe the git
+configuration and remotes of the local repository of a git project, which
+"jiri update" applies whenever it creates or updates the project, e.g. to add
+the upstream remote of a fork, or to set "core.autocrlf" or "pull.rebase" for
+everyone.  Each <gitconfig> tag sets the git configuration "key" to "value".
+Each <remote> tag adds the remote with the given "name" and "url", and an
+optional "pushurl".  The "origin" remote is the remote of the project, so only
+its "pushurl" may be set.  Settings and remotes that are removed from the
+manifest are removed from the repository on the next update, while settings
+that are not declared in the manifest are left alone.  Run "jiri help project
+info" to show them.
+
+The <tool> tags describe the tools that will be compiled and installed in
+$JIRI_ROOT/.jiri_root/bin after each update.  The tools must be written in go,
+and are identified by their package name and the project that contains their
+code.  They are configured via the following attributes:
+
+* name (required) - The name of the binary that will be installed in
+  JIRI_ROOT/.jiri_root/bin
+
+* package (required) - The name of the Go package that will be passed to "go
+  build".
+
+* project (required) - The name of the project that contains the source code
+  for the tool.
+
+The <hook> tags describe scripts that "jiri update" runs once after all
+projects and tools have been updated, with the argument "post-update", unlike
+the runhook of a project, which runs whenever that project changes.  Each hook
+runs in the directory of its project, and is skipped if the project is not
+checked out.  They are configured via the following attributes:
+
+* name (required) - The name of the hook, which identifies it in the summary
+  of the hooks that ran.
+
+* project (required) - The name of the project that contains the hook.
+
+* action (required) - The path of the hook script, relative to the project.
+
+The <override> tags in $JIRI_ROOT/.jiri_manifest change the attributes of
+projects loaded from the manifest and its imports, without editing the shared
+manifests.  For example, an override can pin a project to a revision, or switch
+its remote to a fork, while testing a change.  The "project" attribute is the
+key or name of the overridden project, and any "path", "remote",
+"remotebranch" and "revision" attributes replace those of the project.  It is
+an error to override a project that doesn't exist.  Overridden projects are
+reported by "jiri project info" via the Overridden field.
+
+The <retention> tag in $JIRI_ROOT/.jiri_manifest is the retention policy of the
+update history in $JIRI_ROOT/.jiri_root/update_history, which "jiri update"
+applies after every update, and which "jiri snapshot prune" uses when no policy
+is given.  A snapshot is kept if any of the attributes keeps it:
+
+* keeplast (optional) - The number of newest snapshots to keep.
+
+* keepwithin (optional) - A duration, e.g. "168h", such that the snapshots
+newer than that are kept.
+
+* keepdaily (optional) - The number of most recent days with snapshots whose
+newest snapshot is kept.
+
+* keepweekly (optional) - The number of most recent weeks with snapshots whose
+newest snapshot is kept.
+
+The "latest" and "second-latest" snapshots are always kept.
+
+Manifests are validated against the schema above when they are loaded.  Unknown
+elements and attributes are errors, so that a misspelled attribute isn't
+silently ignored.  Project paths must be relative to the jiri root, and may not
+point outside of it, and no two projects may have the same path.  Projects
+with an "if" attribute may share a path, as long as their conditions never hold
+on the same host.
+
+Run "jiri manifest explain <project>" to see where the attributes of a project
+were defined.
+
+The other "jiri manifest" commands edit manifest files, and always write them in
+the canonical format, which is also produced by "jiri manifest fmt".  Since
+they only look at the given file, imports are not followed.
+`,
+	Children: []*cmdline.Command{
+		cmdManifestAddProject,
+		cmdManifestAddTool,
+		cmdManifestExplain,
+		cmdManifestFmt,
+		cmdManifestRemoveImport,
+		cmdManifestRemoveProject,
+		cmdManifestSetRevision,
+		cmdManifestValidate,
+	},
+}
+
+// cmdManifestExplain represents the "jiri manifest explain" command.
+var cmdManifestExplain = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestExplain),
+	Name:   "explain",
+	Short:  "Explain where the attributes of a project were defined",
+	Long: `
+Loads the manifest, and prints the manifest file and line that defines the given
+project, the chain of manifests that imported that file, and the source of each
+attribute of the project: the definition itself, the defaults, or an override in
+$JIRI_ROOT/.jiri_manifest.
+`,
+	ArgsName: "<project>",
+	ArgsLong: "<project> is the key or name of the project.",
+}
+
+func runManifestExplain(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	p, prov, err := project.ExplainProject(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(jirix.Stdout(), "Project %q is defined at %v\n", p.Key(), prov)
+	width := 0
+	for _, attr := range prov.Attributes {
+		if len(attr.Name) > width {
+			width = len(attr.Name)
+		}
+	}
+	for _, attr := range prov.Attributes {
+		fmt.Fprintf(jirix.Stdout(), "  %s%s  %s  (%s)\n", attr.Name, strings.Repeat(" ", width-len(attr.Name)), attr.Value, attr.Source)
+	}
+	return nil
+}
+
+// editManifest applies edit to the manifest in the given file, and writes it
+// back in the canonical format.
+func editManifest(jirix *jiri.X, file string, edit func(m *project.Manifest) error) error {
+	m, err := project.ManifestFromFile(jirix, file)
+	if err != nil {
+		return err
+	}
+	if err := edit(m); err != nil {
+		return err
+	}
+	return m.ToFile(jirix, file)
+}
+
+// findManifestProject returns the index of the project with the given key or
+// name in the manifest in the given file.
+func findManifestProject(m *project.Manifest, file, keyOrName string) (int, error) {
+	index := -1
+	for i, p := range m.Projects {
+		if string(p.Key()) != keyOrName && p.Name != keyOrName {
+			continue
+		}
+		if index >= 0 {
+			return -1, fmt.Errorf("multiple projects found with name %q in %v", keyOrName, file)
+		}
+		index = i
+	}
+	if index < 0 {
+		return -1, fmt.Errorf("no projects found with key or name %q in %v", keyOrName, file)
+	}
+	return index, nil
+}
+
+// cmdManifestAddProject represents the "jiri manifest add-project" command.
+var cmdManifestAddProject = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestAddProject),
+	Name:   "add-project",
+	Short:  "Add a project to a manifest",
+	Long: `
+Adds a <project> element to the given manifest file.  It is an error to add a
+project with the name of a project that is already in the manifest.
+`,
+	ArgsName: "<manifest> <name> <remote>",
+	ArgsLong: `
+<manifest> is the manifest file to edit.
+
+<name> is the name of the project.
+
+<remote> is the remote url of the project, or "name:path" for a repository on a
+named host.
+`,
+}
+
+func runManifestAddProject(jirix *jiri.X, args []string) error {
+	if len(args) != 3 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file, name, remote := args[0], args[1], args[2]
+	return editManifest(jirix, file, func(m *project.Manifest) error {
+		for _, p := range m.Projects {
+			if p.Name == name {
+				return fmt.Errorf("project %q already exists in %v", name, file)
+			}
+		}
+		path := flagManifestPath
+		if path == "" {
+			path = name
+		}
+		m.Projects = append(m.Projects, project.Project{
+			Name:         name,
+			Path:         path,
+			Protocol:     flagManifestProtocol,
+			Remote:       remote,
+			RemoteBranch: flagManifestRemoteBranch,
+			Revision:     flagManifestRevision,
+			GerritHost:   flagManifestGerritHost,
+			GitHooks:     flagManifestGitHooks,
+			RunHook:      flagManifestRunHook,
+			Groups:       flagManifestGroups,
+		})
+		return nil
+	})
+}
+
+// cmdManifestRemoveProject represents the "jiri manifest remove-project"
+// command.
+var cmdManifestRemoveProject = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestRemoveProject),
+	Name:   "remove-project",
+	Short:  "Remove a project from a manifest",
+	Long: `
+Removes a <project> element from the given manifest file.
+`,
+	ArgsName: "<manifest> <project>",
+	ArgsLong: `
+<manifest> is the manifest file to edit.
+
+<project> is the key or name of the project to remove.
+`,
+}
+
+func runManifestRemoveProject(jirix *jiri.X, args []string) error {
+	if len(args) != 2 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file := args[0]
+	return editManifest(jirix, file, func(m *project.Manifest) error {
+		index, err := findManifestProject(m, file, args[1])
+		if err != nil {
+			return err
+		}
+		m.Projects = append(m.Projects[:index], m.Projects[index+1:]...)
+		return nil
+	})
+}
+
+// cmdManifestSetRevision represents the "jiri manifest set-revision" command.
+var cmdManifestSetRevision = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestSetRevision),
+	Name:   "set-revision",
+	Short:  "Set the revision of a project in a manifest",
+	Long: `
+Sets the revision of a <project> element in the given manifest file.  Setting
+the revision to "HEAD" makes the project track its remote branch.
+`,
+	ArgsName: "<manifest> <project> <revision>",
+	ArgsLong: `
+<manifest> is the manifest file to edit.
+
+<project> is the key or name of the project.
+
+<revision> is the new revision of the project.
+`,
+}
+
+func runManifestSetRevision(jirix *jiri.X, args []string) error {
+	if len(args) != 3 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file := args[0]
+	return editManifest(jirix, file, func(m *project.Manifest) error {
+		index, err := findManifestProject(m, file, args[1])
+		if err != nil {
+			return err
+		}
+		m.Projects[index].Revision = args[2]
+		return nil
+	})
+}
+
+// cmdManifestAddTool represents the "jiri manifest add-tool" command.
+var cmdManifestAddTool = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestAddTool),
+	Name:   "add-tool",
+	Short:  "Add a tool to a manifest",
+	Long: `
+Adds a <tool> element to the given manifest file.  It is an error to add a tool
+with the name of a tool that is already in the manifest.
+`,
+	ArgsName: "<manifest> <name> <package> <project>",
+	ArgsLong: `
+<manifest> is the manifest file to edit.
+
+<name> is the name of the tool binary.
+
+<package> is the Go package of the tool.
+
+<project> is the name of the project that contains the tool.
+`,
+}
+
+func runManifestAddTool(jirix *jiri.X, args []string) error {
+	if len(args) != 4 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file := args[0]
+	return editManifest(jirix, file, func(m *project.Manifest) error {
+		for _, tool := range m.Tools {
+			if tool.Name == args[1] {
+				return fmt.Errorf("tool %q already exists in %v", args[1], file)
+			}
+		}
+		m.Tools = append(m.Tools, project.Tool{
+			Name:    args[1],
+			Package: args[2],
+			Project: args[3],
+			Data:    flagManifestToolData,
+		})
+		return nil
+	})
+}
+
+// cmdManifestRemoveImport represents the "jiri manifest remove-import"
+// command.
+var cmdManifestRemoveImport = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestRemoveImport),
+	Name:   "remove-import",
+	Short:  "Remove an import from a manifest",
+	Long: `
+Removes the <import> elements with the given manifest, and the <localimport>
+elements with the given file, from the given manifest file.  It is an error if
+there are no such elements.
+`,
+	ArgsName: "<manifest> <import>",
+	ArgsLong: `
+<manifest> is the manifest file to edit.
+
+<import> is the manifest of a remote import, or the file of a local import.
+`,
+}
+
+func runManifestRemoveImport(jirix *jiri.X, args []string) error {
+	if len(args) != 2 {
+		return jirix.UsageErrorf("wrong number of arguments")
+	}
+	file, name := args[0], args[1]
+	return editManifest(jirix, file, func(m *project.Manifest) error {
+		removed := false
+		var imports []project.Import
+		for _, imp := range m.Imports {
+			if imp.Manifest == name && (flagManifestImportRemote == "" || imp.Remote == flagManifestImportRemote) {
+				removed = true
+				continue
+			}
+			imports = append(imports, imp)
+		}
+		var localImports []project.LocalImport
+		for _, imp := range m.LocalImports {
+			if imp.File == name && flagManifestImportRemote == "" {
+				removed = true
+				continue
+			}
+			localImports = append(localImports, imp)
+		}
+		if !removed {
+			return fmt.Errorf("no imports found for %q in %v", name, file)
+		}
+		m.Imports, m.LocalImports = imports, localImports
+		return nil
+	})
+}
+
+// cmdManifestValidate represents the "jiri manifest validate" command.
+var cmdManifestValidate = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestValidate),
+	Name:   "validate",
+	Short:  "Check manifest files for errors",
+	Long: `
+Checks that the given manifest files are valid, and reports the errors of the
+files that are not.  Imports are not followed.
+
+Manifests are checked against the schema described by "jiri help manifest":
+unknown elements and attributes are errors, as are projects without a name or
+path, project paths that are absolute or outside the jiri root, projects
+without an "if" attribute that have the same path, and unsupported protocols.
+Each error is reported as "file:line:column: message", which makes the command
+suitable for presubmit checks.
+`,
+	ArgsName: "<manifest>...",
+	ArgsLong: "<manifest>... is a list of manifest files to check.",
+}
+
+func runManifestValidate(jirix *jiri.X, args []string) error {
+	if len(args) == 0 {
+		return jirix.UsageErrorf("no manifest files given")
+	}
+	failed := 0
+	for _, file := range args {
+		if _, err := project.ManifestFromFile(jirix, file); err != nil {
+			fmt.Fprintf(jirix.Stderr(), "%v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifest files are invalid", failed, len(args))
+	}
+	return nil
+}
+
+// cmdManifestFmt represents the "jiri manifest fmt" command.
+var cmdManifestFmt = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runManifestFmt),
+	Name:   "fmt",
+	Short:  "Rewrite manifest files in the canonical format",
+	Long: `
+Rewrites the given manifest files in the canonical format, which is the format
+written by jiri.  With -l, the files that aren't in the canonical format are
+listed instead.
+`,
+	ArgsName: "<manifest>...",
+	ArgsLong: "<manifest>... is a list of manifest files to format.",
+}
+
+func runManifestFmt(jirix *jiri.X, args []string) error {
+	if len(args) == 0 {
+		return jirix.UsageErrorf("no manifest files given")
+	}
+	for _, file := range args {
+		data, err := jirix.NewSeq().ReadFile(file)
+		if err != nil {
+			return err
+		}
+		m, err := project.ManifestFromBytes(data)
+		if err != nil {
+			return fmt.Errorf("invalid manifest %s: %v", file, err)
+		}
+		formatted, err := m.ToBytes()
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(data, formatted) {
+			continue
+		}
+		if flagManifestList {
+			fmt.Fprintln(jirix.Stdout(), file)
+			continue
+		}
+		if err := jirix.NewSeq().WriteFile(file, formatted, 0644).Done(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"v.io/jiri/jiritest"
+	"v.io/jiri/tool"
+)
+
+func resetManifestFlags() {
+	flagManifestPath, flagManifestProtocol, flagManifestRemoteBranch, flagManifestRevision = "", "", "", ""
+	flagManifestGroups, flagManifestGerritHost, flagManifestGitHooks, flagManifestRunHook = "", "", "", ""
+	flagManifestToolData, flagManifestImportRemote = "", ""
+	flagManifestList = false
+}
+
+// TestManifestEdit checks that the "jiri manifest" commands edit manifest
+// files, and write them in the canonical format.
+func TestManifestEdit(t *testing.T) {
+	resetManifestFlags()
+	defer resetManifestFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	file := filepath.Join(fake.X.Root, "test-manifest")
+	original := `<manifest><imports>
+<import manifest="public" name="manifest" remote="https://example.com/manifest"/>
+<localimport file="local"/></imports>
+<projects><project name="a" path="a" remote="https://example.com/a"/></projects>
+</manifest>
+`
+	if err := ioutil.WriteFile(file, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	fake.X.Context = tool.NewContext(tool.ContextOpts{Stdout: &stdout, Stderr: &stderr})
+
+	// The original file is not in the canonical format.
+	flagManifestList = true
+	if err := runManifestFmt(fake.X, []string{file}); err != nil {
+		t.Fatalf("fmt failed: %v", err)
+	}
+	if got, want := stdout.String(), file+"\n"; got != want {
+		t.Errorf("fmt -l: got %q, want %q", got, want)
+	}
+	flagManifestList = false
+
+	flagManifestRevision = "abc"
+	flagManifestGroups = "mobile"
+	if err := runManifestAddProject(fake.X, []string{file, "b", "https://example.com/b"}); err != nil {
+		t.Fatalf("add-project failed: %v", err)
+	}
+	flagManifestRevision, flagManifestGroups = "", ""
+	if err := runManifestAddProject(fake.X, []string{file, "b", "https://example.com/b"}); err == nil {
+		t.Errorf("add-project of an existing project did not fail")
+	}
+	if err := runManifestSetRevision(fake.X, []string{file, "a", "def"}); err != nil {
+		t.Fatalf("set-revision failed: %v", err)
+	}
+	if err := runManifestSetRevision(fake.X, []string{file, "c", "def"}); err == nil {
+		t.Errorf("set-revision of a missing project did not fail")
+	}
+	if err := runManifestRemoveProject(fake.X, []string{file, "b"}); err != nil {
+		t.Fatalf("remove-project failed: %v", err)
+	}
+	if err := runManifestAddTool(fake.X, []string{file, "tool", "example.com/tool", "a"}); err != nil {
+		t.Fatalf("add-tool failed: %v", err)
+	}
+	if err := runManifestRemoveImport(fake.X, []string{file, "local"}); err != nil {
+		t.Fatalf("remove-import failed: %v", err)
+	}
+	if err := runManifestRemoveImport(fake.X, []string{file, "local"}); err == nil {
+		t.Errorf("remove-import of a missing import did not fail")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<manifest>
+  <imports>
+    <import manifest="public" name="manifest" remote="https://example.com/manifest"/>
+  </imports>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a" revision="def"/>
+  </projects>
+  <tools>
+    <tool name="tool" package="example.com/tool" project="a"/>
+  </tools>
+</manifest>
+`
+	if got := string(data); got != want {
+		t.Errorf("got manifest:\n%v\nwant:\n%v", got, want)
+	}
+
+	// The edited file is in the canonical format, and valid.
+	stdout.Reset()
+	flagManifestList = true
+	if err := runManifestFmt(fake.X, []string{file}); err != nil {
+		t.Fatalf("fmt failed: %v", err)
+	}
+	if got := stdout.String(); got != "" {
+		t.Errorf("fmt -l: got %q, want no files", got)
+	}
+	if err := runManifestValidate(fake.X, []string{file}); err != nil {
+		t.Errorf("validate failed: %v", err)
+	}
+
+	// Invalid manifests are reported.
+	invalid := filepath.Join(fake.X.Root, "invalid-manifest")
+	if err := ioutil.WriteFile(invalid, []byte(`<manifest><projects><project name="x"/>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runManifestValidate(fake.X, []string{file, invalid}); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("validate: got error %v, want 1 of 2 invalid files", err)
+	}
+	if got := stderr.String(); !strings.Contains(got, invalid) {
+		t.Errorf("validate: got stderr %q, want the invalid file", got)
+	}
+}
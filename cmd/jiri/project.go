@@ -137,7 +137,16 @@ that the contains the current directory is used, or if run from outside
 of a given project, all projects will be used. The information to be
 displayed is specified using a go template, supplied via the -f flag, that is
 executed against the v.io/jiri/project.ProjectState structure. This structure
-currently has the following fields: ` + fmt.Sprintf("%#v", project.ProjectState{}),
+currently has the following fields: ` + fmt.Sprintf("%#v", project.ProjectState{}) + `
+
+The git configuration settings and remotes that the manifest declares for a
+project, which "jiri update" applies to its repository, are in the GitConfigs
+and GitRemotes fields of the project, e.g. -f '{{.Project.Name}}
+{{.Project.GitConfigs}} {{.Project.GitRemotes}}'.
+
+Unless only the project that contains the current directory is used, the
+manifest imports, projects and tools that are skipped on this host, since their
+"if" condition doesn't hold, are reported on stderr along with the reason.`,
 	ArgsName: "<project-keys>...",
 	ArgsLong: "<project-keys>... a list of project keys, as regexps, to apply the specified format to",
 }
@@ -171,6 +180,9 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 
 	var states map[project.ProjectKey]*project.ProjectState
 	var keys project.ProjectKeys
+	// allProjects is true if the info covers all projects, rather than the
+	// current project.
+	allProjects := true
 	if len(args) == 0 {
 		currentProjectKey, err := project.CurrentProjectKey(jirix)
 		if err != nil {
@@ -192,6 +204,7 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 				currentProjectKey: state,
 			}
 			keys = append(keys, currentProjectKey)
+			allProjects = false
 		}
 	} else {
 		var err error
@@ -218,6 +231,29 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 		}
 		fmt.Fprintln(jirix.Stdout(), out.String())
 	}
+	if !allProjects {
+		return nil
+	}
+	// Report the manifest elements that were skipped on this host, since
+	// their condition doesn't hold.
+	// The local projects are reported even if the manifest can't be loaded.
+	skipped, err := project.SkippedElements(jirix)
+	if err != nil {
+		fmt.Fprintf(jirix.Stderr(), "WARNING: can't report the skipped manifest elements: %v\n", err)
+		return nil
+	}
+	for _, e := range skipped {
+		matches := len(regexps) == 0
+		for _, re := range regexps {
+			if re.MatchString(e.Name) {
+				matches = true
+				break
+			}
+		}
+		if matches {
+			fmt.Fprintln(jirix.Stderr(), e)
+		}
+	}
 	return nil
 }
 
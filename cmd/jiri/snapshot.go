@@ -5,12 +5,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"v.io/jiri"
@@ -26,16 +31,41 @@ const (
 )
 
 var (
-	pushRemoteFlag  bool
-	snapshotDirFlag string
-	snapshotGcFlag  bool
-	timeFormatFlag  string
+	pushRemoteFlag      bool
+	snapshotDirFlag     string
+	snapshotGcFlag      bool
+	snapshotJobsFlag    int
+	snapshotLogFlag     bool
+	snapshotJSONFlag    bool
+	includeBranchesFlag bool
+	includeDirtyFlag    bool
+	keepLastFlag        int
+	keepWithinFlag      time.Duration
+	keepDailyFlag       int
+	keepWeeklyFlag      int
+	pruneHistoryFlag    bool
+	pruneDryRunFlag     bool
+	timeFormatFlag      string
 )
 
 func init() {
 	cmdSnapshot.Flags.StringVar(&snapshotDirFlag, "dir", "", "Directory where snapshot are stored.  Defaults to $JIRI_ROOT/.snapshot.")
 	cmdSnapshotCheckout.Flags.BoolVar(&snapshotGcFlag, "gc", false, "Garbage collect obsolete repositories.")
+	cmdSnapshotCheckout.Flags.IntVar(&snapshotJobsFlag, "jobs", project.DefaultJobs, "Number of projects to update concurrently.")
+	cmdSnapshotBisect.Flags.IntVar(&snapshotJobsFlag, "jobs", project.DefaultJobs, "Number of projects to update concurrently.")
+	cmdSnapshotBisect.Flags.BoolVar(&snapshotLogFlag, "log", false, "List the commits between the last good and first bad revision of each changed project, read from its local clone.")
+	cmdSnapshotDiff.Flags.BoolVar(&snapshotLogFlag, "log", false, "List the commits between the old and new revision of each changed project, read from its local clone.")
+	cmdSnapshotDiff.Flags.BoolVar(&snapshotJSONFlag, "json", false, "Print the differences in JSON format.")
+	cmdSnapshotPrune.Flags.IntVar(&keepLastFlag, "keep-last", 0, "Keep the given number of newest snapshots.")
+	cmdSnapshotPrune.Flags.DurationVar(&keepWithinFlag, "keep-within", 0, "Keep the snapshots newer than the given duration, e.g. 720h.")
+	cmdSnapshotPrune.Flags.IntVar(&keepDailyFlag, "keep-daily", 0, "Keep the newest snapshot of each of the given number of most recent days with snapshots.")
+	cmdSnapshotPrune.Flags.IntVar(&keepWeeklyFlag, "keep-weekly", 0, "Keep the newest snapshot of each of the given number of most recent weeks with snapshots.")
+	cmdSnapshotPrune.Flags.BoolVar(&pruneHistoryFlag, "history", false, "Prune the update history rather than snapshot labels.")
+	cmdSnapshotPrune.Flags.BoolVar(&pruneDryRunFlag, "n", false, "Show what would be removed, but don't remove anything.")
+	cmdSnapshotPrune.Flags.BoolVar(&pushRemoteFlag, "push-remote", false, "Commit and push the removal of snapshots upstream.")
 	cmdSnapshotCreate.Flags.BoolVar(&pushRemoteFlag, "push-remote", false, "Commit and push snapshot upstream.")
+	cmdSnapshotCreate.Flags.BoolVar(&includeBranchesFlag, "include-branches", false, "Record the current branch and revision of projects that are not on master.")
+	cmdSnapshotCreate.Flags.BoolVar(&includeDirtyFlag, "include-dirty", false, "Record the uncommitted changes of projects as patches.")
 	cmdSnapshotCreate.Flags.StringVar(&timeFormatFlag, "time-format", time.RFC3339, "Time format for snapshot file name.")
 }
 
@@ -47,7 +77,7 @@ The "jiri snapshot" command can be used to manage project snapshots.
 In particular, it can be used to create new snapshots and to list
 existing snapshots.
 `,
-	Children: []*cmdline.Command{cmdSnapshotCheckout, cmdSnapshotCreate, cmdSnapshotList},
+	Children: []*cmdline.Command{cmdSnapshotBisect, cmdSnapshotCheckout, cmdSnapshotCreate, cmdSnapshotDiff, cmdSnapshotList, cmdSnapshotPrune},
 }
 
 // cmdSnapshotCreate represents the "jiri snapshot create" command.
@@ -80,6 +110,17 @@ Internally, snapshots are organized as follows:
 
 NOTE: Unlike the jiri tool commands, the above internal organization
 is not an API. It is an implementation and can change without notice.
+
+By default, a snapshot records the revision of the master branch of each
+project.  With -include-branches, it also records the current branch and
+revision of each project that is not on master, along with a git bundle of the
+commits of the branch that are not on master.  With -include-dirty, it records
+the uncommitted changes of each project as a patch, relative to the current
+branch if it is recorded, or to master otherwise.  Untracked files are not
+recorded.  The bundles and patches are stored in the <snapshot>.patches
+directory next to the snapshot, and "jiri snapshot checkout" restores the
+branches and changes onto the projects, so that a snapshot can hand over a
+work in progress.
 `,
 	ArgsName: "<label>",
 	ArgsLong: "<label> is the snapshot label.",
@@ -153,7 +194,8 @@ func getSnapshotDir(jirix *jiri.X) (string, error) {
 func createSnapshot(jirix *jiri.X, snapshotDir, snapshotFile, label string) error {
 	// Create a snapshot that encodes the current state of master
 	// branches for all local projects.
-	if err := project.CreateSnapshot(jirix, snapshotFile, ""); err != nil {
+	opts := []project.SnapshotOpt{project.IncludeBranchesOpt(includeBranchesFlag), project.IncludeDirtyOpt(includeDirtyFlag)}
+	if err := project.CreateSnapshot(jirix, snapshotFile, "", opts...); err != nil {
 		return err
 	}
 
@@ -192,6 +234,14 @@ func commitAndPushChanges(jirix *jiri.X, snapshotDir, snapshotFile, label string
 	if err := git.Add(label); err != nil {
 		return err
 	}
+	patchDir := project.SnapshotPatchDir(relativeSnapshotPath)
+	if exists, err := jirix.NewSeq().IsDir(patchDir); err != nil {
+		return err
+	} else if exists {
+		if err := git.Add(patchDir); err != nil {
+			return err
+		}
+	}
 	name := strings.TrimPrefix(snapshotFile, snapshotDir)
 	if err := git.CommitNoVerify(fmt.Sprintf("adding snapshot %q for label %q", name, label)); err != nil {
 		return err
@@ -202,6 +252,164 @@ func commitAndPushChanges(jirix *jiri.X, snapshotDir, snapshotFile, label string
 	return nil
 }
 
+// cmdSnapshotBisect represents the "jiri snapshot bisect" command.
+var cmdSnapshotBisect = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runSnapshotBisect),
+	Name:   "bisect",
+	Short:  "Find the first bad snapshot with a binary search",
+	Long: `
+The "jiri snapshot bisect <good> <bad> -- <command>" command finds the first
+snapshot in which the command fails, among the snapshots from the good to the
+bad one.  Both must be snapshots of the same label, or of the update history,
+and are given like for "jiri snapshot diff".  The good snapshot is assumed to
+pass and the bad one to fail.
+
+Each step checks out the snapshot halfway between the last known good and the
+first known bad snapshot, like "jiri snapshot checkout", and runs the command
+in the current directory.  The snapshot is good if the command succeeds, and
+bad otherwise.  Finally, the first bad and last good snapshots are reported,
+along with the projects that changed between them, like "jiri snapshot diff".
+
+The projects must not have uncommitted changes.  Projects that are on another
+branch than master are switched to master while bisecting.  The original
+state of all projects, including their current branches, is restored at the
+end, even if the bisection fails or is interrupted.  The checkouts are not
+recorded in the update history, so "jiri update rollback" is not affected.
+`,
+	ArgsName: "<good> <bad> -- <command> [<arg> ...]",
+	ArgsLong: `
+<good> and <bad> are the snapshots to search between, and <command> is the
+command that tests each snapshot, along with its arguments.
+`,
+}
+
+func runSnapshotBisect(jirix *jiri.X, args []string) (e error) {
+	if len(args) < 3 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	var files []string
+	for _, arg := range args[:2] {
+		file, err := resolveSnapshot(jirix, arg)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	snapshots, err := project.SnapshotsBetween(jirix, files[0], files[1])
+	if err != nil {
+		return err
+	}
+	command := args[2:]
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return fmt.Errorf("command %q not found: %v", command[0], err)
+	}
+	branches, err := currentBranches(jirix)
+	if err != nil {
+		return err
+	}
+
+	// Record the original state, including the current branches, and restore
+	// it once done.  Interrupts stop the bisection, rather than jiri, so that
+	// the original state is restored.
+	s := jirix.NewSeq()
+	tmpDir, err := s.TempDir("", "tmp-jiri-bisect")
+	if err != nil {
+		return fmt.Errorf("TempDir() failed: %v", err)
+	}
+	original := filepath.Join(tmpDir, "original")
+	if err := project.CreateSnapshot(jirix, original, "", project.IncludeBranchesOpt(true)); err != nil {
+		return err
+	}
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	defer collect.Error(func() error {
+		fmt.Fprintln(jirix.Stdout(), "restoring the original state")
+		if err := project.CheckoutSnapshot(jirix, original, false, project.JobsOpt(snapshotJobsFlag), project.SkipUpdateHistoryOpt(true)); err != nil {
+			return fmt.Errorf("failed to restore the original state, run \"jiri snapshot checkout %v\" to restore it: %v", original, err)
+		}
+		return jirix.NewSeq().RemoveAll(tmpDir).Done()
+	}, &e)
+	interrupted := func() error {
+		select {
+		case sig := <-interrupts:
+			return fmt.Errorf("bisection interrupted by %v", sig)
+		default:
+			return nil
+		}
+	}
+
+	// Switch all projects to master, so that they are tested at the revisions
+	// of the snapshots.
+	for path, branch := range branches {
+		if branch != "master" {
+			if err := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(path)).CheckoutBranch("master"); err != nil {
+				return err
+			}
+		}
+	}
+	good, bad := 0, len(snapshots)-1
+	for bad-good > 1 {
+		mid := (good + bad) / 2
+		fmt.Fprintf(jirix.Stdout(), "bisecting: %d snapshots left to test, checking out %v\n", bad-good-1, snapshots[mid])
+		if err := project.CheckoutSnapshot(jirix, snapshots[mid], false, project.JobsOpt(snapshotJobsFlag), project.SkipUpdateHistoryOpt(true)); err != nil {
+			return err
+		}
+		if err := interrupted(); err != nil {
+			return err
+		}
+		err := jirix.NewSeq().Capture(jirix.Stdout(), jirix.Stderr()).Last(command[0], command[1:]...)
+		if err := interrupted(); err != nil {
+			return err
+		}
+		if err == nil {
+			fmt.Fprintf(jirix.Stdout(), "snapshot %v is good\n", snapshots[mid])
+			good = mid
+		} else {
+			fmt.Fprintf(jirix.Stdout(), "snapshot %v is bad: %v\n", snapshots[mid], err)
+			bad = mid
+		}
+	}
+	fmt.Fprintf(jirix.Stdout(), "first bad snapshot: %v\nlast good snapshot: %v\n", snapshots[bad], snapshots[good])
+	changes, err := project.DiffSnapshots(jirix, snapshots[good], snapshots[bad], snapshotLogFlag)
+	if err != nil {
+		return err
+	}
+	return printSnapshotChanges(jirix, changes)
+}
+
+// currentBranches returns the current branches of the local git projects,
+// keyed by their paths, and fails if any of them has uncommitted changes.
+func currentBranches(jirix *jiri.X) (map[string]string, error) {
+	projects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return nil, err
+	}
+	branches := map[string]string{}
+	var dirty []string
+	for _, p := range projects {
+		if p.Protocol != "git" {
+			continue
+		}
+		git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(p.Path))
+		if uncommitted, err := git.HasUncommittedChanges(); err != nil {
+			return nil, err
+		} else if uncommitted {
+			dirty = append(dirty, p.Name)
+		}
+		branch, err := git.CurrentBranchName()
+		if err != nil {
+			return nil, err
+		}
+		branches[p.Path] = branch
+	}
+	if len(dirty) > 0 {
+		sort.Strings(dirty)
+		return nil, fmt.Errorf("projects %v have uncommitted changes, commit or stash them first", dirty)
+	}
+	return branches, nil
+}
+
 // cmdSnapshotCheckout represents the "jiri snapshot checkout" command.
 var cmdSnapshotCheckout = &cmdline.Command{
 	Runner: jiri.RunnerFunc(runSnapshotCheckout),
@@ -210,16 +418,200 @@ var cmdSnapshotCheckout = &cmdline.Command{
 	Long: `
 The "jiri snapshot checkout <snapshot>" command restores local project state to
 the state in the given snapshot manifest.
-`,
+
+The snapshot is the path of a snapshot manifest file, a snapshot label, which
+stands for its latest snapshot, the name of a snapshot in the update history
+in $JIRI_ROOT/.jiri_root/update_history, e.g. "latest" or "second-latest", or
+a selector of a snapshot of a label.
+
+The branches and uncommitted changes recorded by "jiri snapshot create
+-include-branches -include-dirty" are restored once the projects have been
+updated.  A branch is created at its recorded revision, from the bundle of the
+snapshot if necessary, and checked out, and the recorded changes are applied on
+top of it.  Projects that have uncommitted changes, or whose branch already
+exists at another revision, are left as they are and reported.
+` + snapshotSelectorDoc,
 	ArgsName: "<snapshot>",
-	ArgsLong: "<snapshot> is the snapshot manifest file.",
+	ArgsLong: "<snapshot> is the snapshot to check out.",
 }
 
 func runSnapshotCheckout(jirix *jiri.X, args []string) error {
 	if len(args) != 1 {
 		return jirix.UsageErrorf("unexpected number of arguments")
 	}
-	return project.CheckoutSnapshot(jirix, args[0], snapshotGcFlag)
+	file, err := resolveSnapshot(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	return project.CheckoutSnapshot(jirix, file, snapshotGcFlag, project.JobsOpt(snapshotJobsFlag))
+}
+
+// cmdSnapshotDiff represents the "jiri snapshot diff" command.
+var cmdSnapshotDiff = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runSnapshotDiff),
+	Name:   "diff",
+	Short:  "Compare two project snapshots",
+	Long: `
+The "jiri snapshot diff <old> <new>" command lists the projects that were
+added, removed, moved or changed from the old to the new snapshot, along with
+their old and new revisions.  Renamed projects are matched by their former
+name or path, like in "jiri update".
+
+Each snapshot is the path of a snapshot manifest file, a snapshot label, which
+stands for its latest snapshot, the name of a snapshot in the update history
+in $JIRI_ROOT/.jiri_root/update_history, e.g. "latest" or "second-latest", or
+a selector of a snapshot of a label.
+
+With -log, the commits from the old to the new revision of each changed project
+are listed as well.  They are read from the local clone of the project, so
+projects that are not checked out, or whose revisions haven't been fetched, are
+reported without their log.
+` + snapshotSelectorDoc,
+	ArgsName: "<old> <new>",
+	ArgsLong: "<old> and <new> are the snapshots to compare.",
+}
+
+func runSnapshotDiff(jirix *jiri.X, args []string) error {
+	if len(args) != 2 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	var files []string
+	for _, arg := range args {
+		file, err := resolveSnapshot(jirix, arg)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	changes, err := project.DiffSnapshots(jirix, files[0], files[1], snapshotLogFlag)
+	if err != nil {
+		return err
+	}
+	return printSnapshotChanges(jirix, changes)
+}
+
+// printSnapshotChanges prints the given project changes between snapshots,
+// along with their logs, in text or JSON format.
+func printSnapshotChanges(jirix *jiri.X, changes []project.ProjectChange) error {
+	if snapshotJSONFlag {
+		data, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return fmt.Errorf("MarshalIndent() failed: %v", err)
+		}
+		fmt.Fprintln(jirix.Stdout(), string(data))
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Fprintln(jirix.Stdout(), change)
+		if change.LogError != "" {
+			fmt.Fprintf(jirix.Stdout(), "  no log: %v\n", change.LogError)
+		}
+		for _, commit := range change.Log {
+			fmt.Fprintf(jirix.Stdout(), "  %v\n", commit)
+		}
+	}
+	return nil
+}
+
+// resolveSnapshot returns the snapshot manifest file identified by arg, which
+// is either the path of the file, a snapshot label, which identifies its latest
+// snapshot, the name of a snapshot in the update history, or a selector of a
+// snapshot of a label, as described by snapshotSelectorDoc.
+func resolveSnapshot(jirix *jiri.X, arg string) (string, error) {
+	s := jirix.NewSeq()
+	if isFile, err := s.IsFile(arg); err != nil {
+		return "", err
+	} else if isFile {
+		return arg, nil
+	}
+	snapshotDir, err := getSnapshotDir(jirix)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range []string{
+		filepath.Join(snapshotDir, arg),
+		filepath.Join(jirix.UpdateHistoryDir(), arg),
+	} {
+		if isFile, err := s.IsFile(file); err != nil {
+			return "", err
+		} else if isFile {
+			return file, nil
+		}
+	}
+	if label, query, ok, err := parseSnapshotSelector(arg); err != nil {
+		return "", err
+	} else if ok {
+		labelDir := filepath.Join(snapshotDir, "labels", label)
+		if exists, err := s.IsDir(labelDir); err != nil {
+			return "", err
+		} else if !exists {
+			return "", fmt.Errorf("snapshot label %q not found", label)
+		}
+		return project.FindSnapshot(jirix, labelDir, query)
+	}
+	return "", fmt.Errorf("snapshot %q is neither a file, nor a label in %v, nor a snapshot in %v", arg, snapshotDir, jirix.UpdateHistoryDir())
+}
+
+// snapshotSelectorDoc describes the snapshot selectors of parseSnapshotSelector.
+const snapshotSelectorDoc = `
+A snapshot of a label may also be selected as follows:
+
+ <label>@<time>                 The snapshot in effect at the given time, i.e.
+                                the newest one taken at or before that time.
+                                The time is either RFC3339, e.g.
+                                2016-03-01T15:04:05-08:00, or local time, e.g.
+                                2016-03-01T15:04, or a date, e.g. 2016-03-01,
+                                which stands for the end of that day.
+ <label>~<n>                    The nth most recent snapshot, where <label>~1
+                                is the latest one.
+ <label>:<project>=<revision>   The newest snapshot in which the project is at
+                                the revision or after it, as determined by the
+                                local clone of the project.
+`
+
+// selectorTimeLayouts are the time formats accepted by "<label>@<time>"
+// selectors, in local time unless they specify a time zone.
+var selectorTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseSnapshotSelector parses a snapshot selector described by
+// snapshotSelectorDoc into its label and query.  It returns false if arg
+// isn't a selector.
+func parseSnapshotSelector(arg string) (string, project.SnapshotQuery, bool, error) {
+	var query project.SnapshotQuery
+	index := strings.IndexAny(arg, "@~:")
+	if index <= 0 {
+		return "", query, false, nil
+	}
+	label, value := arg[:index], arg[index+1:]
+	switch arg[index] {
+	case '@':
+		for _, layout := range selectorTimeLayouts {
+			t, err := time.ParseInLocation(layout, value, time.Local)
+			if err != nil {
+				continue
+			}
+			if layout == "2006-01-02" {
+				t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			query.At = t
+			return label, query, true, nil
+		}
+		return "", query, false, fmt.Errorf("invalid time %q in snapshot selector %q, want e.g. 2016-03-01 or 2016-03-01T15:04", value, arg)
+	case '~':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return "", query, false, fmt.Errorf("invalid number %q in snapshot selector %q, want a positive integer", value, arg)
+		}
+		query.Nth = n
+		return label, query, true, nil
+	default:
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", query, false, fmt.Errorf("invalid snapshot selector %q, want <label>:<project>=<revision>", arg)
+		}
+		query.Project, query.Revision = parts[0], parts[1]
+		return label, query, true, nil
+	}
 }
 
 // cmdSnapshotList represents the "jiri snapshot list" command.
@@ -292,8 +684,167 @@ func runSnapshotList(jirix *jiri.X, args []string) error {
 		}
 		fmt.Fprintf(jirix.Stdout(), "snapshots of label %q:\n", label)
 		for _, fileInfo := range fileInfoList {
+			// Skip the bundles and patches of snapshots, which aren't
+			// snapshots that selectors could select.
+			if fileInfo.IsDir() {
+				continue
+			}
 			fmt.Fprintf(jirix.Stdout(), "  %v\n", fileInfo.Name())
 		}
 	}
 	return nil
 }
+
+// cmdSnapshotPrune represents the "jiri snapshot prune" command.
+var cmdSnapshotPrune = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runSnapshotPrune),
+	Name:   "prune",
+	Short:  "Remove old project snapshots",
+	Long: `
+The "jiri snapshot prune" command removes the snapshots of the given labels, or
+of all labels if none are given, that the retention policy doesn't keep.  With
+-history, it prunes the update history in $JIRI_ROOT/.jiri_root/update_history
+instead.
+
+A snapshot is kept if any of the -keep-last, -keep-within, -keep-daily and
+-keep-weekly rules keeps it.  If none of them is given, the retention policy in
+$JIRI_ROOT/.jiri_manifest is used, which "jiri update" also applies to the
+update history after every update.  The snapshots that the label symlinks, or
+the "latest" and "second-latest" symlinks of the update history, point to are
+always kept.  Snapshots are dated by their names if they use the default time
+format, and by their modification times otherwise.
+
+If the snapshot directory is a git repository, -push-remote commits and pushes
+the removal of snapshots upstream.  Without it, removing a committed snapshot
+is refused, rather than leaving the repository with uncommitted changes.
+
+Run "jiri help manifest" for details on the retention policy.
+`,
+	ArgsName: "<label ...>",
+	ArgsLong: "<label ...> is a list of snapshot labels.",
+}
+
+func runSnapshotPrune(jirix *jiri.X, args []string) error {
+	if pruneHistoryFlag && len(args) > 0 {
+		return jirix.UsageErrorf("labels can't be given with -history")
+	}
+	if pruneHistoryFlag && pushRemoteFlag {
+		return jirix.UsageErrorf("-push-remote can't be used with -history")
+	}
+	policy := project.RetentionPolicy{KeepLast: keepLastFlag, KeepDaily: keepDailyFlag, KeepWeekly: keepWeeklyFlag}
+	if keepWithinFlag != 0 {
+		policy.KeepWithin = keepWithinFlag.String()
+	}
+	if policy == (project.RetentionPolicy{}) {
+		configured, err := project.LoadRetentionPolicy(jirix)
+		if err != nil {
+			return err
+		}
+		if configured == nil {
+			return jirix.UsageErrorf("no retention policy given, and none is configured in %v", jirix.JiriManifestFile())
+		}
+		policy = *configured
+	}
+	var removed []string
+	if pruneHistoryFlag {
+		files, err := project.PruneUpdateHistory(jirix, policy, pruneDryRunFlag)
+		if err != nil {
+			return err
+		}
+		removed = files
+	} else {
+		snapshotDir, err := getSnapshotDir(jirix)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			labelsDir := filepath.Join(snapshotDir, "labels")
+			fileInfoList, err := jirix.NewSeq().ReadDir(labelsDir)
+			if err != nil && !runutil.IsNotExist(err) {
+				return err
+			}
+			for _, fileInfo := range fileInfoList {
+				if fileInfo.IsDir() {
+					args = append(args, fileInfo.Name())
+				}
+			}
+		}
+		sort.Strings(args)
+		for _, label := range args {
+			files, err := pruneLabel(jirix, snapshotDir, label, policy)
+			if err != nil {
+				return err
+			}
+			removed = append(removed, files...)
+		}
+	}
+	verb := "removed"
+	if pruneDryRunFlag {
+		verb = "would remove"
+	}
+	for _, file := range removed {
+		fmt.Fprintf(jirix.Stdout(), "%s %v\n", verb, file)
+	}
+	return nil
+}
+
+// pruneLabel removes the snapshots of the given label that the policy doesn't
+// keep, and returns their paths.  With -push-remote, the removal is committed
+// and pushed upstream on a clean master branch.  Otherwise, removing a snapshot
+// that is committed to the snapshot repository is refused.
+func pruneLabel(jirix *jiri.X, snapshotDir, label string, policy project.RetentionPolicy) ([]string, error) {
+	labelDir := filepath.Join(snapshotDir, "labels", label)
+	if exists, err := jirix.NewSeq().IsDir(labelDir); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("snapshot label %q not found", label)
+	}
+	links := []string{filepath.Join(snapshotDir, label)}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(snapshotDir))
+	if !pushRemoteFlag || pruneDryRunFlag {
+		if !pruneDryRunFlag {
+			files, err := project.PruneSnapshots(jirix, labelDir, links, policy, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if git.IsFileCommitted(file) {
+					return nil, fmt.Errorf("snapshot %v is committed to the snapshot repository, use -push-remote to commit and push its removal", file)
+				}
+			}
+		}
+		return project.PruneSnapshots(jirix, labelDir, links, policy, pruneDryRunFlag)
+	}
+
+	var removed []string
+	pruneFn := func() error {
+		// Pull from master so we are up-to-date.
+		if err := git.Pull("origin", "master"); err != nil {
+			return err
+		}
+		files, err := project.PruneSnapshots(jirix, labelDir, links, policy, false)
+		if err != nil || len(files) == 0 {
+			return err
+		}
+		removed = files
+		if err := git.Add(labelDir); err != nil {
+			return err
+		}
+		if err := git.CommitNoVerify(fmt.Sprintf("pruning %d snapshots for label %q", len(files), label)); err != nil {
+			return err
+		}
+		return git.Push("origin", "master", gitutil.VerifyOpt(false))
+	}
+
+	// Execute the above function in the snapshot directory on a clean master branch.
+	p := project.Project{
+		Path:         snapshotDir,
+		Protocol:     "git",
+		RemoteBranch: "master",
+		Revision:     "HEAD",
+	}
+	if err := project.ApplyToLocalMaster(jirix, project.Projects{p.Key(): p}, pruneFn); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -7,9 +7,14 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"v.io/jiri"
 	"v.io/jiri/gitutil"
@@ -180,6 +185,13 @@ func writeReadme(t *testing.T, jirix *jiri.X, projectDir, message string) {
 func resetFlags() {
 	snapshotDirFlag = ""
 	pushRemoteFlag = false
+	snapshotLogFlag = false
+	snapshotJSONFlag = false
+	includeBranchesFlag = false
+	includeDirtyFlag = false
+	keepLastFlag, keepWithinFlag, keepDailyFlag, keepWeeklyFlag = 0, 0, 0, 0
+	pruneHistoryFlag = false
+	pruneDryRunFlag = false
 }
 
 func TestGetSnapshotDir(t *testing.T) {
@@ -340,3 +352,538 @@ func TestCreatePushRemote(t *testing.T) {
 		t.Errorf("expected file %v to be committed but it was not", labelFile)
 	}
 }
+
+// TestDiff checks that "jiri snapshot diff" lists the projects that differ
+// between two snapshots, along with their commit logs.
+func TestDiff(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	numProjects := 3
+	for i := 0; i < numProjects; i++ {
+		if err := fake.CreateRemoteProject(remoteProjectName(i)); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(i)], "revision 1")
+	}
+	for i := 0; i < 2; i++ {
+		if err := fake.AddProject(project.Project{
+			Name:   remoteProjectName(i),
+			Path:   localProjectName(i),
+			Remote: fake.Projects[remoteProjectName(i)],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := project.UpdateUniverse(fake.X, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSnapshotCreate(fake.X, []string{"before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advance the first project by two commits, remove the second project and
+	// add the third one.
+	writeReadme(t, fake.X, fake.Projects[remoteProjectName(0)], "revision 2")
+	writeReadme(t, fake.X, fake.Projects[remoteProjectName(0)], "revision 3")
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var projects []project.Project
+	for _, p := range m.Projects {
+		if p.Name != remoteProjectName(1) {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = append(projects, project.Project{
+		Name:   remoteProjectName(2),
+		Path:   localProjectName(2),
+		Remote: fake.Projects[remoteProjectName(2)],
+	})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(fake.X, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSnapshotCreate(fake.X, []string{"after"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old snapshot is given by its label, and the new one by its file.
+	var stdout bytes.Buffer
+	fake.X.Context = tool.NewContext(tool.ContextOpts{Stdout: &stdout})
+	snapshotLogFlag = true
+	after := filepath.Join(fake.X.Root, defaultSnapshotDir, "after")
+	if err := runSnapshotDiff(fake.X, []string{"before", after}); err != nil {
+		t.Fatal(err)
+	}
+	got := stdout.String()
+	for _, want := range []string{
+		fmt.Sprintf(`changed project %q in %q from "[0-9a-f]{8}" to "[0-9a-f]{8}"\n(  [0-9a-f]+ creating README\n){2}`, remoteProjectName(0), filepath.Join(fake.X.Root, localProjectName(0))),
+		fmt.Sprintf(`removed project %q from %q at "[0-9a-f]{8}"\n`, remoteProjectName(1), filepath.Join(fake.X.Root, localProjectName(1))),
+		fmt.Sprintf(`added project %q in %q at "[0-9a-f]{8}"\n`, remoteProjectName(2), filepath.Join(fake.X.Root, localProjectName(2))),
+	} {
+		if !regexp.MustCompile(want).MatchString(got) {
+			t.Errorf("diff %q doesn't match %q", got, want)
+		}
+	}
+	if strings.Contains(got, remoteProjectName(1)+`" in`) {
+		t.Errorf("diff %q lists removed project %q as changed", got, remoteProjectName(1))
+	}
+
+	if err := runSnapshotDiff(fake.X, []string{"before", "missing"}); err == nil || !strings.Contains(err.Error(), `snapshot "missing"`) {
+		t.Errorf("got error %v, want missing snapshot", err)
+	}
+}
+
+// TestCreateIncludeLocalState checks that snapshots created with
+// -include-branches and -include-dirty restore the branches and uncommitted
+// changes of the projects on checkout.
+func TestCreateIncludeLocalState(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	// The paths of the projects would collide if their separators were
+	// replaced in the names of the bundles and patches.
+	paths := []string{"a_b", filepath.Join("a", "b")}
+	for i := 0; i < 2; i++ {
+		if err := fake.CreateRemoteProject(remoteProjectName(i)); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(i)], "revision 1")
+		if err := fake.AddProject(project.Project{
+			Name:   remoteProjectName(i),
+			Path:   paths[i],
+			Remote: fake.Projects[remoteProjectName(i)],
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := project.UpdateUniverse(fake.X, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first project has a local branch with a commit and uncommitted
+	// changes on top of it, and the second one has uncommitted changes on
+	// master.
+	s := fake.X.NewSeq()
+	dirs := []string{filepath.Join(fake.X.Root, paths[0]), filepath.Join(fake.X.Root, paths[1])}
+	git := gitutil.New(s, gitutil.RootDirOpt(dirs[0]))
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, dirs[0], "feature")
+	featureRevision, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dir := range dirs {
+		if err := s.WriteFile(filepath.Join(dir, "README"), []byte(fmt.Sprintf("work in progress %d", i)), 0644).Done(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	includeBranchesFlag, includeDirtyFlag = true, true
+	if err := runSnapshotCreate(fake.X, []string{"wip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Discard the local state, including the commit of the branch, which then
+	// has to be restored from the bundle of the snapshot.
+	if err := git.CheckoutBranch("master", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.DeleteBranch("feature", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Dir(dirs[0]).Last("git", "reflog", "expire", "--expire=now", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Dir(dirs[0]).Last("git", "gc", "--prune=now", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if git.IsRevisionAvailable(featureRevision) {
+		t.Fatalf("revision %v is still available", featureRevision)
+	}
+	if err := gitutil.New(s, gitutil.RootDirOpt(dirs[1])).Reset("HEAD"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSnapshotCheckout(fake.X, []string{filepath.Join(fake.X.Root, defaultSnapshotDir, "wip")}); err != nil {
+		t.Fatal(err)
+	}
+	if branch, err := git.CurrentBranchName(); err != nil {
+		t.Fatal(err)
+	} else if got, want := branch, "feature"; got != want {
+		t.Errorf("got branch %v, want %v", got, want)
+	}
+	if revision, err := git.CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if got, want := revision, featureRevision; got != want {
+		t.Errorf("got revision %v, want %v", got, want)
+	}
+	for i, dir := range dirs {
+		data, err := s.ReadFile(filepath.Join(dir, "README"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), fmt.Sprintf("work in progress %d", i); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// The local state isn't restored over uncommitted changes.
+	if err := runSnapshotCheckout(fake.X, []string{filepath.Join(fake.X.Root, defaultSnapshotDir, "wip")}); err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+		t.Errorf("got error %v, want uncommitted changes", err)
+	}
+}
+
+// TestPrune checks that "jiri snapshot prune" removes the old snapshots of
+// labels and of the update history.
+func TestPrune(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	var names []string
+	for day := 1; day <= 3; day++ {
+		names = append(names, time.Date(2016, 3, day, 12, 0, 0, 0, time.Local).Format(time.RFC3339))
+	}
+	// The label symlink points to the oldest snapshot, which is always kept.
+	createLabelDir(t, fake.X, "", "beta", names)
+	labelDir := filepath.Join(fake.X.Root, defaultSnapshotDir, "labels", "beta")
+
+	var stdout bytes.Buffer
+	fake.X.Context = tool.NewContext(tool.ContextOpts{Stdout: &stdout})
+	keepLastFlag, pruneDryRunFlag = 1, true
+	if err := runSnapshotPrune(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), fmt.Sprintf("would remove %v\n", filepath.Join(labelDir, names[1])); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(labelDir, names[1])); err != nil {
+		t.Errorf("dry run removed %v: %v", names[1], err)
+	}
+
+	// Without a policy, the one in $JIRI_ROOT/.jiri_manifest is used.
+	stdout.Reset()
+	resetFlags()
+	if err := runSnapshotPrune(fake.X, []string{"beta"}); err == nil {
+		t.Errorf("prune succeeded without a retention policy")
+	}
+	m, err := project.ManifestFromFile(fake.X, fake.X.JiriManifestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Retention = &project.RetentionPolicy{KeepLast: 1}
+	if err := m.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSnapshotPrune(fake.X, []string{"beta"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), fmt.Sprintf("removed %v\n", filepath.Join(labelDir, names[1])); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(labelDir, name))
+		if got, want := os.IsNotExist(err), i == 1; got != want {
+			t.Errorf("%v removed: got %v, want %v", name, got, want)
+		}
+	}
+
+	// The update history keeps the snapshots of its symlinks, and prunes the
+	// older ones.
+	historyDir := fake.X.UpdateHistoryDir()
+	s := fake.X.NewSeq().MkdirAll(historyDir, 0755)
+	for _, name := range names {
+		s.WriteFile(filepath.Join(historyDir, name), []byte("<manifest/>"), 0644)
+	}
+	if err := s.Symlink(names[2], fake.X.UpdateHistoryLatestLink()).
+		Symlink(names[1], fake.X.UpdateHistorySecondLatestLink()).Done(); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	pruneHistoryFlag = true
+	if err := runSnapshotPrune(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), fmt.Sprintf("removed %v\n", filepath.Join(historyDir, names[0])); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestPrunePushRemote checks that "jiri snapshot prune" refuses to remove
+// committed snapshots without -push-remote, and commits and pushes their
+// removal with it.
+func TestPrunePushRemote(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	fake.EnableRemoteManifestPush()
+	defer fake.DisableRemoteManifestPush()
+
+	manifestDir := filepath.Join(fake.X.Root, "manifest")
+	snapshotDir := filepath.Join(manifestDir, "snapshot")
+	var names []string
+	for day := 1; day <= 3; day++ {
+		names = append(names, time.Date(2016, 3, day, 12, 0, 0, 0, time.Local).Format(time.RFC3339))
+	}
+	createLabelDir(t, fake.X, snapshotDir, "beta", names)
+	labelDir := filepath.Join(snapshotDir, "labels", "beta")
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(manifestDir))
+	if err := git.Add(snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CommitWithMessage("adding snapshots"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Push("origin", "master"); err != nil {
+		t.Fatal(err)
+	}
+	commitCount, err := git.CountCommits("master", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotDirFlag, keepLastFlag = snapshotDir, 1
+	if err := runSnapshotPrune(fake.X, nil); err == nil || !strings.Contains(err.Error(), "-push-remote") {
+		t.Errorf("got error %v, want it to suggest -push-remote", err)
+	}
+	if _, err := os.Stat(filepath.Join(labelDir, names[1])); err != nil {
+		t.Errorf("prune removed %v: %v", names[1], err)
+	}
+
+	pushRemoteFlag = true
+	if err := runSnapshotPrune(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(labelDir, names[1])
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("prune didn't remove %v: %v", file, err)
+	}
+	newCommitCount, err := git.CountCommits("master", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := newCommitCount, commitCount+1; got != want {
+		t.Errorf("unexpected commit count: got %v want %v", got, want)
+	}
+	if git.IsFileCommitted(file) {
+		t.Errorf("expected the removal of %v to be committed but it was not", file)
+	}
+	if dirty, err := git.HasUncommittedChanges(); err != nil {
+		t.Fatal(err)
+	} else if dirty {
+		t.Errorf("prune left uncommitted changes")
+	}
+}
+
+// TestSnapshotSelectors checks that the snapshots of a label can be selected
+// by time, by position and by the revision of a project.
+func TestSnapshotSelectors(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	if err := fake.CreateRemoteProject(remoteProjectName(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{
+		Name:   remoteProjectName(0),
+		Path:   localProjectName(0),
+		Remote: fake.Projects[remoteProjectName(0)],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var revisions []string
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(filepath.Join(fake.X.Root, localProjectName(0))))
+	for i := 1; i <= 2; i++ {
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(0)], fmt.Sprintf("revision %d", i))
+		if err := project.UpdateUniverse(fake.X, false); err != nil {
+			t.Fatal(err)
+		}
+		revision, err := git.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	// The snapshots of March 1st, 2nd and 3rd have the project at the first,
+	// second and again first revision, as if the second one was rolled back.
+	labelDir := filepath.Join(fake.X.Root, defaultSnapshotDir, "labels", "stable")
+	var files []string
+	for day, revision := range []string{revisions[0], revisions[1], revisions[0]} {
+		if err := git.Reset(revision); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(labelDir, time.Date(2016, 3, day+1, 12, 0, 0, 0, time.Local).Format(time.RFC3339))
+		if err := project.CreateSnapshot(fake.X, file, ""); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	tests := []struct {
+		selector, file, err string
+	}{
+		{"stable@2016-03-02", files[1], ""},
+		{"stable@2016-03-02T11:00", files[0], ""},
+		{"stable@2016-04-01T00:00:00Z", files[2], ""},
+		{"stable@2016-03-01T11:00", "", "no snapshot"},
+		{"stable@yesterday", "", "invalid time"},
+		{"stable~1", files[2], ""},
+		{"stable~3", files[0], ""},
+		{"stable~4", "", "only 3 snapshots"},
+		{"stable~0", "", "invalid number"},
+		{"stable:" + remoteProjectName(0) + "=" + revisions[1], files[1], ""},
+		{"stable:" + remoteProjectName(0) + "=" + revisions[0], files[2], ""},
+		{"stable:" + remoteProjectName(0), "", "invalid snapshot selector"},
+		{"beta~1", "", `label "beta" not found`},
+	}
+	for _, test := range tests {
+		file, err := resolveSnapshot(fake.X, test.selector)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: got error %v, want %q", test.selector, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.selector, err)
+		} else if file != test.file {
+			t.Errorf("%v: got %v, want %v", test.selector, file, test.file)
+		}
+	}
+
+	// Selectors can be checked out.
+	if err := runSnapshotCheckout(fake.X, []string{"stable~2"}); err != nil {
+		t.Fatal(err)
+	}
+	if revision, err := git.CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if got, want := revision, revisions[1]; got != want {
+		t.Errorf("got revision %v, want %v", got, want)
+	}
+}
+
+// TestBisect checks that "jiri snapshot bisect" finds the first bad snapshot,
+// and restores the original state of the projects.
+func TestBisect(t *testing.T) {
+	resetFlags()
+	defer resetFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	if err := fake.CreateRemoteProject(remoteProjectName(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{
+		Name:   remoteProjectName(0),
+		Path:   localProjectName(0),
+		Remote: fake.Projects[remoteProjectName(0)],
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a snapshot of each of five revisions, of which the third one is
+	// the first bad one.
+	dir := filepath.Join(fake.X.Root, localProjectName(0))
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(dir))
+	labelDir := filepath.Join(fake.X.Root, defaultSnapshotDir, "labels", "nightly")
+	var files, revisions []string
+	for i := 1; i <= 5; i++ {
+		writeReadme(t, fake.X, fake.Projects[remoteProjectName(0)], fmt.Sprintf("revision %d", i))
+		if err := project.UpdateUniverse(fake.X, false); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(labelDir, time.Date(2016, 3, i, 12, 0, 0, 0, time.Local).Format(time.RFC3339))
+		if err := project.CreateSnapshot(fake.X, file, ""); err != nil {
+			t.Fatal(err)
+		}
+		revision, err := git.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, revisions = append(files, file), append(revisions, revision)
+	}
+
+	// The project is on a local branch, which is restored.
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The update history is left unchanged.
+	if err := project.WriteUpdateHistorySnapshot(fake.X, ""); err != nil {
+		t.Fatal(err)
+	}
+	history := func() []string {
+		infos, err := ioutil.ReadDir(fake.X.UpdateHistoryDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		// Snapshots are named by the second, so compare the contents of the
+		// latest snapshot too.
+		latest, err := ioutil.ReadFile(fake.X.UpdateHistoryLatestLink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(names, string(latest))
+	}
+	wantHistory := history()
+
+	var stdout bytes.Buffer
+	fake.X.Context = tool.NewContext(tool.ContextOpts{Stdout: &stdout})
+	test := fmt.Sprintf(`case "$(cat %s)" in "revision 1"|"revision 2") exit 0;; *) exit 1;; esac`, filepath.Join(dir, "README"))
+	if err := runSnapshotBisect(fake.X, []string{"nightly~5", "nightly~1", "sh", "-c", test}); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(); !reflect.DeepEqual(got, wantHistory) {
+		t.Errorf("got update history %v, want %v", got, wantHistory)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("first bad snapshot: %v\nlast good snapshot: %v\n", files[2], files[1]),
+		fmt.Sprintf("changed project %q in %q from %q to %q\n", remoteProjectName(0), dir, revisions[1][:8], revisions[2][:8]),
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("got output %q, want %q", stdout.String(), want)
+		}
+	}
+	if branch, err := git.CurrentBranchName(); err != nil {
+		t.Fatal(err)
+	} else if got, want := branch, "feature"; got != want {
+		t.Errorf("got branch %v, want %v", got, want)
+	}
+	if revision, err := git.CurrentRevisionOfBranch("master"); err != nil {
+		t.Fatal(err)
+	} else if got, want := revision, revisions[4]; got != want {
+		t.Errorf("got master at %v, want %v", got, want)
+	}
+
+	// The original state is restored even if the bisection is interrupted.
+	stdout.Reset()
+	if err := runSnapshotBisect(fake.X, []string{"nightly~5", "nightly~1", "sh", "-c", "kill -INT $PPID; sleep 1"}); err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("got error %v, want interrupted", err)
+	}
+	if branch, err := git.CurrentBranchName(); err != nil {
+		t.Fatal(err)
+	} else if got, want := branch, "feature"; got != want {
+		t.Errorf("got branch %v, want %v", got, want)
+	}
+}
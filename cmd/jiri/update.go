@@ -5,6 +5,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	"v.io/jiri"
 	"v.io/jiri/project"
 	"v.io/jiri/retry"
@@ -13,15 +18,81 @@ import (
 )
 
 var (
-	gcFlag       bool
-	attemptsFlag int
+	gcFlag            bool
+	attemptsFlag      int
+	jobsFlag          int
+	dryRunFlag        bool
+	jsonFlag          bool
+	rollbackFlag      bool
+	groupsFlag        groupsValue
+	depthFlag         int
+	filterFlag        string
+	lockFlag          bool
+	lockedFlag        bool
+	localFlag         bool
+	rebaseTrackedFlag bool
+	rebaseAllFlag     bool
+	hookTimeoutFlag   time.Duration
+	parallelHooksFlag bool
 )
 
+// groupsValue is a flag.Value that records whether the flag was set, since an
+// empty group selection is meaningful.
+type groupsValue struct {
+	groups string
+	set    bool
+}
+
+func (v *groupsValue) String() string { return v.groups }
+
+func (v *groupsValue) Set(groups string) error {
+	v.groups, v.set = groups, true
+	return nil
+}
+
+// updateOpts returns the project.UpdateOpts given by the flags.
+func updateOpts() []project.UpdateOpt {
+	opts := []project.UpdateOpt{
+		project.JobsOpt(jobsFlag),
+		project.RollbackOpt(rollbackFlag),
+		project.DepthOpt(depthFlag),
+		project.FilterOpt(filterFlag),
+		project.LockedOpt(lockedFlag),
+		project.LocalOpt(localFlag),
+		project.HookTimeoutOpt(hookTimeoutFlag),
+		project.ParallelHooksOpt(parallelHooksFlag),
+	}
+	if groupsFlag.set {
+		opts = append(opts, project.GroupsOpt(groupsFlag.groups))
+	}
+	switch {
+	case rebaseAllFlag:
+		opts = append(opts, project.RebaseAll)
+	case rebaseTrackedFlag:
+		opts = append(opts, project.RebaseTracked)
+	}
+	return opts
+}
+
 func init() {
 	tool.InitializeProjectFlags(&cmdUpdate.Flags)
 
 	cmdUpdate.Flags.BoolVar(&gcFlag, "gc", false, "Garbage collect obsolete repositories.")
 	cmdUpdate.Flags.IntVar(&attemptsFlag, "attempts", 1, "Number of attempts before failing.")
+	cmdUpdate.Flags.IntVar(&jobsFlag, "jobs", project.DefaultJobs, "Number of projects to update concurrently.")
+	cmdUpdate.Flags.BoolVar(&dryRunFlag, "n", false, "Show what would be updated without updating anything.")
+	cmdUpdate.Flags.BoolVar(&jsonFlag, "json", false, "Print the plan shown by -n in JSON format.")
+	cmdUpdate.Flags.BoolVar(&rollbackFlag, "rollback-on-error", false, "Roll back the projects touched by a failed update to their previous revisions.")
+	cmdUpdate.Flags.IntVar(&depthFlag, "depth", 0, "Number of commits of history to fetch for shallow clones of new projects that don't specify a depth.")
+	cmdUpdate.Flags.StringVar(&filterFlag, "filter", "", "Filter spec for partial clones of new projects that don't specify a filter, e.g. blob:none.")
+	cmdUpdate.Flags.BoolVar(&lockFlag, "lock", false, "Pin the updated projects and tools in $JIRI_ROOT/.jiri_manifest.lock.")
+	cmdUpdate.Flags.BoolVar(&lockedFlag, "locked", false, "Check out the projects and tools pinned in $JIRI_ROOT/.jiri_manifest.lock.")
+	cmdUpdate.Flags.BoolVar(&localFlag, "local", false, "Update without contacting any remotes, using only the revisions that were already fetched.")
+	cmdUpdate.Flags.BoolVar(&rebaseTrackedFlag, "rebase-tracked", false, "Rebase the local branches that track master, and merge master into CL branches, once master is updated.")
+	cmdUpdate.Flags.BoolVar(&rebaseAllFlag, "rebase-all", false, "Like -rebase-tracked, but rebase all local branches.")
+	cmdUpdate.Flags.DurationVar(&hookTimeoutFlag, "hook-timeout", project.DefaultHookTimeout, "Maximum time each hook may run before it is killed, or 0 for no limit.")
+	cmdUpdate.Flags.BoolVar(&parallelHooksFlag, "parallel-hooks", false, "Run hooks concurrently, with at most -jobs hooks running at the same time.")
+	cmdUpdate.Flags.Var(&groupsFlag, "groups", "Comma-separated list of project groups to check out, where groups prefixed with '-' are excluded.  The selection is saved in $JIRI_ROOT/.jiri_manifest.")
 }
 
 // cmdUpdate represents the "jiri update" command.
@@ -36,11 +107,109 @@ individual updates happen guarantees that we end up with a consistent set of
 tools and source code. The set of projects and tools to update is described in
 the manifest.
 
+With -n, the projects, hooks and tools are not updated.  Instead, the plan that
+would be carried out is printed: each project that would be created, moved,
+updated or deleted along with its old and new revision, the hooks that would
+run, and the tools that would be rebuilt.  With -json the plan is printed in
+JSON format.
+
+With -rollback-on-error, if the update fails, every project it touched is
+returned to its revision in the latest update history snapshot, and the tools
+are rebuilt to match.  Run "jiri update rollback" to return to the state before
+the latest successful update.
+
+With -groups, only the projects in the given groups are checked out, and the
+selection is saved in $JIRI_ROOT/.jiri_manifest for subsequent commands.  For
+example, -groups=+mobile,-experimental checks out the projects in the "mobile"
+group that are not also in the "experimental" group, and -groups=-server checks
+out all projects except those in the "server" group.  Use -groups= to check out
+all projects again.  Projects that are excluded by groups are left alone; in
+particular they are never deleted by -gc.
+
+With -depth and -filter, new projects are cloned shallow or partially, unless
+their manifest specifies otherwise.  Checking out a revision that is not in a
+shallow clone fetches it as needed.
+
+With -lock, the revisions of the projects and tools are pinned in
+$JIRI_ROOT/.jiri_manifest.lock after the update.  With -locked, the projects and
+tools pinned in the lock file are checked out, rather than those in the
+manifest, which reproduces the state of the update that wrote the lock file.
+Run "jiri help lock" for details.
+
+With -local, the update never contacts any remotes, which is useful without
+network access.  The manifest is resolved from the refs that were already
+fetched into the manifest projects, projects are reset to their revisions
+without fetching, and tools are rebuilt and hooks are run as usual.  The update
+fails before changing any project if a revision isn't available locally, or if
+a project would have to be created.  -local can be combined with -locked, and
+also applies to "jiri update rollback".
+
+With -rebase-tracked, the local branches of each project whose master branch
+advanced are brought up to date with it.  Branches that track master, or the
+remote branch of the project, are rebased onto master.  CL branches created by
+"jiri cl new" are brought up to date along their dependency path, as "jiri cl
+sync" does: master is merged into the first CL, which is merged into the next
+one, and so on.  With -rebase-all, all other local branches are rebased onto
+master as well.  A branch that can't be updated automatically, for example
+because of conflicts, is left as it was, along with the branches that depend
+on it, and the project is returned to its current branch.  A summary lists
+each branch as updated, up to date, or needing manual resolution.
+
+Hooks run after the projects are updated: the runhook of each project that was
+created, moved or updated, and then, once the tools are rebuilt, the
+post-update hooks of the manifest.  Every hook runs even if others fail, a
+summary lists the status and duration of each hook, and the update fails if any
+of them failed.  Hooks that run longer than -hook-timeout are killed and
+reported as timed out.  With -parallel-hooks, up to -jobs hooks run at the same
+time, with the output of each hook printed when it completes.  Snapshots and
+the lock file record the post-update hooks, which run after "jiri update
+-locked", "jiri update rollback" and "jiri snapshot checkout" too.
+
+If $JIRI_ROOT/.jiri_manifest has a <retention> policy, the update history
+snapshots that it doesn't keep are removed after every update, as by "jiri
+snapshot prune -history".
+
+If $JIRI_CACHE is set, new projects borrow objects from mirrors in that
+directory.  Run "jiri help cache" for details.
+
 Run "jiri help manifest" for details on manifests.
+`,
+	Children: []*cmdline.Command{cmdUpdateRollback},
+}
+
+// cmdUpdateRollback represents the "jiri update rollback" command.
+var cmdUpdateRollback = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runUpdateRollback),
+	Name:   "rollback",
+	Short:  "Roll back to the state before the latest update",
+	Long: `
+Restores all projects and tools to the state they were in before the latest
+update, as recorded by the second latest update history snapshot.  The latest
+update history snapshot then refers to the restored state, so rolling back
+again has no further effect.
 `,
 }
 
 func runUpdate(jirix *jiri.X, _ []string) error {
+	if lockFlag && lockedFlag {
+		return jirix.UsageErrorf("-lock and -locked can't be used together")
+	}
+	if dryRunFlag && localFlag {
+		return jirix.UsageErrorf("-n and -local can't be used together")
+	}
+	if jsonFlag && !dryRunFlag {
+		return jirix.UsageErrorf("-json can only be used with -n")
+	}
+	if rebaseTrackedFlag && rebaseAllFlag {
+		return jirix.UsageErrorf("-rebase-tracked and -rebase-all can't be used together")
+	}
+	if dryRunFlag {
+		plan, err := project.PlanUpdateUniverse(jirix, gcFlag, updateOpts()...)
+		if err != nil {
+			return err
+		}
+		return printUpdatePlan(jirix, plan)
+	}
 	seq := jirix.NewSeq()
 	// Create the $JIRI_ROOT/.jiri_root directory if it doesn't already exist.
 	//
@@ -53,15 +222,93 @@ func runUpdate(jirix *jiri.X, _ []string) error {
 
 	// Update all projects to their latest version.
 	// Attempt <attemptsFlag> times before failing.
-	updateFn := func() error { return project.UpdateUniverse(jirix, gcFlag) }
+	updateFn := func() error {
+		return project.UpdateUniverse(jirix, gcFlag, updateOpts()...)
+	}
 	if err := retry.Function(jirix.Context, updateFn, retry.AttemptsOpt(attemptsFlag)); err != nil {
 		return err
 	}
 	if err := project.WriteUpdateHistorySnapshot(jirix, ""); err != nil {
 		return err
 	}
+	if lockFlag {
+		if err := project.WriteLockFile(jirix); err != nil {
+			return err
+		}
+	}
 
 	// Only attempt the bin dir transition after the update has succeeded, to
 	// avoid messy partial states.
-	return project.TransitionBinDir(jirix)
+	if err := project.TransitionBinDir(jirix); err != nil {
+		return err
+	}
+	// Prune the update history last, so that a failure doesn't prevent the
+	// steps above.
+	return pruneUpdateHistory(jirix)
+}
+
+// pruneUpdateHistory applies the retention policy configured in
+// $JIRI_ROOT/.jiri_manifest, if any, to the update history.
+func pruneUpdateHistory(jirix *jiri.X) error {
+	policy, err := project.LoadRetentionPolicy(jirix)
+	if err != nil || policy == nil {
+		return err
+	}
+	removed, err := project.PruneUpdateHistory(jirix, *policy, false)
+	if err != nil {
+		return err
+	}
+	if jirix.Verbose() {
+		for _, file := range removed {
+			fmt.Fprintf(jirix.Stdout(), "removed update history snapshot %v\n", file)
+		}
+	}
+	return nil
+}
+
+func runUpdateRollback(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	snapshot := jirix.UpdateHistorySecondLatestLink()
+	exists, err := jirix.NewSeq().IsFile(snapshot)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no previous update to roll back to")
+	}
+	target, err := jirix.NewSeq().Readlink(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := project.CheckoutSnapshot(jirix, snapshot, gcFlag, project.JobsOpt(jobsFlag), project.LocalOpt(localFlag), project.SkipUpdateHistoryOpt(true)); err != nil {
+		return err
+	}
+	// Rather than recording a new snapshot, point the latest snapshot at the
+	// restored one, so that rolling back again doesn't undo the rollback.
+	latest := jirix.UpdateHistoryLatestLink()
+	return jirix.NewSeq().RemoveAll(latest).Symlink(target, latest).Done()
+}
+
+// printUpdatePlan prints the given plan, either as text or as JSON.
+func printUpdatePlan(jirix *jiri.X, plan *project.UpdatePlan) error {
+	if jsonFlag {
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return fmt.Errorf("MarshalIndent() failed: %v", err)
+		}
+		fmt.Fprintln(jirix.Stdout(), string(data))
+		return nil
+	}
+	for _, op := range plan.Operations {
+		fmt.Fprintln(jirix.Stdout(), op)
+	}
+	for _, hook := range plan.Hooks {
+		fmt.Fprintln(jirix.Stdout(), hook)
+	}
+	if len(plan.Tools) > 0 {
+		fmt.Fprintf(jirix.Stdout(), "build tools: %v\n", strings.Join(plan.Tools, " "))
+	}
+	return nil
 }
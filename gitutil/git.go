@@ -99,6 +99,11 @@ func (g *Git) AddRemote(name, path string) error {
 	return g.run("remote", "add", name, path)
 }
 
+// ApplyPatch applies the given patch file to the working tree.
+func (g *Git) ApplyPatch(file string) error {
+	return g.run("apply", file)
+}
+
 // BranchExists tests whether a branch with the given name exists in
 // the local repository.
 func (g *Git) BranchExists(branch string) bool {
@@ -136,9 +141,32 @@ func (g *Git) CheckoutBranch(branch string, opts ...CheckoutOpt) error {
 	return g.run(args...)
 }
 
-// Clone clones the given repository to the given local path.
-func (g *Git) Clone(repo, path string) error {
-	return g.run("clone", repo, path)
+// Clone clones the given repository to the given local path.  Shallow clones
+// fetch all remote branches, so that any of them can be tracked.
+func (g *Git) Clone(repo, path string, opts ...CloneOpt) error {
+	args := []string{"clone"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case DepthOpt:
+			if typedOpt > 0 {
+				args = append(args, "--depth", strconv.Itoa(int(typedOpt)), "--no-single-branch")
+			}
+		case FilterOpt:
+			if typedOpt != "" {
+				args = append(args, "--filter="+string(typedOpt))
+			}
+		case MirrorOpt:
+			if typedOpt {
+				args = append(args, "--mirror")
+			}
+		case ReferenceOpt:
+			if typedOpt != "" {
+				args = append(args, "--reference", string(typedOpt))
+			}
+		}
+	}
+	args = append(args, repo, path)
+	return g.run(args...)
 }
 
 // CloneRecursive clones the given repository recursively to the given local path.
@@ -219,6 +247,22 @@ func (g *Git) Committers() ([]string, error) {
 	return out, nil
 }
 
+// ConfigValues returns the values of the given key in the git configuration
+// of the repository, or nil if the key is not set.  The global and system
+// configuration are ignored.
+func (g *Git) ConfigValues(key string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	capture := func(s runutil.Sequence) runutil.Sequence { return s.Capture(&stdout, &stderr) }
+	if err := g.runWithFn(capture, "config", "--local", "--get-all", key); err != nil {
+		// "git config" fails silently if the key is not set.
+		if stdout.Len() == 0 && stderr.Len() == 0 {
+			return nil, nil
+		}
+		return nil, Error(stdout.String(), stderr.String(), "config", "--local", "--get-all", key)
+	}
+	return trimOutput(stdout.String()), nil
+}
+
 // CountCommits returns the number of commits on <branch> that are not
 // on <base>.
 func (g *Git) CountCommits(branch, base string) (int, error) {
@@ -258,6 +302,12 @@ func (g *Git) CreateBranchWithUpstream(branch, upstream string) error {
 	return g.run("branch", branch, upstream)
 }
 
+// CreateBundle writes the commits in the given revision range, e.g.
+// "master..branch", to the given bundle file, from which they can be fetched.
+func (g *Git) CreateBundle(file, revisions string) error {
+	return g.run("bundle", "create", file, revisions)
+}
+
 // CurrentBranchName returns the name of the current branch.
 func (g *Git) CurrentBranchName() (string, error) {
 	out, err := g.runOutput("rev-parse", "--abbrev-ref", "HEAD")
@@ -306,6 +356,12 @@ func (g *Git) DeleteBranch(branch string, opts ...DeleteBranchOpt) error {
 	return g.run(args...)
 }
 
+// DiffToFile writes the changes of the working tree relative to the given
+// base revision, including binary changes, to the given patch file.
+func (g *Git) DiffToFile(base, file string) error {
+	return g.run("diff", "--binary", "--output="+file, base)
+}
+
 // DirExistsOnBranch returns true if a directory with the given name
 // exists on the branch.  If branch is empty it defaults to "master".
 func (g *Git) DirExistsOnBranch(dir, branch string) bool {
@@ -332,6 +388,18 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 		switch typedOpt := opt.(type) {
 		case TagsOpt:
 			tags = bool(typedOpt)
+		case DepthOpt:
+			if typedOpt > 0 {
+				args = append(args, "--depth", strconv.Itoa(int(typedOpt)))
+			}
+		case FilterOpt:
+			if typedOpt != "" {
+				args = append(args, "--filter="+string(typedOpt))
+			}
+		case UnshallowOpt:
+			if typedOpt {
+				args = append(args, "--unshallow")
+			}
 		}
 	}
 	if tags {
@@ -417,6 +485,30 @@ func (g *Git) IsFileCommitted(file string) bool {
 	return g.run("ls-files", file, "--error-unmatch") == nil
 }
 
+// IsAncestor tests whether the given ancestor revision is the given revision,
+// or one of its ancestors.
+func (g *Git) IsAncestor(ancestor, revision string) bool {
+	return g.run("merge-base", "--is-ancestor", ancestor, revision) == nil
+}
+
+// IsRevisionAvailable tests whether the given commit exists in the local
+// repository.
+func (g *Git) IsRevisionAvailable(revision string) bool {
+	return g.run("cat-file", "-e", revision+"^{commit}") == nil
+}
+
+// IsShallow tests whether the repository is a shallow clone.
+func (g *Git) IsShallow() (bool, error) {
+	out, err := g.runOutput("rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+	if got, want := len(out), 1; got != want {
+		return false, fmt.Errorf("unexpected length of %v: got %v, want %v", out, got, want)
+	}
+	return out[0] == "true", nil
+}
+
 // LatestCommitMessage returns the latest commit message on the
 // current branch.
 func (g *Git) LatestCommitMessage() (string, error) {
@@ -587,6 +679,23 @@ func (g *Git) Remove(fileNames ...string) error {
 	return g.run(args...)
 }
 
+// RemoteBranchRevision returns the revision of the given branch in the given
+// remote repository, without fetching from it.
+func (g *Git) RemoteBranchRevision(remote, branch string) (string, error) {
+	out, err := g.runOutput("ls-remote", remote, "refs/heads/"+branch)
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(out), 1; got != want {
+		return "", fmt.Errorf("RemoteBranchRevision: unexpected length of refs %v: got %v, want %v", out, got, want)
+	}
+	fields := strings.Fields(out[0])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("RemoteBranchRevision: unexpected ref %q", out[0])
+	}
+	return fields[0], nil
+}
+
 // RemoteUrl gets the url of the remote with the given name.
 func (g *Git) RemoteUrl(name string) (string, error) {
 	configKey := fmt.Sprintf("remote.%s.url", name)
@@ -600,6 +709,16 @@ func (g *Git) RemoteUrl(name string) (string, error) {
 	return out[0], nil
 }
 
+// Remotes returns the names of the remotes of the repository.
+func (g *Git) Remotes() ([]string, error) {
+	return g.runOutput("remote")
+}
+
+// RemoveRemote removes the remote with the given name.
+func (g *Git) RemoveRemote(name string) error {
+	return g.run("remote", "remove", name)
+}
+
 // RemoveUntrackedFiles removes untracked files and directories.
 func (g *Git) RemoveUntrackedFiles() error {
 	return g.run("clean", "-d", "-f")
@@ -625,6 +744,12 @@ func (g *Git) SetRemoteUrl(name, url string) error {
 	return g.run("remote", "set-url", name, url)
 }
 
+// SetConfig sets the given key of the git configuration of the repository to
+// the given value, replacing all its values.
+func (g *Git) SetConfig(key, value string) error {
+	return g.run("config", "--local", "--replace-all", key, value)
+}
+
 // Stash attempts to stash any unsaved changes. It returns true if
 // anything was actually stashed, otherwise false. An error is
 // returned if the stash command fails.
@@ -681,6 +806,24 @@ func (g *Git) TrackedFiles() ([]string, error) {
 	return out, nil
 }
 
+// Upstream returns the upstream branch of the given branch, e.g.
+// "origin/master" for a branch that tracks a remote branch, or "master" for a
+// branch that tracks the local master branch.  It returns the empty string if
+// the branch has no upstream.
+func (g *Git) Upstream(branch string) (string, error) {
+	out, err := g.runOutput("for-each-ref", "--format=%(upstream:short)", "refs/heads/"+branch)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// UnsetConfig removes all values of the given key from the git configuration
+// of the repository.
+func (g *Git) UnsetConfig(key string) error {
+	return g.run("config", "--local", "--unset-all", key)
+}
+
 // UntrackedFiles returns the list of files that are not tracked.
 func (g *Git) UntrackedFiles() ([]string, error) {
 	out, err := g.runOutput("ls-files", "--others", "--directory", "--exclude-standard")
@@ -7,6 +7,9 @@ package gitutil
 type CheckoutOpt interface {
 	checkoutOpt()
 }
+type CloneOpt interface {
+	cloneOpt()
+}
 type CommitOpt interface {
 	commitOpt()
 }
@@ -26,6 +29,19 @@ type ResetOpt interface {
 	resetOpt()
 }
 
+// DepthOpt limits the history of a clone or fetch to the given number of
+// commits.  Values less than 1 don't limit the history.
+type DepthOpt int
+
+func (DepthOpt) cloneOpt() {}
+func (DepthOpt) fetchOpt() {}
+
+// FilterOpt is the filter spec of a partial clone or fetch, e.g. "blob:none".
+type FilterOpt string
+
+func (FilterOpt) cloneOpt() {}
+func (FilterOpt) fetchOpt() {}
+
 type FollowTagsOpt bool
 
 func (FollowTagsOpt) pushOpt() {}
@@ -40,10 +56,21 @@ type MessageOpt string
 
 func (MessageOpt) commitOpt() {}
 
+// MirrorOpt creates a bare clone that mirrors all refs of the remote.
+type MirrorOpt bool
+
+func (MirrorOpt) cloneOpt() {}
+
 type ModeOpt string
 
 func (ModeOpt) resetOpt() {}
 
+// ReferenceOpt is the path of a local repository from which a clone borrows
+// objects, instead of fetching them from the remote.
+type ReferenceOpt string
+
+func (ReferenceOpt) cloneOpt() {}
+
 type ResetOnFailureOpt bool
 
 func (ResetOnFailureOpt) mergeOpt() {}
@@ -60,6 +87,12 @@ type TagsOpt bool
 
 func (TagsOpt) fetchOpt() {}
 
+// UnshallowOpt converts a shallow repository into a complete one when
+// fetching.
+type UnshallowOpt bool
+
+func (UnshallowOpt) fetchOpt() {}
+
 type VerifyOpt bool
 
 func (VerifyOpt) pushOpt() {}
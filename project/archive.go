@@ -0,0 +1,365 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"v.io/jiri"
+	"v.io/jiri/collect"
+)
+
+// archiveProtocol implements Protocol for projects that are distributed as
+// release archives, such as tarballs.  The project remote is the URL of the
+// archive, and the project revision is the hex-encoded sha256 of the archive.
+//
+// Supported archive formats are .tar, .tar.gz, .tgz and .zip.  If all the
+// contents of an archive are in a single top-level directory, as is common for
+// release archives, the contents of that directory are unpacked into the
+// project path.  The unpacked files are read-only; updating the project to a
+// new revision replaces all of its contents.
+type archiveProtocol struct{}
+
+func (archiveProtocol) Clone(jirix *jiri.X, project Project, dir string) error {
+	return unpackArchive(jirix, project, dir)
+}
+
+func (archiveProtocol) Fetch(jirix *jiri.X, project Project) error {
+	// The revision identifies the archive contents, so there is nothing to
+	// fetch until the revision changes.
+	return nil
+}
+
+func (p archiveProtocol) Reset(jirix *jiri.X, project Project) (e error) {
+	current, err := p.CurrentRevision(jirix, project)
+	if err != nil {
+		return err
+	}
+	if current == project.Revision {
+		return nil
+	}
+	// Unpack the new revision next to the project, and swap it in, keeping
+	// the jiri metadata of the project.
+	s := jirix.NewSeq()
+	parent, prefix := filepath.Dir(project.Path), filepath.Base(project.Path)+"-"
+	newDir, err := s.TempDir(parent, prefix)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(newDir).Done() }, &e)
+	oldDir, err := s.TempDir(parent, prefix)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(oldDir).Done() }, &e)
+	if err := unpackArchive(jirix, project, newDir); err != nil {
+		return err
+	}
+	metadataDir := filepath.Join(project.Path, jiri.ProjectMetaDir)
+	return s.Rename(metadataDir, filepath.Join(newDir, jiri.ProjectMetaDir)).
+		Chmod(newDir, os.FileMode(0755)).
+		Rename(project.Path, filepath.Join(oldDir, "project")).
+		Rename(newDir, project.Path).Done()
+}
+
+func (p archiveProtocol) IsRevisionAvailable(jirix *jiri.X, project Project) (bool, error) {
+	// Only the unpacked revision is kept, so any other one must be downloaded.
+	current, err := p.CurrentRevision(jirix, project)
+	if err != nil {
+		return false, err
+	}
+	return current == project.Revision, nil
+}
+
+func (archiveProtocol) CurrentRevision(jirix *jiri.X, project Project) (string, error) {
+	// The revision of the unpacked archive is only recorded in the metadata.
+	local, err := ProjectAtPath(jirix, project.Path)
+	if err != nil {
+		return "", err
+	}
+	return local.Revision, nil
+}
+
+func (archiveProtocol) IsLocalProject(jirix *jiri.X, project Project) (bool, error) {
+	return isLocalProject(jirix, project.Path)
+}
+
+func (archiveProtocol) HasLocalChanges(jirix *jiri.X, project Project) (bool, error) {
+	// The unpacked files are read-only, and are replaced on every update.
+	return false, nil
+}
+
+func (archiveProtocol) SwitchToMaster(jirix *jiri.X, project Project) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (archiveProtocol) Poll(jirix *jiri.X, project Project) ([]CL, error) {
+	return nil, nil
+}
+
+// unpackArchive downloads the archive of the given project, checks that its
+// sha256 matches the project revision, and unpacks it into dir.
+func unpackArchive(jirix *jiri.X, project Project, dir string) (e error) {
+	if project.Revision == "" || project.Revision == "HEAD" {
+		return fmt.Errorf("archive project %q must specify the sha256 of the archive as its revision", project.Name)
+	}
+	s := jirix.NewSeq()
+	// Use a directory next to dir, so that the unpacked files can be renamed
+	// into dir.
+	tmpDir, err := s.TempDir(filepath.Dir(dir), "jiri-archive-")
+	if err != nil {
+		return fmt.Errorf("TempDir() failed: %v", err)
+	}
+	defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(tmpDir).Done() }, &e)
+	file := filepath.Join(tmpDir, "archive")
+	sum, err := downloadArchive(project.Remote, file)
+	if err != nil {
+		return fmt.Errorf("download of %v failed: %v", project.Remote, err)
+	}
+	if sum != project.Revision {
+		return fmt.Errorf("archive %v has sha256 %v, want %v", project.Remote, sum, project.Revision)
+	}
+	unpackDir := filepath.Join(tmpDir, "unpack")
+	if err := s.MkdirAll(unpackDir, os.FileMode(0755)).Done(); err != nil {
+		return err
+	}
+	name := strings.ToLower(project.Remote)
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = unzip(file, unpackDir)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		err = untar(file, unpackDir, true)
+	case strings.HasSuffix(name, ".tar"):
+		err = untar(file, unpackDir, false)
+	default:
+		err = fmt.Errorf("unknown archive format")
+	}
+	if err != nil {
+		return fmt.Errorf("unpacking %v failed: %v", project.Remote, err)
+	}
+	// Strip a single top-level directory.
+	root := unpackDir
+	fileInfos, err := s.ReadDir(unpackDir)
+	if err != nil {
+		return err
+	}
+	if len(fileInfos) == 1 && fileInfos[0].IsDir() {
+		root = filepath.Join(unpackDir, fileInfos[0].Name())
+		if fileInfos, err = s.ReadDir(root); err != nil {
+			return err
+		}
+	}
+	for _, fileInfo := range fileInfos {
+		if err := s.Rename(filepath.Join(root, fileInfo.Name()), filepath.Join(dir, fileInfo.Name())).Done(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadArchive copies the archive at the given URL or local path to file,
+// and returns its hex-encoded sha256.
+func downloadArchive(url, file string) (_ string, e error) {
+	var src io.ReadCloser
+	switch {
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		resp, err := http.Get(url)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("got status %v", resp.Status)
+		}
+		src = resp.Body
+	default:
+		f, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return "", err
+		}
+		src = f
+	}
+	defer collect.Error(src.Close, &e)
+	dst, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer collect.Error(dst.Close, &e)
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hash), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// archivePath returns the path within dir of an archive entry with the given
+// name, making sure that the entry can't be written outside of dir.
+func archivePath(dir, name string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if !isWithinDir(dir, path) {
+		return "", fmt.Errorf("invalid archive entry %q", name)
+	}
+	return path, nil
+}
+
+// isWithinDir returns true if the given clean path is dir or is nested within
+// dir.
+func isWithinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// writeArchiveFile writes the contents of r to a read-only file at path.
+func writeArchiveFile(path string, r io.Reader, mode os.FileMode) (e error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()&^0222)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(f.Close, &e)
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// checkArchiveTarget checks that an archive entry can be written to path
+// without escaping dir through the symlinks created by earlier entries: the
+// nearest existing ancestor of path must resolve to a directory within dir,
+// and path itself must not be a symlink.  The dir must have its symlinks
+// resolved.
+func checkArchiveTarget(dir, path string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("archive entry %q would be written through a symlink", path)
+	}
+	parent := filepath.Dir(path)
+	for {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		parent = filepath.Dir(parent)
+	}
+	resolved, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return err
+	}
+	if !isWithinDir(dir, resolved) {
+		return fmt.Errorf("archive entry %q would be written outside of %q", path, dir)
+	}
+	return nil
+}
+
+// untar unpacks the given tar file into dir.  Hard links are not supported.
+func untar(file, dir string, gzipped bool) (e error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(f.Close, &e)
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer collect.Error(gz.Close, &e)
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := archivePath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkArchiveTarget(dir, path); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(0755)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeArchiveFile(path, tr, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !isWithinDir(dir, filepath.Join(filepath.Dir(path), header.Linkname)) {
+				return fmt.Errorf("invalid archive symlink %q -> %q", header.Name, header.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			return fmt.Errorf("unsupported archive hard link %q -> %q", header.Name, header.Linkname)
+		}
+	}
+}
+
+// unzip unpacks the given zip file into dir.
+func unzip(file, dir string) (e error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(zr.Close, &e)
+	for _, zf := range zr.File {
+		path, err := archivePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkArchiveTarget(dir, path); err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, os.FileMode(0755)); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveFile(path, r, zf.Mode())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"v.io/jiri"
+	"v.io/jiri/collect"
+	"v.io/jiri/gitutil"
+	"v.io/jiri/runutil"
+	"v.io/jiri/tool"
+)
+
+// The cache directory, given by jirix.CacheDir, holds a bare mirror of the
+// remote of each git project, which new clones borrow objects from using git
+// alternates.  Since the clones depend on the mirrors, the cache also records
+// the jiri roots that use it in its rootsDir, so that mirrors are only pruned
+// once no jiri root references their remote.
+//
+// The cache may be shared by concurrent updates of different jiri roots, so
+// each mirror has a lock file next to it, which is held while the mirror is
+// fetched, or while a project is cloned from it, and which PruneCache takes
+// before removing the mirror.  The lock files are never removed, since an
+// update may be waiting for them.
+const rootsDir = ".roots"
+
+const lockFileSuffix = ".lock"
+
+var mirrorNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// mirrorPath returns the path of the mirror of the given remote in the cache.
+func mirrorPath(cacheDir, remote string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(remote))
+	name := mirrorNameRE.ReplaceAllString(strings.TrimSuffix(path.Base(remote), ".git"), "_")
+	return filepath.Join(cacheDir, fmt.Sprintf("%s_%x.git", name, hash.Sum64()))
+}
+
+// lockMirror takes the lock of the mirror at the given path, and returns a
+// function that releases it.  If wait is false and the lock is held by another
+// update, it returns errMirrorBusy rather than waiting for the lock.
+func lockMirror(mirror string, wait bool) (func() error, error) {
+	file, err := os.OpenFile(mirror+lockFileSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errMirrorBusy
+		}
+		return nil, fmt.Errorf("failed to lock %v: %v", mirror, err)
+	}
+	// Closing the file releases the lock.
+	return file.Close, nil
+}
+
+var errMirrorBusy = errors.New("mirror is in use")
+
+// withMirrorLock runs fn while holding the lock of the mirror of the given
+// project in the cache.  If no cache is configured, or the project isn't a git
+// project, fn is run without a lock.
+func withMirrorLock(jirix *jiri.X, project Project, fn func() error) (e error) {
+	cacheDir := jirix.CacheDir()
+	if cacheDir == "" || project.Protocol != "git" {
+		return fn()
+	}
+	if err := jirix.NewSeq().MkdirAll(cacheDir, 0755).Done(); err != nil {
+		return err
+	}
+	unlock, err := lockMirror(mirrorPath(cacheDir, project.Remote), true)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(unlock, &e)
+	return fn()
+}
+
+// updateMirror creates or updates the mirror of the given remote in the
+// cache, and returns its path.  It returns the empty string if no cache is
+// configured.  The caller must hold the lock of the mirror.
+func updateMirror(jirix *jiri.X, remote string) (_ string, e error) {
+	cacheDir := jirix.CacheDir()
+	if cacheDir == "" {
+		return "", nil
+	}
+	if err := registerCacheRoot(jirix, cacheDir); err != nil {
+		return "", err
+	}
+	mirror := mirrorPath(cacheDir, remote)
+	s := jirix.NewSeq()
+	exists, err := s.IsDir(mirror)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		if err := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(mirror)).Fetch("origin"); err != nil {
+			return "", err
+		}
+		return mirror, nil
+	}
+	// Clone into a temporary directory, so that other jiri roots sharing the
+	// cache never see a partial mirror.
+	tmpDir, err := s.TempDir(cacheDir, filepath.Base(mirror)+"-")
+	if err != nil {
+		return "", err
+	}
+	defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(tmpDir).Done() }, &e)
+	tmpMirror := filepath.Join(tmpDir, "mirror")
+	if err := gitutil.New(jirix.NewSeq()).Clone(remote, tmpMirror, gitutil.MirrorOpt(true)); err != nil {
+		return "", err
+	}
+	if err := s.Rename(tmpMirror, mirror).Done(); err != nil {
+		// Another update may have created the mirror in the meantime.
+		if exists, err2 := jirix.NewSeq().IsDir(mirror); err2 != nil || !exists {
+			return "", err
+		}
+	}
+	return mirror, nil
+}
+
+// registerCacheRoot records that the jiri root uses the cache.
+func registerCacheRoot(jirix *jiri.X, cacheDir string) error {
+	hash := fnv.New64a()
+	hash.Write([]byte(jirix.Root))
+	link := filepath.Join(cacheDir, rootsDir, fmt.Sprintf("%x", hash.Sum64()))
+	s := jirix.NewSeq()
+	if _, err := s.Lstat(link); err == nil {
+		return nil
+	} else if !runutil.IsNotExist(err) {
+		return err
+	}
+	if err := s.MkdirAll(filepath.Dir(link), 0755).Symlink(jirix.Root, link).Done(); err != nil {
+		// Another update may have registered the root in the meantime.
+		if _, err2 := jirix.NewSeq().Lstat(link); err2 != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneCache removes the mirrors in the cache whose remote is not used by a
+// project of the manifest of the current jiri root, or by a local project of
+// any jiri root that uses the cache, and that no local project borrows objects
+// from.  A local project keeps borrowing from the mirror it was cloned with
+// even after its remote changes.  Mirrors that a concurrent update is fetching
+// or cloning from are kept.  It returns the paths of the removed mirrors.
+func PruneCache(jirix *jiri.X) (_ []string, e error) {
+	cacheDir := jirix.CacheDir()
+	if cacheDir == "" {
+		return nil, fmt.Errorf("%v is not set", jiri.CacheEnv)
+	}
+	s := jirix.NewSeq()
+	// Lock the mirrors before looking for the projects that use them, so
+	// that projects cloned in the meantime are found.
+	fileInfos, err := s.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	var locked []string
+	for _, fileInfo := range fileInfos {
+		mirror := filepath.Join(cacheDir, fileInfo.Name())
+		if !fileInfo.IsDir() || filepath.Ext(mirror) != ".git" {
+			continue
+		}
+		unlock, err := lockMirror(mirror, false)
+		if err == errMirrorBusy {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		defer collect.Error(unlock, &e)
+		locked = append(locked, mirror)
+	}
+	used := map[string]bool{}
+	manifestProjects, _, err := LoadManifest(jirix)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range manifestProjects {
+		used[mirrorPath(cacheDir, project.Remote)] = true
+	}
+	links, err := s.ReadDir(filepath.Join(cacheDir, rootsDir))
+	if err != nil && !runutil.IsNotExist(err) {
+		return nil, err
+	}
+	for _, link := range links {
+		linkPath := filepath.Join(cacheDir, rootsDir, link.Name())
+		root, err := s.Readlink(linkPath)
+		if err != nil {
+			return nil, err
+		}
+		exists, err := s.IsDir(filepath.Join(root, jiri.RootMetaDir))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			// The jiri root is gone.
+			if err := s.RemoveAll(linkPath).Done(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rootx := jirix.Clone(tool.ContextOpts{})
+		rootx.Root = root
+		localProjects, err := LocalProjects(rootx, FullScan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the projects of %v: %v", root, err)
+		}
+		for _, project := range localProjects {
+			used[mirrorPath(cacheDir, project.Remote)] = true
+			mirrors, err := alternateMirrors(rootx, project)
+			if err != nil {
+				return nil, err
+			}
+			for _, mirror := range mirrors {
+				used[mirror] = true
+			}
+		}
+	}
+	var removed []string
+	for _, mirror := range locked {
+		if used[mirror] {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(mirror); err == nil && used[resolved] {
+			continue
+		}
+		if err := s.RemoveAll(mirror).Done(); err != nil {
+			return nil, err
+		}
+		removed = append(removed, mirror)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// alternateMirrors returns the repositories that the given local project
+// borrows objects from, according to its git alternates, with symlinks
+// resolved.
+func alternateMirrors(jirix *jiri.X, project Project) ([]string, error) {
+	data, err := jirix.NewSeq().ReadFile(filepath.Join(project.Path, ".git", "objects", "info", "alternates"))
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var mirrors []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Each line is the objects directory of a repository, which may be
+		// relative to the objects directory of the project.
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(project.Path, ".git", "objects", line)
+		}
+		mirror := filepath.Dir(filepath.Clean(line))
+		if resolved, err := filepath.EvalSymlinks(mirror); err == nil {
+			mirror = resolved
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// cacheCloneOpts returns the options for cloning the given project, borrowing
+// objects from its mirror in the cache if one is configured.  The caller must
+// hold the lock of the mirror until the clone is in place.
+func cacheCloneOpts(jirix *jiri.X, project Project) ([]gitutil.CloneOpt, error) {
+	mirror, err := updateMirror(jirix, project.Remote)
+	if err != nil || mirror == "" {
+		return nil, err
+	}
+	return []gitutil.CloneOpt{gitutil.ReferenceOpt(mirror)}, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"v.io/jiri"
+	"v.io/jiri/profiles"
+)
+
+// condition is the parsed "if" attribute of an import or project, which
+// determines whether the element is used on this host.  It is a
+// comma-separated list of terms that must all hold, where each term is one of:
+//
+//	os=<os>             the host operating system is <os>
+//	arch=<arch>         the host architecture is <arch>
+//	target=<arch>-<os>  the host architecture and operating system match
+//	env:<name>          the environment variable <name> is set and not empty
+//
+// The values of os, arch and target may list alternatives separated by "|",
+// and a term prefixed with "!" holds if the term doesn't.
+type condition []conditionTerm
+
+// knownOS and knownArch hold the values of GOOS and GOARCH, so that
+// misspelled conditions are reported rather than never holding.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true,
+		"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+		"js": true, "linux": true, "nacl": true, "netbsd": true,
+		"openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true,
+		"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+		"mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+		"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+		"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+type conditionTerm struct {
+	negate bool
+	// kind is "os", "arch", "target" or "env".
+	kind string
+	// values holds the alternatives of the term, or the name of the
+	// environment variable.
+	values []string
+}
+
+// parseCondition parses the given "if" attribute.
+func parseCondition(s string) (condition, error) {
+	var c condition
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		var t conditionTerm
+		if strings.HasPrefix(term, "!") {
+			t.negate, term = true, term[1:]
+		}
+		switch {
+		case strings.HasPrefix(term, "env:"):
+			t.kind, t.values = "env", []string{term[len("env:"):]}
+		case strings.Contains(term, "="):
+			index := strings.Index(term, "=")
+			t.kind, t.values = term[:index], strings.Split(term[index+1:], "|")
+		}
+		switch t.kind {
+		case "os":
+			if err := checkKnown(s, "os", t.values, knownOS); err != nil {
+				return nil, err
+			}
+		case "arch":
+			if err := checkKnown(s, "arch", t.values, knownArch); err != nil {
+				return nil, err
+			}
+		case "env":
+		case "target":
+			for _, value := range t.values {
+				target, err := profiles.NewTarget(value)
+				if err != nil {
+					return nil, fmt.Errorf("bad condition %q: %v", s, err)
+				}
+				if err := checkKnown(s, "os", []string{target.OS()}, knownOS); err != nil {
+					return nil, err
+				}
+				if err := checkKnown(s, "arch", []string{target.Arch()}, knownArch); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("bad condition %q: %q is not one of os=<os>, arch=<arch>, target=<arch>-<os> or env:<name>", s, term)
+		}
+		for _, value := range t.values {
+			if value == "" {
+				return nil, fmt.Errorf("bad condition %q: empty value in %q", s, term)
+			}
+		}
+		c = append(c, t)
+	}
+	return c, nil
+}
+
+// checkKnown returns an error if any of the given values of the kind of term
+// isn't known.  Empty values are reported by parseCondition.
+func checkKnown(cond, kind string, values []string, known map[string]bool) error {
+	for _, value := range values {
+		if value != "" && !known[value] {
+			return fmt.Errorf("bad condition %q: unknown %s %q", cond, kind, value)
+		}
+	}
+	return nil
+}
+
+// eval returns true if the condition holds on this host, with the given
+// environment.  Otherwise, it also returns the reason why it doesn't.
+func (c condition) eval(host profiles.Target, env map[string]string) (bool, string) {
+	for _, t := range c {
+		var holds bool
+		var actual string
+		switch t.kind {
+		case "os":
+			holds, actual = contains(t.values, host.OS()), fmt.Sprintf("the host os is %q", host.OS())
+		case "arch":
+			holds, actual = contains(t.values, host.Arch()), fmt.Sprintf("the host arch is %q", host.Arch())
+		case "target":
+			for _, value := range t.values {
+				target, _ := profiles.NewTarget(value)
+				holds = holds || target.Match(&host)
+			}
+			actual = fmt.Sprintf("the host target is %s-%s", host.Arch(), host.OS())
+		case "env":
+			holds = env[t.values[0]] != ""
+			actual = fmt.Sprintf("%v is not set", t.values[0])
+			if holds {
+				actual = fmt.Sprintf("%v is set", t.values[0])
+			}
+		}
+		if holds == t.negate {
+			return false, actual
+		}
+	}
+	return true, ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SkippedElement describes an element of the manifest that was skipped on this
+// host, since its "if" attribute doesn't hold.
+type SkippedElement struct {
+	// Kind is "import", "project" or "tool".
+	Kind string
+	// Name is the name of the project or tool, or the manifest of the import.
+	Name string
+	// Provenance describes where the element was defined.
+	Provenance Provenance
+	// Reason describes why the element was skipped.
+	Reason string
+}
+
+func (e SkippedElement) String() string {
+	return fmt.Sprintf("skipped %s %q at %v: %s", e.Kind, e.Name, e.Provenance, e.Reason)
+}
+
+// skip checks the condition of an element of the manifest file being loaded,
+// which is defined at the given line, and records the element as skipped if
+// the condition doesn't hold.  It returns true if the element is skipped.
+func (ld *loader) skip(jirix *jiri.X, file string, line int, kind, name, cond string) (bool, error) {
+	if cond == "" {
+		return false, nil
+	}
+	c, err := parseCondition(cond)
+	if err != nil {
+		return false, err
+	}
+	holds, reason := c.eval(profiles.NativeTarget(), jirix.Env())
+	if holds {
+		return false, nil
+	}
+	ld.skipped = append(ld.skipped, SkippedElement{
+		Kind:       kind,
+		Name:       name,
+		Provenance: ld.newProvenance(jirix, file, line),
+		Reason:     fmt.Sprintf("condition %q doesn't hold, since %s", cond, reason),
+	})
+	return true, nil
+}
+
+// skipTools drops the loaded tools of projects that were skipped, and records
+// the tools as skipped.
+func (ld *loader) skipTools() {
+	skippedProjects := map[string]bool{}
+	for _, e := range ld.skipped {
+		if e.Kind == "project" {
+			skippedProjects[e.Name] = true
+		}
+	}
+	var names []string
+	for name, tool := range ld.Tools {
+		if skippedProjects[tool.Project] && len(ld.Projects.Find(tool.Project)) == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tool := ld.Tools[name]
+		delete(ld.Tools, name)
+		ld.skipped = append(ld.skipped, SkippedElement{
+			Kind:       "tool",
+			Name:       name,
+			Provenance: ld.toolProvenance[name],
+			Reason:     fmt.Sprintf("project %q was skipped", tool.Project),
+		})
+	}
+}
+
+// SkippedElements loads the manifest and returns the imports, projects and
+// tools that were skipped on this host.
+func SkippedElements(jirix *jiri.X) ([]SkippedElement, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	ld := newManifestLoader(localProjects, false)
+	if err := ld.Load(jirix, "", jirix.JiriManifestFile(), ""); err != nil {
+		return nil, err
+	}
+	return ld.skipped, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+
+	"v.io/jiri"
+	"v.io/jiri/gitutil"
+)
+
+// GitConfig is a git configuration setting of a project, e.g. the key
+// "core.autocrlf" with the value "input".  An empty value unsets the key.
+type GitConfig struct {
+	Key     string   `xml:"key,attr,omitempty"`
+	Value   string   `xml:"value,attr,omitempty"`
+	XMLName struct{} `xml:"gitconfig"`
+}
+
+func (c GitConfig) String() string {
+	return c.Key + "=" + c.Value
+}
+
+// GitRemote is a git remote of a project, such as the upstream repository of
+// a fork.  The remote named "origin" is the project remote, and may only set
+// PushURL.
+type GitRemote struct {
+	Name string `xml:"name,attr,omitempty"`
+	URL  string `xml:"url,attr,omitempty"`
+	// PushURL is the URL used to push to the remote.  If not set, URL is used.
+	PushURL string   `xml:"pushurl,attr,omitempty"`
+	XMLName struct{} `xml:"remote"`
+}
+
+func (r GitRemote) String() string {
+	if r.PushURL != "" {
+		return fmt.Sprintf("%s %s (push %s)", r.Name, r.URL, r.PushURL)
+	}
+	return r.Name + " " + r.URL
+}
+
+// applyGitConfig reconciles the git configuration and remotes of the local
+// repository of the project with those that the project declares.  Settings
+// and remotes declared by previous, the project before the update, that the
+// project no longer declares are removed, while settings that jiri never
+// managed are left alone.  Only the settings that differ are changed, so
+// applying the same project again does nothing.
+func applyGitConfig(jirix *jiri.X, previous *Project, project Project) error {
+	if project.Protocol != "git" {
+		return nil
+	}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	// setConfig sets key to value, or unsets it if value is empty, unless it
+	// already has that value.
+	setConfig := func(key, value string) error {
+		values, err := git.ConfigValues(key)
+		if err != nil {
+			return err
+		}
+		switch {
+		case value == "" && len(values) == 0:
+			return nil
+		case value == "":
+			return git.UnsetConfig(key)
+		case len(values) == 1 && values[0] == value:
+			return nil
+		}
+		return git.SetConfig(key, value)
+	}
+	configs := map[string]bool{}
+	for _, c := range project.GitConfigs {
+		configs[c.Key] = true
+		if err := setConfig(c.Key, c.Value); err != nil {
+			return err
+		}
+	}
+	names, err := git.Remotes()
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, name := range names {
+		exists[name] = true
+	}
+	remotes := map[string]bool{}
+	for _, r := range project.GitRemotes {
+		remotes[r.Name] = true
+		switch {
+		case r.Name == "origin":
+			// The url of origin is the project remote.
+		case !exists[r.Name]:
+			if err := git.AddRemote(r.Name, r.URL); err != nil {
+				return err
+			}
+		default:
+			if err := setConfig("remote."+r.Name+".url", r.URL); err != nil {
+				return err
+			}
+		}
+		if err := setConfig("remote."+r.Name+".pushurl", r.PushURL); err != nil {
+			return err
+		}
+	}
+	if previous == nil {
+		return nil
+	}
+	for _, c := range previous.GitConfigs {
+		if !configs[c.Key] {
+			if err := setConfig(c.Key, ""); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range previous.GitRemotes {
+		switch {
+		case remotes[r.Name]:
+		case r.Name == "origin":
+			if err := setConfig("remote.origin.pushurl", ""); err != nil {
+				return err
+			}
+		case exists[r.Name]:
+			if err := git.RemoveRemote(r.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"v.io/jiri"
+	"v.io/jiri/runutil"
+)
+
+// groupSelection determines which projects are checked out, based on their
+// groups.  It is parsed from a comma-separated list of group names, where a
+// name prefixed with "-" excludes the projects in that group, and a name
+// optionally prefixed with "+" includes them.  If no groups are included, all
+// projects that are not excluded are selected.  Exclusion takes precedence
+// over inclusion.
+type groupSelection struct {
+	include, exclude map[string]bool
+}
+
+// parseGroupSelection parses the given comma-separated list of groups.
+func parseGroupSelection(groups string) (groupSelection, error) {
+	gs := groupSelection{
+		include: make(map[string]bool),
+		exclude: make(map[string]bool),
+	}
+	for _, group := range splitGroups(groups) {
+		target := gs.include
+		switch {
+		case strings.HasPrefix(group, "-"):
+			target, group = gs.exclude, group[1:]
+		case strings.HasPrefix(group, "+"):
+			group = group[1:]
+		}
+		if err := validateGroup(group); err != nil {
+			return groupSelection{}, fmt.Errorf("bad group selection %q: %v", groups, err)
+		}
+		target[group] = true
+	}
+	return gs, nil
+}
+
+// selects returns true if the given project is selected.
+func (gs groupSelection) selects(project Project) bool {
+	included := len(gs.include) == 0
+	for _, group := range splitGroups(project.Groups) {
+		if gs.exclude[group] {
+			return false
+		}
+		if gs.include[group] {
+			included = true
+		}
+	}
+	return included
+}
+
+// selectsLocal returns true if the given local project is selected, based on
+// the groups recorded in its metadata, and the groups of its counterpart in
+// remoteProjects, if any.  The remote groups are checked as well, since the
+// metadata of projects that are not selected is not kept up to date.
+func (gs groupSelection) selectsLocal(local Project, remoteProjects Projects) bool {
+	if !gs.selects(local) {
+		return false
+	}
+	if remote, ok := remoteProjects[local.Key()]; ok && !gs.selects(remote) {
+		return false
+	}
+	return true
+}
+
+// loadGroupSelection returns the group selection of the given update options,
+// or if none is given, the one in $JIRI_ROOT/.jiri_manifest.
+func loadGroupSelection(jirix *jiri.X, opts updateOpts) (groupSelection, error) {
+	if opts.groups != nil {
+		return parseGroupSelection(*opts.groups)
+	}
+	m, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return parseGroupSelection("")
+		}
+		return groupSelection{}, err
+	}
+	return parseGroupSelection(m.Groups)
+}
+
+// saveGroupSelection records the given comma-separated list of groups as the
+// group selection in $JIRI_ROOT/.jiri_manifest.
+func saveGroupSelection(jirix *jiri.X, groups string) error {
+	if _, err := parseGroupSelection(groups); err != nil {
+		return err
+	}
+	m, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		return err
+	}
+	if m.Groups == groups {
+		return nil
+	}
+	m.Groups = groups
+	return m.ToFile(jirix, jirix.JiriManifestFile())
+}
+
+// selectGroups returns the projects and tools for an update from
+// localProjects to remoteProjects, given the group selection.  Remote projects
+// that are not selected are dropped, along with their tools, so that they are
+// not created.  Local projects that are not selected are dropped as well, so
+// that they are neither updated nor deleted.
+func selectGroups(gs groupSelection, localProjects, remoteProjects Projects, remoteTools Tools) (Projects, Projects, Tools) {
+	selectedLocal := Projects{}
+	for key, project := range localProjects {
+		if gs.selectsLocal(project, remoteProjects) {
+			selectedLocal[key] = project
+		}
+	}
+	selectedRemote := Projects{}
+	for key, project := range remoteProjects {
+		if gs.selects(project) {
+			selectedRemote[key] = project
+		}
+	}
+	selectedTools := Tools{}
+	for name, tool := range remoteTools {
+		if len(remoteProjects.Find(tool.Project)) > 0 && len(selectedRemote.Find(tool.Project)) == 0 {
+			continue
+		}
+		selectedTools[name] = tool
+	}
+	return selectedLocal, selectedRemote, selectedTools
+}
+
+// selectLocalProjects returns the given local projects that are selected by
+// the group selection in $JIRI_ROOT/.jiri_manifest, based on the groups
+// recorded in their metadata.
+func selectLocalProjects(jirix *jiri.X, projects Projects) (Projects, error) {
+	gs, err := loadGroupSelection(jirix, updateOpts{})
+	if err != nil {
+		return nil, err
+	}
+	selected := Projects{}
+	for key, project := range projects {
+		if gs.selects(project) {
+			selected[key] = project
+		}
+	}
+	return selected, nil
+}
+
+// splitGroups returns the groups in the given comma-separated list.
+func splitGroups(groups string) []string {
+	var result []string
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// mergeGroups returns the sorted union of the given comma-separated lists of
+// groups.
+func mergeGroups(groups1, groups2 string) string {
+	set := make(map[string]bool)
+	for _, group := range append(splitGroups(groups1), splitGroups(groups2)...) {
+		set[group] = true
+	}
+	var result []string
+	for group := range set {
+		result = append(result, group)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+// validateGroup returns an error if the given group name is invalid.
+func validateGroup(group string) error {
+	if group == "" || strings.IndexAny(group, "+-") == 0 || strings.ContainsAny(group, " \t") {
+		return fmt.Errorf("invalid group name %q", group)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"v.io/jiri"
+	"v.io/jiri/runutil"
+	"v.io/jiri/tool"
+)
+
+// Hooks maps hook names to their detailed description.
+type Hooks map[string]Hook
+
+// Hook is a script that runs once after all projects and tools have been
+// updated, rather than after the operations of a single project like the
+// runhook of a project.  Its argument is "post-update".
+type Hook struct {
+	// Name is the name of the hook.
+	Name string `xml:"name,attr,omitempty"`
+	// Project is the name of the project that contains the hook.  The hook
+	// runs in the directory of the project, and is skipped if the project is
+	// not checked out.
+	Project string `xml:"project,attr,omitempty"`
+	// Action is the path of the hook script, relative to the project.
+	Action  string   `xml:"action,attr,omitempty"`
+	XMLName struct{} `xml:"hook"`
+}
+
+// PostUpdateHookKind is the argument passed to the hooks of the manifest.
+const PostUpdateHookKind = "post-update"
+
+// HookTimeoutOpt is the maximum time a single hook may run before it is killed
+// and reported as timed out.  Zero means no timeout.
+type HookTimeoutOpt time.Duration
+
+func (HookTimeoutOpt) updateOpt() {}
+
+// DefaultHookTimeout is the hook timeout when no HookTimeoutOpt is given.
+const DefaultHookTimeout = 5 * time.Minute
+
+// ParallelHooksOpt determines whether hooks run concurrently, with at most
+// JobsOpt hooks running at the same time, rather than one after another.
+type ParallelHooksOpt bool
+
+func (ParallelHooksOpt) updateOpt() {}
+
+// The statuses of a hookResult.
+const (
+	hookOK       = "ok"
+	hookFailed   = "failed"
+	hookTimedOut = "timed out"
+	hookSkipped  = "skipped"
+)
+
+// hookRun describes a single run of a hook.
+type hookRun struct {
+	// project is the name of the project the hook belongs to.
+	project string
+	// name identifies the hook in the summary.
+	name string
+	// dir is the directory the hook runs in, and path is the hook script,
+	// which is run with the single argument kind.  An empty path means that
+	// the hook is skipped, for the reason given in detail.
+	dir, path, kind string
+	detail          string
+}
+
+// hookResult describes the outcome of a hookRun.
+type hookResult struct {
+	hookRun
+	status   string
+	duration time.Duration
+	err      error
+}
+
+// runHooks runs the hooks of the projects of the given operations.
+func runHooks(jirix *jiri.X, ops []operation, opts updateOpts) []hookResult {
+	jirix.TimerPush("run hooks")
+	defer jirix.TimerPop()
+	var runs []hookRun
+	for _, op := range ops {
+		if !hasHook(op) {
+			continue
+		}
+		runs = append(runs, hookRun{
+			project: op.Project().Name,
+			name:    shortFileName(jirix.Root, op.Project().RunHook),
+			dir:     op.Project().Path,
+			path:    op.Project().RunHook,
+			kind:    op.Kind(),
+		})
+	}
+	return runHookList(jirix, runs, opts)
+}
+
+// hasHook returns true if the hook of the operation's project should be run
+// after the operation.
+func hasHook(op operation) bool {
+	if op.Project().RunHook == "" {
+		return false
+	}
+	return op.Kind() == "create" || op.Kind() == "move" || op.Kind() == "update"
+}
+
+// runPostUpdateHooks runs the given hooks of the manifest, once all projects
+// and tools have been updated to remoteProjects.
+func runPostUpdateHooks(jirix *jiri.X, remoteProjects Projects, hooks Hooks, opts updateOpts) []hookResult {
+	jirix.TimerPush("run post-update hooks")
+	defer jirix.TimerPop()
+	var runs []hookRun
+	for _, name := range hooks.sortedNames() {
+		hook := hooks[name]
+		run := hookRun{project: hook.Project, name: name, kind: PostUpdateHookKind}
+		if project, err := remoteProjects.FindUnique(hook.Project); err != nil {
+			run.detail = fmt.Sprintf("project %q is not checked out", hook.Project)
+		} else {
+			run.dir, run.path = project.Path, filepath.Join(project.Path, hook.Action)
+		}
+		runs = append(runs, run)
+	}
+	return runHookList(jirix, runs, opts)
+}
+
+// sorted returns the hooks sorted by name.
+func (hooks Hooks) sorted() []Hook {
+	var sorted []Hook
+	for _, name := range hooks.sortedNames() {
+		sorted = append(sorted, hooks[name])
+	}
+	return sorted
+}
+
+// sortedNames returns the names of the hooks in sorted order.
+func (hooks Hooks) sortedNames() []string {
+	var names []string
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runHookList runs the given hooks, either serially or with at most opts.jobs
+// hooks running at the same time, and returns their outcome.  All hooks run
+// even if some of them fail.
+//
+// The output of hooks that run concurrently is buffered and written out when
+// they complete, so that it isn't interleaved.
+func runHookList(jirix *jiri.X, runs []hookRun, opts updateOpts) []hookResult {
+	results := make([]hookResult, len(runs))
+	if !opts.parallelHooks || opts.jobs < 2 {
+		for i, run := range runs {
+			results[i] = runHook(jirix, run, opts.hookTimeout)
+		}
+	} else {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, opts.jobs)
+		for i, run := range runs {
+			wg.Add(1)
+			go func(i int, run hookRun) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// jirix is not threadsafe, so we make a clone for each goroutine.
+				var out syncBuffer
+				results[i] = runHook(jirix.Clone(tool.ContextOpts{Stdout: &out, Stderr: &out}), run, opts.hookTimeout)
+				mu.Lock()
+				jirix.Stdout().Write(out.Bytes())
+				mu.Unlock()
+			}(i, run)
+		}
+		wg.Wait()
+	}
+	return results
+}
+
+// reportHooks prints the status and duration of every hook, and returns an
+// error that lists every hook that failed or timed out.
+func reportHooks(jirix *jiri.X, results []hookResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(jirix.Stdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tHOOK\tKIND\tSTATUS\tDURATION\tDETAILS")
+	for _, r := range results {
+		duration := "-"
+		if r.status != hookSkipped {
+			duration = fmt.Sprintf("%.1fs", r.duration.Seconds())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.project, r.name, r.kind, r.status, duration, r.detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var failures []string
+	for _, result := range results {
+		if result.err != nil {
+			failures = append(failures, result.err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d hooks failed:\n%v", len(failures), len(results), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// runHook runs a single hook, subject to the given timeout.
+func runHook(jirix *jiri.X, run hookRun, timeout time.Duration) hookResult {
+	result := hookResult{hookRun: run}
+	if run.path == "" {
+		result.status = hookSkipped
+		return result
+	}
+	s := jirix.NewSeq()
+	s.Verbose(true).Output([]string{fmt.Sprintf("running hook %q for project %q", run.name, run.project)})
+	start := time.Now()
+	err := s.Dir(run.dir).Capture(jirix.Stdout(), jirix.Stderr()).Timeout(timeout).Last(run.path, run.kind)
+	result.duration = time.Since(start)
+	switch {
+	case err == nil:
+		result.status = hookOK
+	case runutil.IsTimeout(err):
+		result.status = hookTimedOut
+		result.detail = fmt.Sprintf("killed after %v", timeout)
+		result.err = fmt.Errorf("hook %q for project %q timed out after %v", run.name, run.project, timeout)
+	default:
+		// TODO(nlacasse): Should we delete projectDir or perform some
+		// other cleanup in the event of a hook failure?
+		result.status = hookFailed
+		result.err = fmt.Errorf("error running hook %q for project %q: %v", run.name, run.project, err)
+	}
+	return result
+}
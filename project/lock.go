@@ -0,0 +1,86 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+
+	"v.io/jiri"
+	"v.io/jiri/runutil"
+)
+
+// The lock file $JIRI_ROOT/.jiri_manifest.lock pins the projects selected by
+// groups, including the manifest projects, and the tools to exact revisions,
+// and records the post-update hooks.  It is a snapshot manifest, i.e. it has no
+// imports, and lives next to .jiri_manifest so that it can be committed along
+// with it.
+
+// WriteLockFile writes the lock file, pinning the projects to the revisions of
+// their local master branches.
+func WriteLockFile(jirix *jiri.X) error {
+	manifest, err := snapshotManifest(jirix)
+	if err != nil {
+		return err
+	}
+	return manifest.ToFile(jirix, jirix.JiriManifestLockFile())
+}
+
+// RefreshLockFile writes the lock file, pinning the projects to the revisions
+// given by the manifest, with projects at "HEAD" resolved to the current
+// revision of their remote branch.  The manifest projects of remote imports
+// that exist locally are pinned to the current revision of their remote
+// branch too, even if the manifest doesn't declare them.  Local projects are
+// left untouched.
+func RefreshLockFile(jirix *jiri.X) error {
+	jirix.TimerPush("refresh lock file")
+	defer jirix.TimerPop()
+	ld, err := loadRemoteManifestWithLoader(jirix)
+	if err != nil {
+		return err
+	}
+	gs, err := loadGroupSelection(jirix, updateOpts{})
+	if err != nil {
+		return err
+	}
+	_, projects, tools := selectGroups(gs, nil, ld.Projects, ld.Tools)
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return err
+	}
+	for key, p := range ld.importProjects {
+		local, ok := localProjects[key]
+		if _, declared := projects[key]; declared || !ok {
+			continue
+		}
+		p.Path = local.Path
+		projects[key] = p
+	}
+	if err := resolveHeadRevisions(jirix, projects); err != nil {
+		return err
+	}
+	manifest := &Manifest{}
+	for _, project := range projects {
+		manifest.Projects = append(manifest.Projects, project)
+	}
+	for _, tool := range tools {
+		manifest.Tools = append(manifest.Tools, tool)
+	}
+	manifest.Hooks = ld.Hooks.sorted()
+	return manifest.ToFile(jirix, jirix.JiriManifestLockFile())
+}
+
+// loadLockFile loads the projects and tools pinned by the lock file, along
+// with the post-update hooks.
+func loadLockFile(jirix *jiri.X) (Projects, Tools, Hooks, error) {
+	file := jirix.JiriManifestLockFile()
+	projects, tools, hooks, err := loadManifestFile(jirix, file, nil)
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return nil, nil, nil, fmt.Errorf("lock file %v doesn't exist; run \"jiri lock refresh\" or \"jiri update -lock\" to create it", file)
+		}
+		return nil, nil, nil, err
+	}
+	return projects, tools, hooks, nil
+}
@@ -13,8 +13,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"v.io/jiri"
@@ -22,6 +24,7 @@ import (
 	"v.io/jiri/gitutil"
 	"v.io/jiri/googlesource"
 	"v.io/jiri/runutil"
+	"v.io/jiri/tool"
 	"v.io/x/lib/set"
 )
 
@@ -41,10 +44,24 @@ type CL struct {
 
 // Manifest represents a setting used for updating the universe.
 type Manifest struct {
+	Hosts        []Host        `xml:"hosts>host"`
+	Defaults     *Defaults     `xml:"defaults"`
 	Imports      []Import      `xml:"imports>import"`
 	LocalImports []LocalImport `xml:"imports>localimport"`
 	Projects     []Project     `xml:"projects>project"`
 	Tools        []Tool        `xml:"tools>tool"`
+	// Hooks run once after all projects and tools have been updated.
+	Hooks []Hook `xml:"hooks>hook"`
+	// Overrides replace attributes of projects loaded from the manifest and
+	// its imports.  They are only used in $JIRI_ROOT/.jiri_manifest.
+	Overrides []Override `xml:"overrides>override"`
+	// Retention is the retention policy of the update history.  It is only
+	// used in $JIRI_ROOT/.jiri_manifest.
+	Retention *RetentionPolicy `xml:"retention"`
+	// Groups is the comma-separated group selection, which determines the
+	// projects that are checked out.  It is only used in
+	// $JIRI_ROOT/.jiri_manifest.
+	Groups string `xml:"groups,attr,omitempty"`
 	// SnapshotPath is the relative path to the snapshot file from JIRI_ROOT.
 	// It is only set when creating a snapshot.
 	SnapshotPath string   `xml:"snapshotpath,attr,omitempty"`
@@ -54,14 +71,26 @@ type Manifest struct {
 // ManifestFromBytes returns a manifest parsed from data, with defaults filled
 // in.
 func ManifestFromBytes(data []byte) (*Manifest, error) {
+	m, _, err := manifestFromBytes(data, nil)
+	return m, err
+}
+
+// manifestFromBytes is like ManifestFromBytes, but also applies the hosts and
+// defaults inherited from importing manifests, and returns the hosts and
+// defaults in effect for manifests imported by the returned manifest.
+func manifestFromBytes(data []byte, inherited *manifestDefaults) (*Manifest, *manifestDefaults, error) {
+	if err := checkManifest(data); err != nil {
+		return nil, nil, err
+	}
 	m := new(Manifest)
 	if err := xml.Unmarshal(data, m); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if err := m.fillDefaults(); err != nil {
-		return nil, err
+	d, err := m.fillDefaults(inherited)
+	if err != nil {
+		return nil, nil, err
 	}
-	return m, nil
+	return m, d, nil
 }
 
 // ManifestFromFile returns a manifest parsed from the contents of filename,
@@ -73,42 +102,77 @@ func ManifestFromBytes(data []byte) (*Manifest, error) {
 // manifest is through LoadManifest, which does absolutize the paths, and uses
 // the correct root directory.
 func ManifestFromFile(jirix *jiri.X, filename string) (*Manifest, error) {
+	m, _, err := manifestFromFile(jirix, filename, nil)
+	return m, err
+}
+
+// manifestFromFile is like ManifestFromFile, but also applies the hosts and
+// defaults inherited from importing manifests.  See manifestFromBytes.
+func manifestFromFile(jirix *jiri.X, filename string, inherited *manifestDefaults) (*Manifest, *manifestDefaults, error) {
 	data, err := jirix.NewSeq().ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	m, d, err := manifestFromBytes(data, inherited)
+	if errs, ok := err.(manifestErrors); ok {
+		return nil, nil, errs.inFile(filename)
 	}
-	m, err := ManifestFromBytes(data)
 	if err != nil {
-		return nil, fmt.Errorf("invalid manifest %s: %v", filename, err)
+		return nil, nil, fmt.Errorf("invalid manifest %s: %v", filename, err)
 	}
-	return m, nil
+	return m, d, nil
 }
 
 var (
-	newlineBytes       = []byte("\n")
-	emptyImportsBytes  = []byte("\n  <imports></imports>\n")
-	emptyProjectsBytes = []byte("\n  <projects></projects>\n")
-	emptyToolsBytes    = []byte("\n  <tools></tools>\n")
+	newlineBytes        = []byte("\n")
+	emptyHostsBytes     = []byte("\n  <hosts></hosts>\n")
+	emptyImportsBytes   = []byte("\n  <imports></imports>\n")
+	emptyProjectsBytes  = []byte("\n  <projects></projects>\n")
+	emptyToolsBytes     = []byte("\n  <tools></tools>\n")
+	emptyHooksBytes     = []byte("\n  <hooks></hooks>\n")
+	emptyOverridesBytes = []byte("\n  <overrides></overrides>\n")
 
 	endElemBytes        = []byte("/>\n")
+	endHostBytes        = []byte("></host>\n")
+	endDefaultsBytes    = []byte("></defaults>\n")
 	endImportBytes      = []byte("></import>\n")
 	endLocalImportBytes = []byte("></localimport>\n")
 	endProjectBytes     = []byte("></project>\n")
 	endToolBytes        = []byte("></tool>\n")
+	endHookBytes        = []byte("></hook>\n")
+	endOverrideBytes    = []byte("></override>\n")
+	endGitConfigBytes   = []byte("></gitconfig>\n")
+	endGitRemoteBytes   = []byte("></remote>\n")
+	endRetentionBytes   = []byte("></retention>\n")
 
 	endImportSoloBytes  = []byte("></import>")
 	endProjectSoloBytes = []byte("></project>")
 	endElemSoloBytes    = []byte("/>")
+
+	endGitConfigSoloBytes = []byte("></gitconfig>")
+	endGitRemoteSoloBytes = []byte("></remote>")
 )
 
 // deepCopy returns a deep copy of Manifest.
 func (m *Manifest) deepCopy() *Manifest {
 	x := new(Manifest)
+	x.Groups = m.Groups
 	x.SnapshotPath = m.SnapshotPath
+	x.Hosts = append([]Host(nil), m.Hosts...)
+	if m.Defaults != nil {
+		defaults := *m.Defaults
+		x.Defaults = &defaults
+	}
 	x.Imports = append([]Import(nil), m.Imports...)
 	x.LocalImports = append([]LocalImport(nil), m.LocalImports...)
 	x.Projects = append([]Project(nil), m.Projects...)
 	x.Tools = append([]Tool(nil), m.Tools...)
+	x.Hooks = append([]Hook(nil), m.Hooks...)
+	x.Overrides = append([]Override(nil), m.Overrides...)
+	if m.Retention != nil {
+		retention := *m.Retention
+		x.Retention = &retention
+	}
 	return x
 }
 
@@ -124,13 +188,23 @@ func (m *Manifest) ToBytes() ([]byte, error) {
 	}
 	// It's hard (impossible?) to get xml.Marshal to elide some of the empty
 	// elements, or produce short empty elements, so we post-process the data.
+	data = bytes.Replace(data, emptyHostsBytes, newlineBytes, -1)
 	data = bytes.Replace(data, emptyImportsBytes, newlineBytes, -1)
 	data = bytes.Replace(data, emptyProjectsBytes, newlineBytes, -1)
 	data = bytes.Replace(data, emptyToolsBytes, newlineBytes, -1)
+	data = bytes.Replace(data, emptyHooksBytes, newlineBytes, -1)
+	data = bytes.Replace(data, emptyOverridesBytes, newlineBytes, -1)
+	data = bytes.Replace(data, endHostBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endDefaultsBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endImportBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endLocalImportBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endProjectBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endToolBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endHookBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endOverrideBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endGitConfigBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endGitRemoteBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endRetentionBytes, endElemBytes, -1)
 	if !bytes.HasSuffix(data, newlineBytes) {
 		data = append(data, '\n')
 	}
@@ -166,35 +240,60 @@ func (m *Manifest) ToFile(jirix *jiri.X, filename string) error {
 	return safeWriteFile(jirix, filename, data)
 }
 
-func (m *Manifest) fillDefaults() error {
+// fillDefaults fills in the defaults of m, using the hosts and defaults of m
+// along with those inherited from importing manifests, which may be nil.  It
+// returns the hosts and defaults in effect for m.
+func (m *Manifest) fillDefaults(inherited *manifestDefaults) (*manifestDefaults, error) {
+	if _, err := parseGroupSelection(m.Groups); err != nil {
+		return nil, err
+	}
+	d, err := newManifestDefaults(m, inherited)
+	if err != nil {
+		return nil, err
+	}
 	for index := range m.Imports {
+		m.Imports[index].Remote = d.expandRemote(m.Imports[index].Remote)
 		if err := m.Imports[index].fillDefaults(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	for index := range m.LocalImports {
 		if err := m.LocalImports[index].validate(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	for index := range m.Projects {
-		if err := m.Projects[index].fillDefaults(); err != nil {
-			return err
+		if err := d.fillProject(&m.Projects[index]); err != nil {
+			return nil, err
 		}
 	}
 	for index := range m.Tools {
 		if err := m.Tools[index].fillDefaults(); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	for index := range m.Overrides {
+		if err := m.Overrides[index].validate(); err != nil {
+			return nil, err
+		}
+		m.Overrides[index].Remote = d.expandRemote(m.Overrides[index].Remote)
+	}
+	return d, nil
 }
 
+// unfillDefaults is the inverse of fillDefaults, using only the hosts and
+// defaults of m.  Remotes under the base url of a host are always written
+// using the host alias, so that the result is canonical.
 func (m *Manifest) unfillDefaults() error {
+	d, err := newManifestDefaults(m, nil)
+	if err != nil {
+		return err
+	}
 	for index := range m.Imports {
 		if err := m.Imports[index].unfillDefaults(); err != nil {
 			return err
 		}
+		m.Imports[index].Remote = d.aliasRemote(m.Imports[index].Remote)
 	}
 	for index := range m.LocalImports {
 		if err := m.LocalImports[index].validate(); err != nil {
@@ -202,7 +301,7 @@ func (m *Manifest) unfillDefaults() error {
 		}
 	}
 	for index := range m.Projects {
-		if err := m.Projects[index].unfillDefaults(); err != nil {
+		if err := d.unfillProject(&m.Projects[index]); err != nil {
 			return err
 		}
 	}
@@ -211,6 +310,192 @@ func (m *Manifest) unfillDefaults() error {
 			return err
 		}
 	}
+	for index := range m.Overrides {
+		if err := m.Overrides[index].validate(); err != nil {
+			return err
+		}
+		m.Overrides[index].Remote = d.aliasRemote(m.Overrides[index].Remote)
+	}
+	return nil
+}
+
+// Host represents a named remote host.  Projects and imports may refer to a
+// remote on the host as "<name>:<path>", which is expanded to the base url of
+// the host followed by "/<path>".
+type Host struct {
+	// Name is the alias of the host.
+	Name string `xml:"name,attr,omitempty"`
+	// Remote is the base url of the host.
+	Remote string `xml:"remote,attr,omitempty"`
+	// GerritHost is the default gerrit host of projects on the host.
+	GerritHost string `xml:"gerrithost,attr,omitempty"`
+	// GitHooks is the default git hooks directory of projects on the host.
+	GitHooks string `xml:"githooks,attr,omitempty"`
+	// RemoteBranch is the default remote branch of projects on the host.
+	RemoteBranch string   `xml:"remotebranch,attr,omitempty"`
+	XMLName      struct{} `xml:"host"`
+}
+
+func (h *Host) validate() error {
+	if h.Name == "" || h.Remote == "" {
+		return fmt.Errorf("bad host: both name and remote must be specified: %+v", *h)
+	}
+	if strings.ContainsAny(h.Name, ":/") {
+		return fmt.Errorf("bad host: name cannot contain ':' or '/': %+v", *h)
+	}
+	return nil
+}
+
+// Defaults represents the default attributes of the projects in a manifest,
+// which are used for projects that are not on a host with its own default.
+type Defaults struct {
+	// GerritHost is the default gerrit host of projects.
+	GerritHost string `xml:"gerrithost,attr,omitempty"`
+	// GitHooks is the default git hooks directory of projects.
+	GitHooks string `xml:"githooks,attr,omitempty"`
+	// RemoteBranch is the default remote branch of projects.
+	RemoteBranch string   `xml:"remotebranch,attr,omitempty"`
+	XMLName      struct{} `xml:"defaults"`
+}
+
+// manifestDefaults holds the hosts and defaults in effect for a manifest.
+// Imported manifests inherit the hosts and defaults of the importing manifest,
+// and may override them with their own.
+type manifestDefaults struct {
+	hosts    map[string]Host
+	defaults Defaults
+}
+
+// newManifestDefaults returns the hosts and defaults in effect for m, given
+// those inherited from importing manifests, which may be nil.
+func newManifestDefaults(m *Manifest, inherited *manifestDefaults) (*manifestDefaults, error) {
+	d := &manifestDefaults{hosts: make(map[string]Host)}
+	if inherited != nil {
+		for name, host := range inherited.hosts {
+			d.hosts[name] = host
+		}
+		d.defaults = inherited.defaults
+	}
+	seen := make(map[string]bool)
+	for _, host := range m.Hosts {
+		if err := host.validate(); err != nil {
+			return nil, err
+		}
+		if seen[host.Name] {
+			return nil, fmt.Errorf("duplicate host %q", host.Name)
+		}
+		seen[host.Name] = true
+		d.hosts[host.Name] = host
+	}
+	if m.Defaults != nil {
+		if m.Defaults.GerritHost != "" {
+			d.defaults.GerritHost = m.Defaults.GerritHost
+		}
+		if m.Defaults.GitHooks != "" {
+			d.defaults.GitHooks = m.Defaults.GitHooks
+		}
+		if m.Defaults.RemoteBranch != "" {
+			d.defaults.RemoteBranch = m.Defaults.RemoteBranch
+		}
+	}
+	return d, nil
+}
+
+// expandRemote returns remote with its host alias, if any, replaced by the
+// base url of the host.
+func (d *manifestDefaults) expandRemote(remote string) string {
+	index := strings.Index(remote, ":")
+	if index < 0 {
+		return remote
+	}
+	host, ok := d.hosts[remote[:index]]
+	if !ok {
+		return remote
+	}
+	return strings.TrimSuffix(host.Remote, "/") + "/" + remote[index+1:]
+}
+
+// hostOf returns the host whose base url is the longest prefix of remote.
+// Ties are broken by host name, to keep the choice deterministic.
+func (d *manifestDefaults) hostOf(remote string) (Host, bool) {
+	var result Host
+	found := false
+	for _, host := range d.hosts {
+		base := strings.TrimSuffix(host.Remote, "/") + "/"
+		if !strings.HasPrefix(remote, base) || len(remote) == len(base) {
+			continue
+		}
+		resultBase := strings.TrimSuffix(result.Remote, "/") + "/"
+		if !found || len(base) > len(resultBase) || (len(base) == len(resultBase) && host.Name < result.Name) {
+			result, found = host, true
+		}
+	}
+	return result, found
+}
+
+// aliasRemote is the inverse of expandRemote.
+func (d *manifestDefaults) aliasRemote(remote string) string {
+	host, ok := d.hostOf(remote)
+	if !ok {
+		return remote
+	}
+	return host.Name + ":" + strings.TrimPrefix(remote, strings.TrimSuffix(host.Remote, "/")+"/")
+}
+
+// projectDefaults returns the defaults for a project with the given expanded
+// remote.  Host defaults take precedence over manifest defaults.
+func (d *manifestDefaults) projectDefaults(remote string) Defaults {
+	defaults := d.defaults
+	if host, ok := d.hostOf(remote); ok {
+		if host.GerritHost != "" {
+			defaults.GerritHost = host.GerritHost
+		}
+		if host.GitHooks != "" {
+			defaults.GitHooks = host.GitHooks
+		}
+		if host.RemoteBranch != "" {
+			defaults.RemoteBranch = host.RemoteBranch
+		}
+	}
+	if defaults.RemoteBranch == "" {
+		defaults.RemoteBranch = "master"
+	}
+	return defaults
+}
+
+func (d *manifestDefaults) fillProject(p *Project) error {
+	p.Remote = d.expandRemote(p.Remote)
+	defaults := d.projectDefaults(p.Remote)
+	if p.GerritHost == "" {
+		p.GerritHost = defaults.GerritHost
+	}
+	if p.GitHooks == "" {
+		p.GitHooks = defaults.GitHooks
+	}
+	if p.RemoteBranch == "" {
+		p.RemoteBranch = defaults.RemoteBranch
+	}
+	return p.fillDefaults()
+}
+
+func (d *manifestDefaults) unfillProject(p *Project) error {
+	defaults := d.projectDefaults(p.Remote)
+	// Project.unfillDefaults only knows about the "master" default.
+	remoteBranch := p.RemoteBranch
+	if err := p.unfillDefaults(); err != nil {
+		return err
+	}
+	p.RemoteBranch = remoteBranch
+	if p.RemoteBranch == defaults.RemoteBranch {
+		p.RemoteBranch = ""
+	}
+	if p.GerritHost == defaults.GerritHost {
+		p.GerritHost = ""
+	}
+	if p.GitHooks == defaults.GitHooks {
+		p.GitHooks = ""
+	}
+	p.Remote = d.aliasRemote(p.Remote)
 	return nil
 }
 
@@ -218,6 +503,12 @@ func (m *Manifest) unfillDefaults() error {
 type Import struct {
 	// Manifest file to use from the remote manifest project.
 	Manifest string `xml:"manifest,attr,omitempty"`
+	// Groups is a comma-separated list of groups that all projects in the
+	// imported manifest belong to, in addition to their own groups.
+	Groups string `xml:"groups,attr,omitempty"`
+	// If is the condition under which the import is used, e.g. "os=linux".
+	// If not set, the import is always used.
+	If string `xml:"if,attr,omitempty"`
 	// Name is the name of the remote manifest project, used to determine the
 	// project key.
 	Name string `xml:"name,attr,omitempty"`
@@ -259,6 +550,11 @@ func (i *Import) validate() error {
 	if i.Manifest == "" || i.Remote == "" {
 		return fmt.Errorf("bad import: both manifest and remote must be specified")
 	}
+	for _, group := range splitGroups(i.Groups) {
+		if err := validateGroup(group); err != nil {
+			return fmt.Errorf("bad import: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -316,6 +612,69 @@ func (i *LocalImport) validate() error {
 	return nil
 }
 
+// Override represents an override of the attributes of a project, which is
+// useful to try out a change without editing the remote manifest.
+type Override struct {
+	// Project is the key or name of the overridden project.
+	Project string `xml:"project,attr,omitempty"`
+	// Path, if set, replaces the path of the project.
+	Path string `xml:"path,attr,omitempty"`
+	// Remote, if set, replaces the remote of the project.
+	Remote string `xml:"remote,attr,omitempty"`
+	// RemoteBranch, if set, replaces the remote branch of the project.
+	RemoteBranch string `xml:"remotebranch,attr,omitempty"`
+	// Revision, if set, replaces the revision of the project.
+	Revision string   `xml:"revision,attr,omitempty"`
+	XMLName  struct{} `xml:"override"`
+}
+
+func (o *Override) validate() error {
+	if o.Project == "" {
+		return fmt.Errorf("bad override: must specify project: %+v", *o)
+	}
+	if o.Path == "" && o.Remote == "" && o.RemoteBranch == "" && o.Revision == "" {
+		return fmt.Errorf("bad override: must specify path, remote, remotebranch or revision: %+v", *o)
+	}
+	return nil
+}
+
+// apply applies the override to the given project, with relative paths taken
+// relative to root.
+func (o Override) apply(project *Project, root string) {
+	if o.Path != "" {
+		project.Path = o.Path
+		if !filepath.IsAbs(project.Path) {
+			project.Path = filepath.Join(root, project.Path)
+		}
+	}
+	if o.Remote != "" {
+		project.Remote = o.Remote
+	}
+	if o.RemoteBranch != "" {
+		project.RemoteBranch = o.RemoteBranch
+	}
+	if o.Revision != "" {
+		project.Revision = o.Revision
+	}
+}
+
+// overrides returns true if the override applies to the given local project,
+// which has the attributes resulting from the override.
+func (o Override) overrides(project Project) bool {
+	name, remote := o.Project, ""
+	if i := strings.Index(o.Project, projectKeySeparator); i >= 0 {
+		name, remote = o.Project[:i], o.Project[i+len(projectKeySeparator):]
+	}
+	switch {
+	case name != project.Name:
+		return false
+	case o.Remote != "":
+		return project.Remote == o.Remote
+	default:
+		return remote == "" || project.Remote == remote
+	}
+}
+
 // ProjectKey is a unique string for a project.
 type ProjectKey string
 
@@ -366,7 +725,47 @@ type Project struct {
 	// RunHook is a script that will run when the project is created, updated,
 	// or moved.  The argument to the script will be "create", "update" or
 	// "move" depending on the type of operation being performed.
-	RunHook string   `xml:"runhook,attr,omitempty"`
+	RunHook string `xml:"runhook,attr,omitempty"`
+	// Groups is a comma-separated list of groups the project belongs to, which
+	// determine whether it is checked out.
+	Groups string `xml:"groups,attr,omitempty"`
+	// Depth is the number of commits of history to fetch for a shallow clone
+	// of the project.  If not set, the complete history is fetched.
+	Depth int `xml:"depth,attr,omitempty"`
+	// Filter is the filter spec of a partial clone of the project, e.g.
+	// "blob:none".  If not set, all objects are fetched.
+	Filter string `xml:"filter,attr,omitempty"`
+	// Nested allows the project to be located within the working tree of
+	// another project, whose .git/info/exclude file then lists the project.
+	Nested bool `xml:"nested,attr,omitempty"`
+	// If is the condition under which the project is used, e.g. "os=linux".
+	// If not set, the project is always used.  Loaded projects never have a
+	// condition, since projects whose condition doesn't hold are skipped.
+	If string `xml:"if,attr,omitempty"`
+	// Formerly is the former name of the project.  "jiri update" renames a
+	// local project with that name to this project, keeping its local branches
+	// and metadata, rather than deleting it and creating this project.
+	Formerly string `xml:"formerly,attr,omitempty"`
+	// FormerPath is the former path of the project.  "jiri update" moves and
+	// renames a local project at that path to this project, like for Formerly.
+	FormerPath string `xml:"formerpath,attr,omitempty"`
+	// GitConfigs are git configuration settings that "jiri update" applies to
+	// the local repository of a git project.
+	GitConfigs []GitConfig `xml:"gitconfig"`
+	// GitRemotes are git remotes that "jiri update" adds to the local
+	// repository of a git project, besides "origin", which is the project
+	// remote.
+	GitRemotes []GitRemote `xml:"remote"`
+	// LocalBranch and LocalRevision are the current branch of the project and
+	// its revision, if it isn't master.  They are only recorded in snapshots
+	// created with IncludeBranchesOpt, and restored by CheckoutSnapshot.
+	LocalBranch   string `xml:"localbranch,attr,omitempty"`
+	LocalRevision string `xml:"localrevision,attr,omitempty"`
+	// Bundle is the git bundle with the commits of LocalBranch that are not on
+	// master, and Patch is the patch with the uncommitted changes of the
+	// project.  Both are relative to the directory of the snapshot.
+	Bundle  string   `xml:"bundle,attr,omitempty"`
+	Patch   string   `xml:"patch,attr,omitempty"`
 	XMLName struct{} `xml:"project"`
 }
 
@@ -405,7 +804,11 @@ func (p Project) ToFile(jirix *jiri.X, filename string) error {
 		return fmt.Errorf("project xml.Marshal failed: %v", err)
 	}
 	// Same logic as Manifest.ToBytes, to make the output more compact.
-	data = bytes.Replace(data, endProjectSoloBytes, endElemSoloBytes, -1)
+	data = bytes.Replace(data, endGitConfigSoloBytes, endElemSoloBytes, -1)
+	data = bytes.Replace(data, endGitRemoteSoloBytes, endElemSoloBytes, -1)
+	if len(p.GitConfigs) == 0 && len(p.GitRemotes) == 0 {
+		data = bytes.Replace(data, endProjectSoloBytes, endElemSoloBytes, -1)
+	}
 	if !bytes.HasSuffix(data, newlineBytes) {
 		data = append(data, '\n')
 	}
@@ -423,6 +826,9 @@ func (p *Project) absolutizePaths(basepath string) {
 	if p.RunHook != "" && !filepath.IsAbs(p.RunHook) {
 		p.RunHook = filepath.Join(basepath, p.RunHook)
 	}
+	if p.FormerPath != "" && !filepath.IsAbs(p.FormerPath) {
+		p.FormerPath = filepath.Join(basepath, p.FormerPath)
+	}
 }
 
 // relativizePaths makes all absolute paths relative to basepath.
@@ -448,6 +854,13 @@ func (p *Project) relativizePaths(basepath string) error {
 		}
 		p.RunHook = relRunHook
 	}
+	if filepath.IsAbs(p.FormerPath) {
+		relFormerPath, err := filepath.Rel(basepath, p.FormerPath)
+		if err != nil {
+			return err
+		}
+		p.FormerPath = relFormerPath
+	}
 	return nil
 }
 
@@ -486,8 +899,18 @@ func (p *Project) validate() error {
 	if strings.Contains(p.Name, projectKeySeparator) {
 		return fmt.Errorf("bad project: name cannot contain %q: %+v", projectKeySeparator, *p)
 	}
-	if p.Protocol != "" && p.Protocol != "git" {
-		return fmt.Errorf("bad project: only git protocol is supported: %+v", *p)
+	if p.Protocol != "" {
+		if _, err := lookupProtocol(p.Protocol); err != nil {
+			return fmt.Errorf("bad project: %v: %+v", err, *p)
+		}
+	}
+	for _, group := range splitGroups(p.Groups) {
+		if err := validateGroup(group); err != nil {
+			return fmt.Errorf("bad project: %v: %+v", err, *p)
+		}
+	}
+	if p.Depth < 0 {
+		return fmt.Errorf("bad project: depth cannot be negative: %+v", *p)
 	}
 	return nil
 }
@@ -597,6 +1020,118 @@ const (
 	FullScan = ScanMode(true)
 )
 
+// UpdateOpt is an option for UpdateUniverse and CheckoutSnapshot.
+type UpdateOpt interface {
+	updateOpt()
+}
+
+// JobsOpt is the maximum number of project operations that may run
+// concurrently.  Values less than 2 run all operations serially.
+type JobsOpt int
+
+func (JobsOpt) updateOpt() {}
+
+// DefaultJobs is the number of project operations run concurrently when no
+// JobsOpt is given.
+const DefaultJobs = 8
+
+// RollbackOpt determines whether a failed update rolls the projects it touched
+// back to their revisions in the latest update history snapshot.
+type RollbackOpt bool
+
+func (RollbackOpt) updateOpt() {}
+
+// GroupsOpt is the comma-separated group selection, which determines the
+// projects that are checked out.  UpdateUniverse records it in
+// $JIRI_ROOT/.jiri_manifest for subsequent commands.
+type GroupsOpt string
+
+func (GroupsOpt) updateOpt() {}
+
+// DepthOpt is the number of commits of history to fetch for shallow clones of
+// git projects that don't specify their own depth.
+type DepthOpt int
+
+func (DepthOpt) updateOpt() {}
+
+// FilterOpt is the filter spec for partial clones of git projects that don't
+// specify their own filter, e.g. "blob:none".
+type FilterOpt string
+
+func (FilterOpt) updateOpt() {}
+
+// LockedOpt determines whether UpdateUniverse checks out the projects and
+// tools pinned in $JIRI_ROOT/.jiri_manifest.lock, rather than those in the
+// manifest.
+type LockedOpt bool
+
+func (LockedOpt) updateOpt() {}
+
+// LocalOpt determines whether UpdateUniverse works offline, without contacting
+// any remotes.  The manifest is resolved from the refs that were already
+// fetched into the manifest projects, and the projects are reset to their
+// revisions without fetching, which fails if a revision isn't available
+// locally.  Projects that don't exist locally can't be created.
+type LocalOpt bool
+
+func (LocalOpt) updateOpt() {}
+
+// SkipUpdateHistoryOpt determines whether CheckoutSnapshot leaves the update
+// history unchanged, rather than recording the checked out state in it.  This
+// is used for temporary checkouts, such as the steps of a bisection.
+type SkipUpdateHistoryOpt bool
+
+func (SkipUpdateHistoryOpt) updateOpt() {}
+
+// updateOpts holds the settings collected from a list of UpdateOpts.
+type updateOpts struct {
+	jobs        int
+	rollback    bool
+	groups      *string
+	depth       int
+	filter      string
+	locked      bool
+	local       bool
+	skipHistory bool
+	rebase      RebaseOpt
+	// hookTimeout and parallelHooks control how hooks are run; see
+	// runHookList.
+	hookTimeout   time.Duration
+	parallelHooks bool
+}
+
+func newUpdateOpts(opts []UpdateOpt) updateOpts {
+	uo := updateOpts{jobs: DefaultJobs, hookTimeout: DefaultHookTimeout}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case JobsOpt:
+			uo.jobs = int(typedOpt)
+		case RollbackOpt:
+			uo.rollback = bool(typedOpt)
+		case GroupsOpt:
+			groups := string(typedOpt)
+			uo.groups = &groups
+		case DepthOpt:
+			uo.depth = int(typedOpt)
+		case FilterOpt:
+			uo.filter = string(typedOpt)
+		case LockedOpt:
+			uo.locked = bool(typedOpt)
+		case LocalOpt:
+			uo.local = bool(typedOpt)
+		case SkipUpdateHistoryOpt:
+			uo.skipHistory = bool(typedOpt)
+		case RebaseOpt:
+			uo.rebase = typedOpt
+		case HookTimeoutOpt:
+			uo.hookTimeout = time.Duration(typedOpt)
+		case ParallelHooksOpt:
+			uo.parallelHooks = bool(typedOpt)
+		}
+	}
+	return uo
+}
+
 type UnsupportedProtocolErr string
 
 func (e UnsupportedProtocolErr) Error() string {
@@ -609,7 +1144,9 @@ type Update map[string][]CL
 
 // CreateSnapshot creates a manifest that encodes the current state of master
 // branches of all projects and writes this snapshot out to the given file.
-func CreateSnapshot(jirix *jiri.X, file, snapshotPath string) error {
+// The options may add the current branches and uncommitted changes of the
+// projects to the snapshot.
+func CreateSnapshot(jirix *jiri.X, file, snapshotPath string, opts ...SnapshotOpt) error {
 	jirix.TimerPush("create snapshot")
 	defer jirix.TimerPop()
 
@@ -627,37 +1164,58 @@ func CreateSnapshot(jirix *jiri.X, file, snapshotPath string) error {
 		snapshotPath = relSnapshotPath
 	}
 
-	manifest := Manifest{
-		SnapshotPath: snapshotPath,
+	manifest, err := snapshotManifest(jirix)
+	if err != nil {
+		return err
 	}
+	manifest.SnapshotPath = snapshotPath
+	if err := recordLocalState(jirix, manifest, file, newSnapshotOpts(opts)); err != nil {
+		return err
+	}
+	return manifest.ToFile(jirix, file)
+}
 
-	// Add all local projects to manifest.
+// snapshotManifest returns a manifest that encodes the current state of master
+// branches of all projects selected by groups, along with the tools and the
+// post-update hooks.
+func snapshotManifest(jirix *jiri.X) (*Manifest, error) {
 	localProjects, err := LocalProjects(jirix, FullScan)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, project := range localProjects {
-		manifest.Projects = append(manifest.Projects, project)
+	// Load the current manifest, for its tools and project groups.  We can't
+	// just call LoadManifest here, since that determines the local projects
+	// using FastScan, but if we're calling CreateSnapshot during "jiri update"
+	// and we added some new projects, they won't be found anymore.
+	remoteProjects, tools, hooks, err := loadManifestFile(jirix, jirix.JiriManifestFile(), localProjects)
+	if err != nil {
+		return nil, err
 	}
-
-	// Add all tools from the current manifest to the snapshot manifest.
-	// We can't just call LoadManifest here, since that determines the
-	// local projects using FastScan, but if we're calling CreateSnapshot
-	// during "jiri update" and we added some new projects, they won't be
-	// found anymore.
-	_, tools, err := loadManifestFile(jirix, jirix.JiriManifestFile(), localProjects)
+	gs, err := loadGroupSelection(jirix, updateOpts{})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	localProjects, _, tools = selectGroups(gs, localProjects, remoteProjects, tools)
+
+	// Add all selected local projects and tools to the snapshot manifest.
+	manifest := &Manifest{}
+	for _, project := range localProjects {
+		manifest.Projects = append(manifest.Projects, project)
 	}
 	for _, tool := range tools {
 		manifest.Tools = append(manifest.Tools, tool)
 	}
-	return manifest.ToFile(jirix, file)
+	manifest.Hooks = hooks.sorted()
+	return manifest, nil
 }
 
 // CheckoutSnapshot updates project state to the state specified in the given
 // snapshot file.  Note that the snapshot file must not contain remote imports.
-func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc bool) error {
+// The branches and uncommitted changes recorded in the snapshot are restored
+// once the projects have been updated, and the post-update hooks recorded in
+// the snapshot are run.  The new state is recorded in the update history
+// unless SkipUpdateHistoryOpt is given.
+func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc bool, opts ...UpdateOpt) error {
 	// Find all local projects.
 	scanMode := FastScan
 	if gc {
@@ -667,20 +1225,28 @@ func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc bool) error {
 	if err != nil {
 		return err
 	}
-	remoteProjects, remoteTools, err := LoadSnapshotFile(jirix, snapshot)
+	remoteProjects, remoteTools, remoteHooks, err := loadManifestFile(jirix, snapshot, nil)
 	if err != nil {
 		return err
 	}
-	if err := updateTo(jirix, localProjects, remoteProjects, remoteTools, gc); err != nil {
+	localState := takeLocalState(remoteProjects)
+	uo := newUpdateOpts(opts)
+	if err := updateTo(jirix, localProjects, remoteProjects, remoteTools, remoteHooks, gc, uo); err != nil {
 		return err
 	}
-	return WriteUpdateHistorySnapshot(jirix, snapshot)
+	if !uo.skipHistory {
+		if err := WriteUpdateHistorySnapshot(jirix, snapshot); err != nil {
+			return err
+		}
+	}
+	return restoreLocalState(jirix, localState, snapshot)
 }
 
 // LoadSnapshotFile loads the specified snapshot manifest.  If the snapshot
 // manifest contains a remote import, an error will be returned.
 func LoadSnapshotFile(jirix *jiri.X, file string) (Projects, Tools, error) {
-	return loadManifestFile(jirix, file, nil)
+	projects, tools, _, err := loadManifestFile(jirix, file, nil)
+	return projects, tools, err
 }
 
 // CurrentProjectKey gets the key of the current project from the current
@@ -706,16 +1272,15 @@ func CurrentProjectKey(jirix *jiri.X) (ProjectKey, error) {
 // each project as found on the filesystem
 func setProjectRevisions(jirix *jiri.X, projects Projects) (_ Projects, e error) {
 	for name, project := range projects {
-		switch project.Protocol {
-		case "git":
-			revision, err := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path)).CurrentRevisionOfBranch("master")
-			if err != nil {
-				return nil, err
-			}
-			project.Revision = revision
-		default:
-			return nil, UnsupportedProtocolErr(project.Protocol)
+		protocol, err := lookupProtocol(project.Protocol)
+		if err != nil {
+			return nil, err
 		}
+		revision, err := protocol.CurrentRevision(jirix, project)
+		if err != nil {
+			return nil, err
+		}
+		project.Revision = revision
 		projects[name] = project
 	}
 	return projects, nil
@@ -795,13 +1360,6 @@ func PollProjects(jirix *jiri.X, projectSet map[string]struct{}) (_ Update, e er
 	jirix.TimerPush("poll projects")
 	defer jirix.TimerPop()
 
-	// Switch back to current working directory when we're done.
-	cwd, err := os.Getwd()
-	if err != nil {
-		return nil, err
-	}
-	defer collect.Error(func() error { return jirix.NewSeq().Chdir(cwd).Done() }, &e)
-
 	// Gather local & remote project data.
 	localProjects, err := LocalProjects(jirix, FastScan)
 	if err != nil {
@@ -814,8 +1372,7 @@ func PollProjects(jirix *jiri.X, projectSet map[string]struct{}) (_ Update, e er
 
 	// Compute difference between local and remote.
 	update := Update{}
-	ops := computeOperations(localProjects, remoteProjects, false)
-	s := jirix.NewSeq()
+	ops := computeOperations(localProjects, remoteProjects, false, false)
 	for _, op := range ops {
 		name := op.Project().Name
 
@@ -829,38 +1386,12 @@ func PollProjects(jirix *jiri.X, projectSet map[string]struct{}) (_ Update, e er
 		// We only inspect this project if an update operation is required.
 		cls := []CL{}
 		if updateOp, ok := op.(updateOperation); ok {
-			switch updateOp.project.Protocol {
-			case "git":
-
-				// Enter project directory - this assumes absolute paths.
-				if err := s.Chdir(updateOp.destination).Done(); err != nil {
-					return nil, err
-				}
-
-				// Fetch the latest from origin.
-				if err := gitutil.New(jirix.NewSeq()).FetchRefspec("origin", updateOp.project.RemoteBranch); err != nil {
-					return nil, err
-				}
-
-				// Collect commits visible from FETCH_HEAD that aren't visible from master.
-				commitsText, err := gitutil.New(jirix.NewSeq()).Log("FETCH_HEAD", "master", "%an%n%ae%n%B")
-				if err != nil {
-					return nil, err
-				}
-
-				// Format those commits and add them to the results.
-				for _, commitText := range commitsText {
-					if got, want := len(commitText), 3; got < want {
-						return nil, fmt.Errorf("Unexpected length of %v: got %v, want at least %v", commitText, got, want)
-					}
-					cls = append(cls, CL{
-						Author:      commitText[0],
-						Email:       commitText[1],
-						Description: strings.Join(commitText[2:], "\n"),
-					})
-				}
-			default:
-				return nil, UnsupportedProtocolErr(updateOp.project.Protocol)
+			protocol, err := lookupProtocol(updateOp.project.Protocol)
+			if err != nil {
+				return nil, err
+			}
+			if cls, err = protocol.Poll(jirix, updateOp.project); err != nil {
+				return nil, err
 			}
 		}
 		update[name] = cls
@@ -870,7 +1401,7 @@ func PollProjects(jirix *jiri.X, projectSet map[string]struct{}) (_ Update, e er
 
 // LoadManifest loads the manifest, starting with the .jiri_manifest file,
 // resolving remote and local imports.  Returns the projects and tools specified
-// by the manifest.
+// by the manifest, limited to those selected by the groups in .jiri_manifest.
 //
 // WARNING: LoadManifest cannot be run multiple times in parallel!  It invokes
 // git operations which require a lock on the filesystem.  If you see errors
@@ -884,7 +1415,16 @@ func LoadManifest(jirix *jiri.X) (Projects, Tools, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	return loadManifestFile(jirix, file, localProjects)
+	projects, tools, _, err := loadManifestFile(jirix, file, localProjects)
+	if err != nil {
+		return nil, nil, err
+	}
+	gs, err := loadGroupSelection(jirix, updateOpts{})
+	if err != nil {
+		return nil, nil, err
+	}
+	_, projects, tools = selectGroups(gs, nil, projects, tools)
+	return projects, tools, nil
 }
 
 // loadManifestFile loads the manifest starting with the given file, resolving
@@ -895,12 +1435,12 @@ func LoadManifest(jirix *jiri.X) (Projects, Tools, error) {
 // invokes git operations which require a lock on the filesystem.  If you see
 // errors about ".git/index.lock exists", you are likely calling
 // loadManifestFile in parallel.
-func loadManifestFile(jirix *jiri.X, file string, localProjects Projects) (Projects, Tools, error) {
+func loadManifestFile(jirix *jiri.X, file string, localProjects Projects) (Projects, Tools, Hooks, error) {
 	ld := newManifestLoader(localProjects, false)
 	if err := ld.Load(jirix, "", file, ""); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	return ld.Projects, ld.Tools, nil
+	return ld.Projects, ld.Tools, ld.Hooks, nil
 }
 
 // getManifestRemote returns the remote url of the origin from the manifest
@@ -917,24 +1457,36 @@ func getManifestRemote(jirix *jiri.X, manifestPath string) (string, error) {
 		}, "get manifest origin").Done()
 }
 
-func loadUpdatedManifest(jirix *jiri.X, localProjects Projects) (Projects, Tools, string, error) {
+// loadUpdatedManifest loads the manifest, updating all manifest projects to
+// match their remote counterparts.  If local is true, the manifest projects are
+// reset to the refs that were already fetched instead, and remote imports that
+// don't exist locally result in an error.
+func loadUpdatedManifest(jirix *jiri.X, localProjects Projects, local bool) (Projects, Tools, Hooks, string, error) {
 	jirix.TimerPush("load updated manifest")
 	defer jirix.TimerPop()
-	ld := newManifestLoader(localProjects, true)
+	ld := newManifestLoader(localProjects, !local)
+	ld.local = local
 	if err := ld.Load(jirix, "", jirix.JiriManifestFile(), ""); err != nil {
-		return nil, nil, ld.TmpDir, err
+		return nil, nil, nil, ld.TmpDir, err
 	}
-	return ld.Projects, ld.Tools, ld.TmpDir, nil
+	return ld.Projects, ld.Tools, ld.Hooks, ld.TmpDir, nil
 }
 
 // UpdateUniverse updates all local projects and tools to match the remote
 // counterparts identified in the manifest. Optionally, the 'gc' flag can be
 // used to indicate that local projects that no longer exist remotely should be
 // removed.
-func UpdateUniverse(jirix *jiri.X, gc bool) (e error) {
+func UpdateUniverse(jirix *jiri.X, gc bool, opts ...UpdateOpt) (e error) {
 	jirix.TimerPush("update universe")
 	defer jirix.TimerPop()
 
+	uo := newUpdateOpts(opts)
+	if uo.groups != nil {
+		if err := saveGroupSelection(jirix, *uo.groups); err != nil {
+			return err
+		}
+	}
+
 	// Find all local projects.
 	scanMode := FastScan
 	if gc {
@@ -945,25 +1497,45 @@ func UpdateUniverse(jirix *jiri.X, gc bool) (e error) {
 		return err
 	}
 
+	if uo.locked {
+		remoteProjects, remoteTools, remoteHooks, err := loadLockFile(jirix)
+		if err != nil {
+			return err
+		}
+		return updateTo(jirix, localProjects, remoteProjects, remoteTools, remoteHooks, gc, uo)
+	}
+
 	// Load the manifest, updating all manifest projects to match their remote
 	// counterparts.
 	s := jirix.NewSeq()
-	remoteProjects, remoteTools, tmpLoadDir, err := loadUpdatedManifest(jirix, localProjects)
+	remoteProjects, remoteTools, remoteHooks, tmpLoadDir, err := loadUpdatedManifest(jirix, localProjects, uo.local)
 	if tmpLoadDir != "" {
 		defer collect.Error(func() error { return s.RemoveAll(tmpLoadDir).Done() }, &e)
 	}
 	if err != nil {
 		return err
 	}
-	return updateTo(jirix, localProjects, remoteProjects, remoteTools, gc)
+	return updateTo(jirix, localProjects, remoteProjects, remoteTools, remoteHooks, gc, uo)
 }
 
 // updateTo updates the local projects and tools to the state specified in
-// remoteProjects and remoteTools.
-func updateTo(jirix *jiri.X, localProjects, remoteProjects Projects, remoteTools Tools, gc bool) (e error) {
+// remoteProjects and remoteTools, and then runs remoteHooks.
+func updateTo(jirix *jiri.X, localProjects, remoteProjects Projects, remoteTools Tools, remoteHooks Hooks, gc bool, opts updateOpts) (e error) {
+	localProjects, remoteProjects, remoteTools, err := updateGroups(jirix, localProjects, remoteProjects, remoteTools, opts)
+	if err != nil {
+		return err
+	}
+	if opts.rollback {
+		defer func() {
+			if e != nil {
+				e = rollbackUpdate(jirix, localProjects, remoteProjects, gc, opts, e)
+			}
+		}()
+	}
 	s := jirix.NewSeq()
 	// 1. Update all local projects to match the specified projects argument.
-	if err := updateProjects(jirix, localProjects, remoteProjects, gc); err != nil {
+	hookResults, err := updateProjects(jirix, localProjects, remoteProjects, gc, opts)
+	if err != nil {
 		return err
 	}
 	// 2. Build all tools in a temporary directory.
@@ -980,13 +1552,318 @@ func updateTo(jirix *jiri.X, localProjects, remoteProjects Projects, remoteTools
 		return err
 	}
 	// 4. If we have the jiri project, then update the jiri script in
-	// $JIRI_ROOT/.jiri_root/scripts.
-	jiriProject, err := remoteProjects.FindUnique(JiriProject)
+	// $JIRI_ROOT/.jiri_root/scripts.  The jiri project is often not found in
+	// tests, which is ok to ignore.
+	if jiriProject, err := remoteProjects.FindUnique(JiriProject); err == nil {
+		if err := updateJiriScript(jirix, jiriProject); err != nil {
+			return err
+		}
+	}
+	// 5. Run the post-update hooks, and report the outcome of all hooks.
+	hookResults = append(hookResults, runPostUpdateHooks(jirix, remoteProjects, remoteHooks, opts)...)
+	return reportHooks(jirix, hookResults)
+}
+
+// updateGroups applies the group selection to an update from localProjects to
+// remoteProjects, and returns the selected projects and tools; see
+// selectGroups.  The metadata of local projects that are not selected is
+// updated with their new groups, so that they stay hidden from commands that
+// only look at local projects.
+func updateGroups(jirix *jiri.X, localProjects, remoteProjects Projects, remoteTools Tools, opts updateOpts) (Projects, Projects, Tools, error) {
+	gs, err := loadGroupSelection(jirix, opts)
 	if err != nil {
-		// jiri project not found.  This happens often in tests.  Ok to ignore.
-		return nil
+		return nil, nil, nil, err
+	}
+	// Projects that were not selected before are missing from the latest
+	// update history snapshot, so a FastScan may not have found them.
+	for key, remote := range remoteProjects {
+		if _, ok := localProjects[key]; ok || !gs.selects(remote) {
+			continue
+		}
+		isLocal, err := isLocalProject(jirix, remote.Path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if isLocal {
+			if localProjects, err = LocalProjects(jirix, FullScan); err != nil {
+				return nil, nil, nil, err
+			}
+			break
+		}
+	}
+	selectedLocal, selectedRemote, selectedTools := selectGroups(gs, localProjects, remoteProjects, remoteTools)
+	for key, local := range localProjects {
+		remote, ok := remoteProjects[key]
+		if _, selected := selectedLocal[key]; selected || !ok || local.Groups == remote.Groups {
+			continue
+		}
+		local.Groups = remote.Groups
+		if err := writeMetadata(jirix, local, local.Path); err != nil {
+			return nil, nil, nil, err
+		}
 	}
-	return updateJiriScript(jirix, jiriProject)
+	return selectedLocal, selectedRemote, selectedTools, nil
+}
+
+// rollbackUpdate is called when updating localProjects to remoteProjects has
+// failed with updateErr.  It returns every project touched by the update to its
+// revision and path in the latest update history snapshot, rebuilds the tools
+// of that snapshot, so that the tools match the source again, and runs its
+// post-update hooks.  Projects that the update created are deleted, and other
+// projects that were not in the snapshot are left alone.  The returned error
+// always includes updateErr.
+func rollbackUpdate(jirix *jiri.X, localProjects, remoteProjects Projects, gc bool, opts updateOpts, updateErr error) error {
+	s := jirix.NewSeq()
+	snapshot := jirix.UpdateHistoryLatestLink()
+	if exists, err := s.IsFile(snapshot); err != nil || !exists {
+		return fmt.Errorf("%v\nno update history snapshot to roll back to", updateErr)
+	}
+	snapshotProjects, snapshotTools, snapshotHooks, err := loadManifestFile(jirix, snapshot, nil)
+	if err != nil {
+		return fmt.Errorf("%v\nrollback failed: %v", updateErr, err)
+	}
+	currentProjects, err := LocalProjects(jirix, FullScan)
+	if err != nil {
+		return fmt.Errorf("%v\nrollback failed: %v", updateErr, err)
+	}
+	targetProjects := Projects{}
+	for key, project := range currentProjects {
+		targetProjects[key] = project
+	}
+	var created []ProjectKey
+	for _, op := range computeOperations(localProjects, remoteProjects, gc, opts.local) {
+		if op.Kind() == "null" {
+			continue
+		}
+		key := op.Project().Key()
+		if project, ok := snapshotProjects[key]; ok {
+			targetProjects[key] = project
+		} else if op.Kind() == "create" {
+			created = append(created, key)
+		}
+	}
+	s.Verbose(true).Output([]string{fmt.Sprintf("update failed, rolling back to %v", snapshot)})
+	// The projects that the update created can't hold any local work, but may
+	// lack the exclusion of their metadata, so remove them directly rather
+	// than with gc.
+	for _, key := range created {
+		project, ok := currentProjects[key]
+		if !ok {
+			continue
+		}
+		if err := s.Verbose(true).Output([]string{fmt.Sprintf("deleting project %q created by the update from %q", project.Name, project.Path)}).
+			RemoveAll(project.Path).Done(); err != nil {
+			return fmt.Errorf("%v\nrollback failed: %v", updateErr, err)
+		}
+		delete(currentProjects, key)
+		delete(targetProjects, key)
+	}
+	rollbackOpts := updateOpts{jobs: opts.jobs, local: opts.local, hookTimeout: opts.hookTimeout, parallelHooks: opts.parallelHooks}
+	if err := updateTo(jirix, currentProjects, targetProjects, snapshotTools, snapshotHooks, false, rollbackOpts); err != nil {
+		return fmt.Errorf("%v\nrollback failed: %v", updateErr, err)
+	}
+	return updateErr
+}
+
+// UpdatePlan describes the changes that UpdateUniverse would make.
+type UpdatePlan struct {
+	// Operations lists the project operations in the order they would run.
+	// Projects that are already up-to-date are omitted.
+	Operations []PlannedOperation `json:"operations"`
+	// Hooks lists the project hooks that would run after the operations,
+	// followed by the post-update hooks of the manifest.
+	Hooks []PlannedHook `json:"hooks"`
+	// Tools lists the names of the tools that would be rebuilt.
+	Tools []string `json:"tools"`
+}
+
+// PlannedOperation describes a single project operation of an UpdatePlan.
+type PlannedOperation struct {
+	Kind    string `json:"kind"`
+	Project string `json:"project"`
+	// OldProject is the former name of a renamed project.
+	OldProject  string `json:"old_project,omitempty"`
+	Remote      string `json:"remote"`
+	OldPath     string `json:"old_path,omitempty"`
+	NewPath     string `json:"new_path,omitempty"`
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision,omitempty"`
+}
+
+func (op PlannedOperation) String() string {
+	if op.OldProject != "" {
+		if op.Kind == "move" {
+			return fmt.Sprintf("move project %q located in %q to %q, rename it to %q and advance it from %q to %q", op.OldProject, op.OldPath, op.NewPath, op.Project, fmtRevision(op.OldRevision), fmtRevision(op.NewRevision))
+		}
+		return fmt.Sprintf("rename project %q located in %q to %q and advance it from %q to %q", op.OldProject, op.OldPath, op.Project, fmtRevision(op.OldRevision), fmtRevision(op.NewRevision))
+	}
+	switch op.Kind {
+	case "create":
+		return fmt.Sprintf("create project %q in %q at %q", op.Project, op.NewPath, fmtRevision(op.NewRevision))
+	case "delete":
+		return fmt.Sprintf("delete project %q from %q at %q", op.Project, op.OldPath, fmtRevision(op.OldRevision))
+	case "move":
+		return fmt.Sprintf("move project %q located in %q to %q and advance it from %q to %q", op.Project, op.OldPath, op.NewPath, fmtRevision(op.OldRevision), fmtRevision(op.NewRevision))
+	default:
+		return fmt.Sprintf("advance project %q located in %q from %q to %q", op.Project, op.OldPath, fmtRevision(op.OldRevision), fmtRevision(op.NewRevision))
+	}
+}
+
+// PlannedHook describes a single project hook of an UpdatePlan.
+type PlannedHook struct {
+	Project string `json:"project"`
+	Hook    string `json:"hook"`
+	// Kind is the kind of the project operation, which is passed to the hook.
+	Kind string `json:"kind"`
+}
+
+func (h PlannedHook) String() string {
+	return fmt.Sprintf("run hook %q for project %q with argument %q", h.Hook, h.Project, h.Kind)
+}
+
+// loadRemoteManifest loads the manifest without updating any local projects:
+// remote imports are cloned into a temporary directory rather than resolved
+// against the local manifest projects.
+func loadRemoteManifest(jirix *jiri.X) (_ Projects, _ Tools, _ Hooks, e error) {
+	ld, err := loadRemoteManifestWithLoader(jirix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ld.Projects, ld.Tools, ld.Hooks, nil
+}
+
+// loadRemoteManifestWithLoader is like loadRemoteManifest, but returns the
+// loader, which also records the projects of the remote imports.  Since the
+// temporary directory is removed, the paths of those projects are not valid.
+func loadRemoteManifestWithLoader(jirix *jiri.X) (_ *loader, e error) {
+	ld := newManifestLoader(Projects{}, true)
+	err := ld.Load(jirix, "", jirix.JiriManifestFile(), "")
+	if ld.TmpDir != "" {
+		defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(ld.TmpDir).Done() }, &e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ld, nil
+}
+
+// resolveHeadRevisions resolves the git projects at "HEAD" to the current
+// revision of their remote branch.
+func resolveHeadRevisions(jirix *jiri.X, projects Projects) error {
+	getRemoteHeadRevisions(jirix, projects)
+	for key, p := range projects {
+		if p.Revision != "HEAD" || p.Protocol != "git" {
+			continue
+		}
+		rev, err := gitutil.New(jirix.NewSeq()).RemoteBranchRevision(p.Remote, p.RemoteBranch)
+		if err != nil {
+			return err
+		}
+		p.Revision = rev
+		projects[key] = p
+	}
+	return nil
+}
+
+// PlanUpdateUniverse returns the plan that UpdateUniverse would carry out,
+// without changing any local projects or tools.  Unlike UpdateUniverse, the
+// remote manifests are cloned into a temporary directory rather than updated in
+// place, and projects at "HEAD" are resolved to the current revision of their
+// remote branch.  Only the GroupsOpt and LockedOpt options are used, and the
+// group selection is not recorded.
+func PlanUpdateUniverse(jirix *jiri.X, gc bool, opts ...UpdateOpt) (*UpdatePlan, error) {
+	jirix.TimerPush("plan update universe")
+	defer jirix.TimerPop()
+
+	scanMode := FastScan
+	if gc {
+		scanMode = FullScan
+	}
+	localProjects, err := LocalProjects(jirix, scanMode)
+	if err != nil {
+		return nil, err
+	}
+
+	uo := newUpdateOpts(opts)
+	var remoteProjects Projects
+	var remoteTools Tools
+	var remoteHooks Hooks
+	if uo.locked {
+		remoteProjects, remoteTools, remoteHooks, err = loadLockFile(jirix)
+	} else {
+		remoteProjects, remoteTools, remoteHooks, err = loadRemoteManifest(jirix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gs, err := loadGroupSelection(jirix, uo)
+	if err != nil {
+		return nil, err
+	}
+	localProjects, remoteProjects, remoteTools = selectGroups(gs, localProjects, remoteProjects, remoteTools)
+	if err := resolveHeadRevisions(jirix, remoteProjects); err != nil {
+		return nil, err
+	}
+	ops, err := planOperations(jirix, localProjects, remoteProjects, gc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &UpdatePlan{}
+	// Renamed projects are matched to their remote counterparts, as in
+	// computeOperations.
+	localProjects = matchRemoteChanges(localProjects, remoteProjects)
+	for _, op := range ops {
+		if op.Kind() == "null" {
+			continue
+		}
+		if del, ok := op.(deleteOperation); ok && !del.gc {
+			// Projects are only deleted with gc.
+			continue
+		}
+		project := op.Project()
+		planned := PlannedOperation{
+			Kind:    op.Kind(),
+			Project: project.Name,
+			Remote:  project.Remote,
+		}
+		if local, ok := localProjects[project.Key()]; ok {
+			planned.OldPath, planned.OldRevision = local.Path, local.Revision
+			if local.Name != project.Name {
+				planned.OldProject = local.Name
+			}
+		}
+		if op.Kind() != "delete" {
+			planned.NewPath, planned.NewRevision = project.Path, project.Revision
+		}
+		plan.Operations = append(plan.Operations, planned)
+		if hasHook(op) {
+			plan.Hooks = append(plan.Hooks, PlannedHook{
+				Project: project.Name,
+				Hook:    project.RunHook,
+				Kind:    op.Kind(),
+			})
+		}
+	}
+	for _, name := range remoteHooks.sortedNames() {
+		hook := remoteHooks[name]
+		// Hooks of projects that are not checked out are skipped.
+		if _, err := remoteProjects.FindUnique(hook.Project); err == nil {
+			plan.Hooks = append(plan.Hooks, PlannedHook{
+				Project: hook.Project,
+				Hook:    name,
+				Kind:    PostUpdateHookKind,
+			})
+		}
+	}
+	for _, tool := range remoteTools {
+		// Tools with no package specified are skipped by buildToolsFromMaster.
+		if tool.Package != "" {
+			plan.Tools = append(plan.Tools, tool.Name)
+		}
+	}
+	sort.Strings(plan.Tools)
+	return plan, nil
 }
 
 // WriteUpdateHistorySnapshot creates a snapshot of the current state of all
@@ -1034,47 +1911,35 @@ func ApplyToLocalMaster(jirix *jiri.X, projects Projects, fn func() error) (e er
 	defer collect.Error(func() error { return jirix.NewSeq().Chdir(cwd).Done() }, &e)
 
 	s := jirix.NewSeq()
-	git := gitutil.New(s)
 
 	// Loop through all projects, checking out master and stashing any unstaged
 	// changes.
 	for _, project := range projects {
-		p := project
-		if err := s.Chdir(p.Path).Done(); err != nil {
+		if err := s.Chdir(project.Path).Done(); err != nil {
 			return err
 		}
-		switch p.Protocol {
-		case "git":
-			branch, err := git.CurrentBranchName()
-			if err != nil {
-				return err
-			}
-			stashed, err := git.Stash()
-			if err != nil {
-				return err
-			}
-			if err := git.CheckoutBranch("master"); err != nil {
-				return err
-			}
-			// After running the function, return to this project's directory,
-			// checkout the original branch, and stash pop if necessary.
-			defer collect.Error(func() error {
-				if err := s.Chdir(p.Path).Done(); err != nil {
-					return err
-				}
-				if err := git.CheckoutBranch(branch); err != nil {
-					return err
-				}
-				if stashed {
-					return git.StashPop()
-				}
-				return nil
-			}, &e)
-		default:
-			return UnsupportedProtocolErr(p.Protocol)
+		restore, err := switchToLocalMaster(jirix, project)
+		if err != nil {
+			return err
 		}
+		// After running the function, checkout the original branch, and stash
+		// pop if necessary.
+		defer collect.Error(restore, &e)
+	}
+	return fn()
+}
+
+// switchToLocalMaster checks out the local master branch of the given project,
+// stashing any unstaged changes.  It returns a function that checks out the
+// original branch and pops the stash if necessary.  It doesn't depend on the
+// current working directory, so it can be used concurrently on different
+// projects.
+func switchToLocalMaster(jirix *jiri.X, project Project) (func() error, error) {
+	protocol, err := lookupProtocol(project.Protocol)
+	if err != nil {
+		return nil, err
 	}
-	return fn()
+	return protocol.SwitchToMaster(jirix, project)
 }
 
 // BuildTools builds the given tools and places the resulting binaries into the
@@ -1198,6 +2063,10 @@ func CleanupProjects(jirix *jiri.X, projects Projects, cleanupBranches bool) (e
 // resetLocalProject checks out the master branch, cleans up untracked files
 // and uncommitted changes, and optionally deletes all the other branches.
 func resetLocalProject(jirix *jiri.X, project Project, cleanupBranches bool) error {
+	if project.Protocol != "git" {
+		// Other protocols don't have branches or local changes.
+		return resetProjectCurrentBranch(jirix, project)
+	}
 	git := gitutil.New(jirix.NewSeq())
 	if err := jirix.NewSeq().Chdir(project.Path).Done(); err != nil {
 		return err
@@ -1280,6 +2149,15 @@ func findLocalProjects(jirix *jiri.X, path string, projects Projects) error {
 		if path != project.Path {
 			return fmt.Errorf("project %v has path %v but was found in %v", project.Name, project.Path, path)
 		}
+		protocol, err := lookupProtocol(project.Protocol)
+		if err != nil {
+			return err
+		}
+		if ok, err := protocol.IsLocalProject(jirix, project); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("project %v in %v has jiri metadata but no %v contents", project.Name, path, project.Protocol)
+		}
 		if p, ok := projects[project.Key()]; ok {
 			return fmt.Errorf("name conflict: both %v and %v contain project with key %v", p.Path, project.Path, project.Key())
 		}
@@ -1412,18 +2290,11 @@ func TransitionBinDir(jirix *jiri.X) error {
 
 // fetchProject fetches from the project remote.
 func fetchProject(jirix *jiri.X, project Project) error {
-	switch project.Protocol {
-	case "git":
-		if project.Remote == "" {
-			return fmt.Errorf("project %q does not have a remote", project.Name)
-		}
-		if err := gitutil.New(jirix.NewSeq()).SetRemoteUrl("origin", project.Remote); err != nil {
-			return err
-		}
-		return gitutil.New(jirix.NewSeq()).Fetch("origin")
-	default:
-		return UnsupportedProtocolErr(project.Protocol)
+	protocol, err := lookupProtocol(project.Protocol)
+	if err != nil {
+		return err
 	}
+	return protocol.Fetch(jirix, project)
 }
 
 // resetProjectCurrentBranch resets the current branch to the revision and
@@ -1432,28 +2303,53 @@ func resetProjectCurrentBranch(jirix *jiri.X, project Project) error {
 	if err := project.fillDefaults(); err != nil {
 		return err
 	}
-	switch project.Protocol {
-	case "git":
-		// Having a specific revision trumps everything else.
-		if project.Revision != "HEAD" {
-			return gitutil.New(jirix.NewSeq()).Reset(project.Revision)
-		}
-		// If no revision, reset to the configured remote branch.
-		return gitutil.New(jirix.NewSeq()).Reset("origin/" + project.RemoteBranch)
-	default:
-		return UnsupportedProtocolErr(project.Protocol)
+	protocol, err := lookupProtocol(project.Protocol)
+	if err != nil {
+		return err
+	}
+	return protocol.Reset(jirix, project)
+}
+
+// checkRevisionAvailable returns an error if resetting the project to the
+// revision and branch specified on the project would need to contact its
+// remote, since the revision hasn't been fetched yet.
+func checkRevisionAvailable(jirix *jiri.X, project Project) error {
+	if err := project.fillDefaults(); err != nil {
+		return err
+	}
+	protocol, err := lookupProtocol(project.Protocol)
+	if err != nil {
+		return err
 	}
+	available, err := protocol.IsRevisionAvailable(jirix, project)
+	if err != nil {
+		return err
+	}
+	if !available {
+		return fmt.Errorf("revision %q of project %q is not available locally, run \"jiri update\" without -local to fetch it", project.Revision, project.Name)
+	}
+	return nil
 }
 
 // syncProjectMaster fetches from the project remote and resets the local master
-// branch to the revision and branch specified on the project.
-func syncProjectMaster(jirix *jiri.X, project Project) error {
-	return ApplyToLocalMaster(jirix, Projects{project.Key(): project}, func() error {
-		if err := fetchProject(jirix, project); err != nil {
+// branch to the revision and branch specified on the project.  Unlike
+// ApplyToLocalMaster it doesn't change the current working directory, so it
+// can be run concurrently on different projects.  If local is true, nothing is
+// fetched, and the revision must already be available locally.
+func syncProjectMaster(jirix *jiri.X, project Project, local bool) (e error) {
+	restore, err := switchToLocalMaster(jirix, project)
+	if err != nil {
+		return err
+	}
+	defer collect.Error(restore, &e)
+	if local {
+		if err := checkRevisionAvailable(jirix, project); err != nil {
 			return err
 		}
-		return resetProjectCurrentBranch(jirix, project)
-	})
+	} else if err := fetchProject(jirix, project); err != nil {
+		return err
+	}
+	return resetProjectCurrentBranch(jirix, project)
 }
 
 // newManifestLoader returns a new manifest loader.  The localProjects are used
@@ -1466,20 +2362,80 @@ func syncProjectMaster(jirix *jiri.X, project Project) error {
 // directories, and added to localProjects.
 func newManifestLoader(localProjects Projects, update bool) *loader {
 	return &loader{
-		Projects:      make(Projects),
-		Tools:         make(Tools),
-		localProjects: localProjects,
-		update:        update,
+		Projects:       make(Projects),
+		Tools:          make(Tools),
+		Hooks:          make(Hooks),
+		localProjects:  localProjects,
+		update:         update,
+		provenance:     make(map[ProjectKey]Provenance),
+		toolProvenance: make(map[string]Provenance),
+		hookProvenance: make(map[string]Provenance),
+		importProjects: make(Projects),
 	}
 }
 
 type loader struct {
 	Projects      Projects
 	Tools         Tools
+	Hooks         Hooks
 	TmpDir        string
 	localProjects Projects
 	update        bool
-	cycleStack    []cycleInfo
+	// local determines whether the manifest projects are reset to the refs
+	// that were already fetched, failing if they are missing, rather than
+	// contacting their remotes.
+	local      bool
+	cycleStack []cycleInfo
+	// groups holds the groups of the remote imports of the manifest being
+	// loaded, which are added to the groups of its projects.
+	groups string
+	// defaults holds the hosts and defaults of the manifest being loaded,
+	// which are inherited by the manifests it imports.
+	defaults *manifestDefaults
+	// provenance, toolProvenance and hookProvenance record where the loaded
+	// projects, tools and hooks were defined.
+	provenance     map[ProjectKey]Provenance
+	toolProvenance map[string]Provenance
+	hookProvenance map[string]Provenance
+	// skipped records the elements that were skipped, since their condition
+	// doesn't hold.
+	skipped []SkippedElement
+	// importProjects records the projects of the remote imports that were
+	// loaded, at the revision of their remote branch.
+	importProjects Projects
+}
+
+// applyOverrides applies the overrides of the given manifest file to the
+// loaded projects.
+func (ld *loader) applyOverrides(jirix *jiri.X, file string, overrides []Override, lines []int) error {
+	for index, override := range overrides {
+		location := ld.newProvenance(jirix, file, lineAt(lines, index)).Location()
+		project, err := ld.Projects.FindUnique(override.Project)
+		if err != nil {
+			return fmt.Errorf("bad override at %v: %v", location, err)
+		}
+		prov := ld.provenance[project.Key()]
+		delete(ld.Projects, project.Key())
+		delete(ld.provenance, project.Key())
+		override.apply(&project, jirix.Root)
+		for _, attr := range []struct{ name, override, value string }{
+			{"path", override.Path, project.Path},
+			{"remote", override.Remote, project.Remote},
+			{"remotebranch", override.RemoteBranch, project.RemoteBranch},
+			{"revision", override.Revision, project.Revision},
+		} {
+			if attr.override != "" {
+				prov.setAttribute(attr.name, attr.value, "override at "+location)
+			}
+		}
+		key := project.Key()
+		if _, ok := ld.Projects[key]; ok {
+			return fmt.Errorf("bad override at %v: duplicate project %q", location, key)
+		}
+		ld.Projects[key] = project
+		ld.provenance[key] = prov
+	}
+	return nil
 }
 
 type cycleInfo struct {
@@ -1545,21 +2501,59 @@ func shortFileName(root, file string) string {
 func (ld *loader) Load(jirix *jiri.X, root, file, cycleKey string) error {
 	jirix.TimerPush("load " + shortFileName(jirix.Root, file))
 	defer jirix.TimerPop()
-	return ld.loadNoCycles(jirix, root, file, cycleKey)
+	top := len(ld.cycleStack) == 0
+	if err := ld.loadNoCycles(jirix, root, file, cycleKey); err != nil {
+		return err
+	}
+	if top {
+		ld.skipTools()
+		// Projects from different manifests may only conflict once all
+		// imports and overrides are resolved.
+		return ld.checkProjectPaths(jirix)
+	}
+	return nil
 }
 
 func (ld *loader) load(jirix *jiri.X, root, file string) error {
-	m, err := ManifestFromFile(jirix, file)
+	data, err := jirix.NewSeq().ReadFile(file)
 	if err != nil {
 		return err
 	}
+	m, defaults, err := manifestFromBytes(data, ld.defaults)
+	if errs, ok := err.(manifestErrors); ok {
+		return errs.inFile(shortFileName(jirix.Root, file))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", file, err)
+	}
+	// Keep the manifest as written, and the lines of its elements, to record
+	// the provenance of its projects and tools.
+	raw := new(Manifest)
+	if err := xml.Unmarshal(data, raw); err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", file, err)
+	}
+	lines, err := scanManifestLines(data)
+	if err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", file, err)
+	}
+	inherited := ld.defaults
+	ld.defaults = defaults
+	defer func() { ld.defaults = inherited }()
 	// Process remote imports.
-	for _, remote := range m.Imports {
+	for index, remote := range m.Imports {
+		if skip, err := ld.skip(jirix, file, lineAt(lines.imports, index), "import", remote.Manifest, remote.If); err != nil {
+			return err
+		} else if skip {
+			continue
+		}
 		nextRoot := filepath.Join(root, remote.Root)
 		remote.Name = filepath.Join(nextRoot, remote.Name)
 		key := remote.ProjectKey()
 		p, ok := ld.localProjects[key]
 		if !ok {
+			if ld.local {
+				return fmt.Errorf("can't resolve remote import of %q without contacting %q: project %q not found locally", remote.Manifest, remote.Remote, key)
+			}
 			if !ld.update {
 				return fmt.Errorf("can't resolve remote import: project %q not found locally", key)
 			}
@@ -1587,8 +2581,13 @@ func (ld *loader) load(jirix *jiri.X, root, file string) error {
 		// resetAndLoad.
 		p.Revision = "HEAD"
 		p.RemoteBranch = remote.RemoteBranch
+		ld.importProjects[key] = p
 		nextFile := filepath.Join(p.Path, remote.Manifest)
-		if err := ld.resetAndLoad(jirix, nextRoot, nextFile, remote.cycleKey(), p); err != nil {
+		groups := ld.groups
+		ld.groups = mergeGroups(groups, remote.Groups)
+		err = ld.resetAndLoad(jirix, nextRoot, nextFile, remote.cycleKey(), p)
+		ld.groups = groups
+		if err != nil {
 			return err
 		}
 	}
@@ -1602,26 +2601,81 @@ func (ld *loader) load(jirix *jiri.X, root, file string) error {
 		}
 	}
 	// Collect projects.
-	for _, project := range m.Projects {
+	for index, project := range m.Projects {
+		if skip, err := ld.skip(jirix, file, lineAt(lines.projects, index), "project", filepath.Join(root, project.Name), project.If); err != nil {
+			return err
+		} else if skip {
+			continue
+		}
+		project.If = ""
 		// Make paths absolute by prepending JIRI_ROOT/<root>.
 		project.absolutizePaths(filepath.Join(jirix.Root, root))
 		// Prepend the root to the project name.  This will be a noop if the import is not rooted.
 		project.Name = filepath.Join(root, project.Name)
+		if project.Formerly != "" {
+			project.Formerly = filepath.Join(root, project.Formerly)
+		}
+		if ld.groups != "" {
+			project.Groups = mergeGroups(project.Groups, ld.groups)
+		}
+		prov := ld.newProvenance(jirix, file, lineAt(lines.projects, index))
+		prov.Attributes = projectAttributes(raw.Projects[index], project, defaults, prov.Location())
 		key := project.Key()
-		if dup, ok := ld.Projects[key]; ok && dup != project {
-			// TODO(toddw): Tell the user the other conflicting file.
-			return fmt.Errorf("duplicate project %q found in %v", key, shortFileName(jirix.Root, file))
+		if dup, ok := ld.Projects[key]; ok {
+			dupProv := ld.provenance[key]
+			// The same project may be imported with different groups, in
+			// which case it belongs to all of them.
+			dupGroups := dup.Groups
+			dup.Groups = project.Groups
+			if !reflect.DeepEqual(dup, project) {
+				dup.Groups = dupGroups
+				return duplicateProjectError(jirix, key, dup, dupProv, project, prov)
+			}
+			project.Groups = mergeGroups(dupGroups, project.Groups)
+			if project.Groups != dupGroups {
+				dupProv.setAttribute("groups", project.Groups, fmt.Sprintf("definitions at %v and %v", dupProv.Location(), prov.Location()))
+			}
+			prov = dupProv
 		}
 		ld.Projects[key] = project
+		ld.provenance[key] = prov
 	}
 	// Collect tools.
-	for _, tool := range m.Tools {
+	for index, tool := range m.Tools {
 		name := tool.Name
-		if dup, ok := ld.Tools[name]; ok && dup != tool {
-			// TODO(toddw): Tell the user the other conflicting file.
-			return fmt.Errorf("duplicate tool %q found in %v", name, shortFileName(jirix.Root, file))
+		prov := ld.newProvenance(jirix, file, lineAt(lines.tools, index))
+		if dup, ok := ld.Tools[name]; ok {
+			if dup != tool {
+				return duplicateToolError(name, dup, ld.toolProvenance[name], tool, prov)
+			}
+			continue
 		}
 		ld.Tools[name] = tool
+		ld.toolProvenance[name] = prov
+	}
+	// Collect hooks.
+	for index, hook := range m.Hooks {
+		// Prepend the root to the project name, as for projects.
+		hook.Project = filepath.Join(root, hook.Project)
+		name := hook.Name
+		prov := ld.newProvenance(jirix, file, lineAt(lines.hooks, index))
+		if dup, ok := ld.Hooks[name]; ok {
+			if dup != hook {
+				return duplicateHookError(name, dup, ld.hookProvenance[name], hook, prov)
+			}
+			continue
+		}
+		ld.Hooks[name] = hook
+		ld.hookProvenance[name] = prov
+	}
+	// Apply overrides once all imports are resolved.
+	if len(m.Overrides) > 0 {
+		if len(ld.cycleStack) > 1 {
+			return fmt.Errorf("overrides are only allowed in %v, found in %v", shortFileName(jirix.Root, jirix.JiriManifestFile()), shortFileName(jirix.Root, file))
+		}
+		if err := ld.applyOverrides(jirix, file, m.Overrides, lines.overrides); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -1631,11 +2685,15 @@ func (ld *loader) resetAndLoad(jirix *jiri.X, root, file, cycleKey string, proje
 	pushd := jirix.NewSeq().Pushd(project.Path)
 	defer collect.Error(pushd.Done, &e)
 	// Reset the local master branch to what's specified on the project.  We only
-	// fetch on updates; non-updates just perform the reset.
-	//
-	// TODO(toddw): Support "jiri update -local=p1,p2" by simply calling ld.Load
-	// for the given projects, rather than ApplyToLocalMaster(fetch+reset+load).
+	// fetch on updates; non-updates just perform the reset.  Local updates
+	// reset to the refs that were already fetched, and never contact the
+	// remote.
 	return ApplyToLocalMaster(jirix, Projects{project.Key(): project}, func() error {
+		if ld.local {
+			if err := checkRevisionAvailable(jirix, project); err != nil {
+				return err
+			}
+		}
 		if ld.update {
 			if err := fetchProject(jirix, project); err != nil {
 				return err
@@ -1650,19 +2708,11 @@ func (ld *loader) resetAndLoad(jirix *jiri.X, root, file, cycleKey string, proje
 
 // reportNonMaster checks if the given project is on master branch and
 // if not, reports this fact along with information on how to update it.
-func reportNonMaster(jirix *jiri.X, project Project) (e error) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	defer collect.Error(func() error { return jirix.NewSeq().Chdir(cwd).Done() }, &e)
+func reportNonMaster(jirix *jiri.X, project Project) error {
 	s := jirix.NewSeq()
-	if err := s.Chdir(project.Path).Done(); err != nil {
-		return err
-	}
 	switch project.Protocol {
 	case "git":
-		current, err := gitutil.New(jirix.NewSeq()).CurrentBranchName()
+		current, err := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path)).CurrentBranchName()
 		if err != nil {
 			return err
 		}
@@ -1673,7 +2723,9 @@ func reportNonMaster(jirix *jiri.X, project Project) (e error) {
 		}
 		return nil
 	default:
-		return UnsupportedProtocolErr(project.Protocol)
+		// Other protocols don't have branches.
+		_, err := lookupProtocol(project.Protocol)
+		return err
 	}
 }
 
@@ -1737,60 +2789,187 @@ func getRemoteHeadRevisions(jirix *jiri.X, remoteProjects Projects) {
 	}
 }
 
-func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, gc bool) error {
+// updateProjects updates the local projects to match the remote projects, and
+// returns the outcome of the hooks of the updated projects.
+func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, gc bool, opts updateOpts) ([]hookResult, error) {
 	jirix.TimerPush("update projects")
 	defer jirix.TimerPop()
 
-	getRemoteHeadRevisions(jirix, remoteProjects)
-	ops := computeOperations(localProjects, remoteProjects, gc)
-	updates := newFsUpdates()
-	for _, op := range ops {
-		if err := op.Test(jirix, updates); err != nil {
-			return err
-		}
+	ops, err := planOperations(jirix, localProjects, remoteProjects, gc, opts.local)
+	if err != nil {
+		return nil, err
 	}
-	s := jirix.NewSeq()
-	for _, op := range ops {
-		updateFn := func() error { return op.Run(jirix) }
-		// Always log the output of updateFn, irrespective of
-		// the value of the verbose flag.
-		if err := s.Verbose(true).Call(updateFn, "%v", op).Done(); err != nil {
-			return fmt.Errorf("error updating project %q: %v", op.Project().Name, err)
+	for i, op := range ops {
+		if op, ok := op.(createOperation); ok {
+			op.depth, op.filter = opts.depth, opts.filter
+			ops[i] = op
 		}
 	}
-	if err := runHooks(jirix, ops); err != nil {
-		return err
+	if err := runOperations(jirix, ops, opts.jobs); err != nil {
+		return nil, err
+	}
+	if err := rebaseBranches(jirix, ops, opts.rebase); err != nil {
+		return nil, err
+	}
+	// Failing hooks don't stop the update, and are reported once the
+	// post-update hooks have run too.
+	hookResults := runHooks(jirix, ops, opts)
+	if err := applyGitHooks(jirix, ops); err != nil {
+		return nil, err
+	}
+	if err := excludeNestedProjects(jirix, ops); err != nil {
+		return nil, err
 	}
-	return applyGitHooks(jirix, ops)
+	return hookResults, nil
 }
 
-// runHooks runs all hooks for the given operations.
-func runHooks(jirix *jiri.X, ops []operation) error {
-	jirix.TimerPush("run hooks")
-	defer jirix.TimerPop()
+// planOperations computes the operations that update the local projects to
+// match the remote projects, and checks that none of them would fail.  If local
+// is true, the remotes are never contacted, and projects at "HEAD" are reset
+// to the latest fetched revision of their remote branch.
+func planOperations(jirix *jiri.X, localProjects, remoteProjects Projects, gc, local bool) (operations, error) {
+	if !local {
+		getRemoteHeadRevisions(jirix, remoteProjects)
+	}
+	ops := computeOperations(localProjects, remoteProjects, gc, local)
+	updates := newFsUpdates()
 	for _, op := range ops {
-		if op.Project().RunHook == "" {
-			continue
+		if err := op.Test(jirix, updates); err != nil {
+			return nil, err
 		}
-		if op.Kind() != "create" && op.Kind() != "move" && op.Kind() != "update" {
-			continue
+	}
+	return ops, nil
+}
+
+// runOperation runs a single operation, logging it irrespective of the value
+// of the verbose flag.
+func runOperation(jirix *jiri.X, op operation) error {
+	updateFn := func() error { return op.Run(jirix) }
+	if err := jirix.NewSeq().Verbose(true).Call(updateFn, "%v", op).Done(); err != nil {
+		return fmt.Errorf("error updating project %q: %v", op.Project().Name, err)
+	}
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent writes.  It is
+// used as both the stdout and stderr of a goroutine, since the output of a
+// command and the messages of the runutil executor are written concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Bytes returns the contents of the buffer.
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// runOperations runs the given operations, which must be sorted, with at most
+// jobs operations running at the same time.
+//
+// An operation waits for every earlier operation whose paths overlap with its
+// own, which preserves the ordering required by operations.Less: deletions and
+// moves happen before creations in the same directory, and outer directories
+// are created before nested ones.  If an operation fails, the operations that
+// wait for it are skipped, but all independent operations still run, and every
+// failure is reported in the returned error.
+//
+// The output of each operation is buffered and written out when it completes,
+// so that the output of concurrent operations isn't interleaved.
+func runOperations(jirix *jiri.X, ops operations, jobs int) error {
+	if jobs < 2 {
+		for _, op := range ops {
+			if err := runOperation(jirix, op); err != nil {
+				return err
+			}
 		}
-		s := jirix.NewSeq()
-		s.Verbose(true).Output([]string{fmt.Sprintf("running hook for project %q", op.Project().Name)})
-		if err := s.Dir(op.Project().Path).Capture(os.Stdout, os.Stderr).Last(op.Project().RunHook, op.Kind()); err != nil {
-			// TODO(nlacasse): Should we delete projectDir or perform some
-			// other cleanup in the event of a hook failure?
-			return fmt.Errorf("error running hook for project %q: %v", op.Project().Name, err)
+		return nil
+	}
+	var mu sync.Mutex
+	sem := make(chan struct{}, jobs)
+	done := make([]chan struct{}, len(ops))
+	errs := make([]error, len(ops))
+	for i := range ops {
+		done[i] = make(chan struct{})
+	}
+	for i, op := range ops {
+		var deps []int
+		for j := 0; j < i; j++ {
+			if operationsOverlap(ops[j], op) {
+				deps = append(deps, j)
+			}
 		}
+		go func(i int, op operation, deps []int) {
+			defer close(done[i])
+			for _, j := range deps {
+				<-done[j]
+				if errs[j] != nil {
+					errs[i] = fmt.Errorf("skipped updating project %q since updating project %q failed", op.Project().Name, ops[j].Project().Name)
+					return
+				}
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// jirix is not threadsafe, so we make a clone for each goroutine.
+			var out syncBuffer
+			errs[i] = runOperation(jirix.Clone(tool.ContextOpts{Stdout: &out, Stderr: &out}), op)
+			mu.Lock()
+			jirix.Stdout().Write(out.Bytes())
+			mu.Unlock()
+		}(i, op, deps)
+	}
+	var failures []string
+	for i := range ops {
+		<-done[i]
+		if errs[i] != nil {
+			failures = append(failures, errs[i].Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d project operations failed:\n%v", len(failures), len(ops), strings.Join(failures, "\n"))
 	}
 	return nil
 }
 
+// operationsOverlap returns true if any path touched by op1 is the same as, or
+// nested within, or contains any path touched by op2.
+func operationsOverlap(op1, op2 operation) bool {
+	for _, p1 := range op1.paths() {
+		for _, p2 := range op2.paths() {
+			if pathsOverlap(p1, p2) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathsOverlap returns true if the paths are the same, or if one of them is
+// nested within the other.
+func pathsOverlap(p1, p2 string) bool {
+	p1, p2 = filepath.Clean(p1), filepath.Clean(p2)
+	if len(p1) > len(p2) {
+		p1, p2 = p2, p1
+	}
+	return p1 == p2 || strings.HasPrefix(p2, p1+string(filepath.Separator))
+}
+
 func applyGitHooks(jirix *jiri.X, ops []operation) error {
 	jirix.TimerPush("apply githooks")
 	defer jirix.TimerPop()
 	s := jirix.NewSeq()
 	for _, op := range ops {
+		if op.Project().Protocol != "git" {
+			continue
+		}
 		if op.Kind() == "create" || op.Kind() == "move" {
 			// Apply exclusion for /.jiri/. Ideally we'd only write this file on
 			// create, but the remote manifest import is move from the temp directory
@@ -1842,38 +3021,108 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 	return nil
 }
 
-// writeMetadata stores the given project metadata in the directory
-// identified by the given path.
-func writeMetadata(jirix *jiri.X, project Project, dir string) (e error) {
-	metadataDir := filepath.Join(dir, jiri.ProjectMetaDir)
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
+// excludeNestedProjects adds the path of each nested project to the
+// .git/info/exclude file of every git project that contains it, so that the
+// nested project doesn't show up as untracked content of the enclosing
+// project.  This is done on every update, since creating or moving the
+// enclosing project resets its exclude file.
+func excludeNestedProjects(jirix *jiri.X, ops []operation) error {
+	for _, inner := range ops {
+		if inner.Kind() == "delete" || !inner.Project().Nested {
+			continue
+		}
+		innerPath := filepath.Clean(inner.Project().Path)
+		for _, outer := range ops {
+			if outer.Kind() == "delete" || outer.Project().Protocol != "git" {
+				continue
+			}
+			outerPath := filepath.Clean(outer.Project().Path)
+			if outerPath == innerPath || !pathsOverlap(outerPath, innerPath) || len(outerPath) > len(innerPath) {
+				continue
+			}
+			relPath, err := filepath.Rel(outerPath, innerPath)
+			if err != nil {
+				return err
+			}
+			if err := addExcludePattern(jirix, outerPath, "/"+filepath.ToSlash(relPath)+"/"); err != nil {
+				return err
+			}
+		}
 	}
-	defer collect.Error(func() error { return jirix.NewSeq().Chdir(cwd).Done() }, &e)
+	return nil
+}
 
+// addExcludePattern adds the given pattern to the .git/info/exclude file of
+// the git project in dir, unless it is already there.
+func addExcludePattern(jirix *jiri.X, dir, pattern string) error {
 	s := jirix.NewSeq()
-	if err := s.MkdirAll(metadataDir, os.FileMode(0755)).
-		Chdir(metadataDir).Done(); err != nil {
+	excludeFile := filepath.Join(dir, ".git", "info", "exclude")
+	data, err := s.ReadFile(excludeFile)
+	if err != nil && !runutil.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == pattern {
+			return nil
+		}
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, newlineBytes) {
+		data = append(data, '\n')
+	}
+	data = append(data, pattern+"\n"...)
+	return s.MkdirAll(filepath.Dir(excludeFile), 0755).WriteFile(excludeFile, data, 0644).Done()
+}
+
+// writeMetadata stores the given project metadata in the directory
+// identified by the given path.
+func writeMetadata(jirix *jiri.X, project Project, dir string) error {
+	metadataDir := filepath.Join(dir, jiri.ProjectMetaDir)
+	if err := jirix.NewSeq().MkdirAll(metadataDir, os.FileMode(0755)).Done(); err != nil {
 		return err
 	}
 	metadataFile := filepath.Join(metadataDir, jiri.ProjectMetaFile)
 	return project.ToFile(jirix, metadataFile)
 }
 
-// fsUpdates is used to track filesystem updates made by operations.
-// TODO(nlacasse): Currently we only use fsUpdates to track deletions so that
-// jiri can delete and create a project in the same directory in one update.
-// There are lots of other cases that should be covered though, like detecting
-// when two projects would be created in the same directory.
+// fsUpdates is used to track filesystem updates made by operations.  It tracks
+// deletions so that jiri can delete and create a project in the same directory
+// in one update, and the resulting location of each project, so that two
+// projects are never put in the same directory, and a project is only put in
+// the working tree of another project if it is explicitly allowed to be
+// nested.
 type fsUpdates struct {
 	deletedDirs map[string]bool
+	projectDirs map[string]Project
 }
 
 func newFsUpdates() *fsUpdates {
 	return &fsUpdates{
 		deletedDirs: map[string]bool{},
+		projectDirs: map[string]Project{},
+	}
+}
+
+// addProject records that the given project ends up in dir, and returns an
+// error if it conflicts with the location of another project.
+func (u *fsUpdates) addProject(project Project, dir string) error {
+	dir = filepath.Clean(dir)
+	if other, ok := u.projectDirs[dir]; ok {
+		return fmt.Errorf("cannot put project %q in %q as project %q is also put there", project.Name, dir, other.Name)
+	}
+	for otherDir, other := range u.projectDirs {
+		if !pathsOverlap(dir, otherDir) {
+			continue
+		}
+		inner, innerDir, outer, outerDir := project, dir, other, otherDir
+		if len(innerDir) < len(outerDir) {
+			inner, innerDir, outer, outerDir = other, otherDir, project, dir
+		}
+		if !inner.Nested {
+			return fmt.Errorf("cannot put project %q in %q as it is nested in project %q in %q; set nested=\"true\" on project %q to allow it", inner.Name, innerDir, outer.Name, outerDir, inner.Name)
+		}
 	}
+	u.projectDirs[dir] = project
+	return nil
 }
 
 func (u *fsUpdates) deleteDir(dir string) {
@@ -1897,6 +3146,8 @@ type operation interface {
 	String() string
 	// Test checks whether the operation would fail.
 	Test(jirix *jiri.X, updates *fsUpdates) error
+	// paths returns the local filesystem paths touched by the operation.
+	paths() []string
 }
 
 // commonOperation represents a project operation.
@@ -1909,15 +3160,40 @@ type commonOperation struct {
 	destination string
 	// source is the current project path.
 	source string
+	// formerName is the current project name, if the operation renames the
+	// project.
+	formerName string
+	// local determines whether the operation only uses the revisions that
+	// were already fetched, rather than contacting the project remote.
+	local bool
+	// previous is the local project before the operation, if any.  The git
+	// configuration and remotes that it declares and project doesn't are
+	// removed.
+	previous *Project
 }
 
 func (op commonOperation) Project() Project {
 	return op.project
 }
 
+func (op commonOperation) paths() []string {
+	var paths []string
+	for _, path := range []string{op.source, op.destination} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
 // createOperation represents the creation of a project.
 type createOperation struct {
 	commonOperation
+	// depth and filter are the defaults for cloning git projects that don't
+	// specify them.  They only affect the clone, and aren't recorded in the
+	// project metadata.
+	depth  int
+	filter string
 }
 
 func (op createOperation) Kind() string {
@@ -1938,30 +3214,38 @@ func (op createOperation) Run(jirix *jiri.X) (e error) {
 		return err
 	}
 	defer collect.Error(func() error { return jirix.NewSeq().RemoveAll(tmpDir).Done() }, &e)
-	switch op.project.Protocol {
-	case "git":
-		if err := gitutil.New(jirix.NewSeq()).Clone(op.project.Remote, tmpDir); err != nil {
-			return err
+	protocol, err := lookupProtocol(op.project.Protocol)
+	if err != nil {
+		return err
+	}
+	cloneProject := op.project
+	if cloneProject.Protocol == "git" {
+		if cloneProject.Depth == 0 {
+			cloneProject.Depth = op.depth
 		}
-		cwd, err := os.Getwd()
-		if err != nil {
+		if cloneProject.Filter == "" {
+			cloneProject.Filter = op.filter
+		}
+	}
+	// Hold the lock of the mirror the project borrows objects from until
+	// the project is in place, so that "jiri cache gc" finds the project
+	// before it can remove the mirror.
+	if err := withMirrorLock(jirix, op.project, func() error {
+		if err := protocol.Clone(jirix, cloneProject, tmpDir); err != nil {
 			return err
 		}
-		defer collect.Error(func() error { return jirix.NewSeq().Chdir(cwd).Done() }, &e)
-		if err := s.Chdir(tmpDir).Done(); err != nil {
+		if err := writeMetadata(jirix, op.project, tmpDir); err != nil {
 			return err
 		}
-	default:
-		return UnsupportedProtocolErr(op.project.Protocol)
-	}
-	if err := writeMetadata(jirix, op.project, tmpDir); err != nil {
+		return s.Chmod(tmpDir, os.FileMode(0755)).
+			Rename(tmpDir, op.destination).Done()
+	}); err != nil {
 		return err
 	}
-	if err := s.Chmod(tmpDir, os.FileMode(0755)).
-		Rename(tmpDir, op.destination).Done(); err != nil {
+	if err := applyGitConfig(jirix, nil, op.project); err != nil {
 		return err
 	}
-	return syncProjectMaster(jirix, op.project)
+	return syncProjectMaster(jirix, op.project, op.local)
 }
 
 func (op createOperation) String() string {
@@ -1977,7 +3261,10 @@ func (op createOperation) Test(jirix *jiri.X, updates *fsUpdates) error {
 	} else if !updates.isDeleted(op.destination) {
 		return fmt.Errorf("cannot create %q as it already exists", op.destination)
 	}
-	return nil
+	if op.local {
+		return fmt.Errorf("cannot create project %q in %q without contacting %q, run \"jiri update\" without -local to create it", op.project.Name, op.destination, op.project.Remote)
+	}
+	return updates.addProject(op.project, op.destination)
 }
 
 // deleteOperation represents the deletion of a project.
@@ -1996,20 +3283,15 @@ func (op deleteOperation) Run(jirix *jiri.X) error {
 	if op.gc {
 		// Never delete projects with non-master branches, uncommitted
 		// work, or untracked content.
-		git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(op.project.Path))
-		branches, _, err := git.GetBranches()
+		protocol, err := lookupProtocol(op.project.Protocol)
 		if err != nil {
 			return err
 		}
-		uncommitted, err := git.HasUncommittedChanges()
+		changed, err := protocol.HasLocalChanges(jirix, op.project)
 		if err != nil {
 			return err
 		}
-		untracked, err := git.HasUntrackedFiles()
-		if err != nil {
-			return err
-		}
-		if len(branches) != 1 || uncommitted || untracked {
+		if changed {
 			lines := []string{
 				fmt.Sprintf("NOTE: project %v was not found in the project manifest", op.project.Name),
 				"however this project either contains non-master branches, uncommitted",
@@ -2059,16 +3341,33 @@ func (op moveOperation) Run(jirix *jiri.X) error {
 	if err := s.MkdirAll(path, perm).Rename(op.source, op.destination).Done(); err != nil {
 		return err
 	}
+	// Write the metadata right away, so that it matches the new path and name
+	// of the project even if the sync fails.  It keeps the previous revision
+	// until the sync succeeds, since the archive protocol reads the current
+	// revision from the metadata.
+	moved := op.project
+	if op.previous != nil {
+		moved.Revision = op.previous.Revision
+	}
+	if err := writeMetadata(jirix, moved, moved.Path); err != nil {
+		return err
+	}
+	if err := applyGitConfig(jirix, op.previous, op.project); err != nil {
+		return err
+	}
 	if err := reportNonMaster(jirix, op.project); err != nil {
 		return err
 	}
-	if err := syncProjectMaster(jirix, op.project); err != nil {
+	if err := syncProjectMaster(jirix, op.project, op.local); err != nil {
 		return err
 	}
 	return writeMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op moveOperation) String() string {
+	if op.formerName != "" {
+		return fmt.Sprintf("move project %q located in %q to %q, rename it to %q and advance it to %q", op.formerName, op.source, op.destination, op.project.Name, fmtRevision(op.project.Revision))
+	}
 	return fmt.Sprintf("move project %q located in %q to %q and advance it to %q", op.project.Name, op.source, op.destination, fmtRevision(op.project.Revision))
 }
 
@@ -2087,8 +3386,15 @@ func (op moveOperation) Test(jirix *jiri.X, updates *fsUpdates) error {
 	} else {
 		return fmt.Errorf("cannot move %q to %q as the destination already exists", op.source, op.destination)
 	}
+	if op.local {
+		project := op.project
+		project.Path = op.source
+		if err := checkRevisionAvailable(jirix, project); err != nil {
+			return err
+		}
+	}
 	updates.deleteDir(op.source)
-	return nil
+	return updates.addProject(op.project, op.destination)
 }
 
 // updateOperation represents the update of a project.
@@ -2100,21 +3406,32 @@ func (op updateOperation) Kind() string {
 	return "update"
 }
 func (op updateOperation) Run(jirix *jiri.X) error {
+	if err := applyGitConfig(jirix, op.previous, op.project); err != nil {
+		return err
+	}
 	if err := reportNonMaster(jirix, op.project); err != nil {
 		return err
 	}
-	if err := syncProjectMaster(jirix, op.project); err != nil {
+	if err := syncProjectMaster(jirix, op.project, op.local); err != nil {
 		return err
 	}
 	return writeMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op updateOperation) String() string {
+	if op.formerName != "" {
+		return fmt.Sprintf("rename project %q located in %q to %q and advance it to %q", op.formerName, op.source, op.project.Name, fmtRevision(op.project.Revision))
+	}
 	return fmt.Sprintf("advance project %q located in %q to %q", op.project.Name, op.source, fmtRevision(op.project.Revision))
 }
 
-func (op updateOperation) Test(jirix *jiri.X, _ *fsUpdates) error {
-	return nil
+func (op updateOperation) Test(jirix *jiri.X, updates *fsUpdates) error {
+	if op.local {
+		if err := checkRevisionAvailable(jirix, op.project); err != nil {
+			return err
+		}
+	}
+	return updates.addProject(op.project, op.destination)
 }
 
 // nullOperation represents a noop.  It is used for logging and adding project
@@ -2128,6 +3445,9 @@ func (op nullOperation) Kind() string {
 }
 
 func (op nullOperation) Run(jirix *jiri.X) error {
+	if err := applyGitConfig(jirix, op.previous, op.project); err != nil {
+		return err
+	}
 	return writeMetadata(jirix, op.project, op.project.Path)
 }
 
@@ -2135,8 +3455,8 @@ func (op nullOperation) String() string {
 	return fmt.Sprintf("project %q located in %q at revision %q is up-to-date", op.project.Name, op.source, fmtRevision(op.project.Revision))
 }
 
-func (op nullOperation) Test(jirix *jiri.X, _ *fsUpdates) error {
-	return nil
+func (op nullOperation) Test(jirix *jiri.X, updates *fsUpdates) error {
+	return updates.addProject(op.project, op.destination)
 }
 
 // operations is a sortable collection of operations
@@ -2187,12 +3507,14 @@ func (ops operations) Swap(i, j int) {
 // current and new projects (as defined by contents of the local file
 // system and manifest file respectively) and outputs a collection of
 // operations that describe the actions needed to update the target
-// projects.
-func computeOperations(localProjects, remoteProjects Projects, gc bool) operations {
+// projects.  If localOnly is true, the operations never contact the project
+// remotes.
+func computeOperations(localProjects, remoteProjects Projects, gc, localOnly bool) operations {
 	result := operations{}
+	localProjects = matchRemoteChanges(localProjects, remoteProjects)
 	allProjects := map[ProjectKey]bool{}
-	for _, p := range localProjects {
-		allProjects[p.Key()] = true
+	for key := range localProjects {
+		allProjects[key] = true
 	}
 	for _, p := range remoteProjects {
 		allProjects[p.Key()] = true
@@ -2205,27 +3527,99 @@ func computeOperations(localProjects, remoteProjects Projects, gc bool) operatio
 		if project, ok := remoteProjects[key]; ok {
 			remote = &project
 		}
-		result = append(result, computeOp(local, remote, gc))
+		result = append(result, computeOp(local, remote, gc, localOnly))
 	}
 	sort.Sort(result)
 	return result
 }
 
-func computeOp(local, remote *Project, gc bool) operation {
+// matchRemoteChanges returns the local projects, with each local project that
+// isn't in the remote projects rekeyed to match a remote project that isn't in
+// the local projects, if any, so that it is updated in place or moved rather
+// than deleted.  A local project matches the remote project with the same name
+// and path, which has a new key because its remote changed, for example
+// because of an override.  Otherwise, it matches the remote project that
+// declares the local name as Formerly, or the local path as FormerPath, which
+// renames the local project.
+func matchRemoteChanges(localProjects, remoteProjects Projects) Projects {
+	type namePath struct{ name, path string }
+	unmatched := map[namePath]ProjectKey{}
+	formerNames := map[string]ProjectKey{}
+	formerPaths := map[string]ProjectKey{}
+	// Visit the projects in order, so that the result doesn't depend on the
+	// order of map iteration if several projects match.
+	for _, key := range sortedKeys(remoteProjects) {
+		p := remoteProjects[key]
+		if _, ok := localProjects[key]; ok {
+			continue
+		}
+		unmatched[namePath{p.Name, p.Path}] = key
+		if _, ok := formerNames[p.Formerly]; p.Formerly != "" && !ok {
+			formerNames[p.Formerly] = key
+		}
+		if _, ok := formerPaths[p.FormerPath]; p.FormerPath != "" && !ok {
+			formerPaths[p.FormerPath] = key
+		}
+	}
+	claimed := map[ProjectKey]bool{}
+	matched := Projects{}
+	for _, key := range sortedKeys(localProjects) {
+		p := localProjects[key]
+		if _, ok := remoteProjects[key]; !ok {
+			var candidates []ProjectKey
+			if remoteKey, ok := unmatched[namePath{p.Name, p.Path}]; ok {
+				candidates = append(candidates, remoteKey)
+			}
+			if remoteKey, ok := formerNames[p.Name]; ok {
+				candidates = append(candidates, remoteKey)
+			}
+			if remoteKey, ok := formerPaths[p.Path]; ok {
+				candidates = append(candidates, remoteKey)
+			}
+			for _, remoteKey := range candidates {
+				if !claimed[remoteKey] {
+					claimed[remoteKey] = true
+					key = remoteKey
+					break
+				}
+			}
+		}
+		matched[key] = p
+	}
+	return matched
+}
+
+// sortedKeys returns the keys of the given projects in order.
+func sortedKeys(projects Projects) ProjectKeys {
+	var keys ProjectKeys
+	for key := range projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	return keys
+}
+
+func computeOp(local, remote *Project, gc, localOnly bool) operation {
 	switch {
 	case local == nil && remote != nil:
-		return createOperation{commonOperation{
+		return createOperation{commonOperation: commonOperation{
 			destination: remote.Path,
 			project:     *remote,
 			source:      "",
+			local:       localOnly,
 		}}
 	case local != nil && remote == nil:
 		return deleteOperation{commonOperation{
 			destination: "",
 			project:     *local,
 			source:      local.Path,
+			local:       localOnly,
 		}, gc}
 	case local != nil && remote != nil:
+		var formerName string
+		if local.Name != remote.Name {
+			formerName = local.Name
+		}
 		switch {
 		case local.Path != remote.Path:
 			// moveOperation also does an update, so we don't need to check the
@@ -2234,18 +3628,26 @@ func computeOp(local, remote *Project, gc bool) operation {
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
+				formerName:  formerName,
+				local:       localOnly,
+				previous:    local,
 			}}
-		case local.Revision != remote.Revision:
+		case local.Revision != remote.Revision, local.Remote != remote.Remote, formerName != "":
 			return updateOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
+				formerName:  formerName,
+				local:       localOnly,
+				previous:    local,
 			}}
 		default:
 			return nullOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
+				local:       localOnly,
+				previous:    local,
 			}}
 		}
 	default:
@@ -5,20 +5,29 @@
 package project_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"v.io/jiri"
 	"v.io/jiri/gitutil"
 	"v.io/jiri/jiritest"
 	"v.io/jiri/project"
+	"v.io/jiri/tool"
 )
 
 func checkReadme(t *testing.T, jirix *jiri.X, p project.Project, message string) {
@@ -345,124 +354,1374 @@ func TestUpdateUniverseMovedProject(t *testing.T) {
 	checkReadme(t, fake.X, localProjects[1], "initial readme")
 }
 
+// TestUpdateUniverseRenamedProject checks that UpdateUniverse renames projects
+// that declare their former name or path, keeping their local branches and
+// state, even with gc=true.
+func TestUpdateUniverseRenamedProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(jiri.ProjectMetaDir, "feature", ".dependency_path")
+	for _, p := range localProjects[1:] {
+		if err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(p.Path)).CreateBranch("feature"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.X.NewSeq().MkdirAll(filepath.Dir(filepath.Join(p.Path, state)), 0755).WriteFile(filepath.Join(p.Path, state), []byte("master\n"), 0644).Done(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rename project 1 in place, and move and rename project 2.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := []project.Project{localProjects[1], localProjects[2]}
+	renamed[0].Name, renamed[0].Formerly = "renamed-1", localProjects[1].Name
+	renamed[1].Name, renamed[1].Path, renamed[1].FormerPath = "renamed-2", filepath.Join(fake.X.Root, "renamed-path"), localProjects[2].Path
+	for i, p := range m.Projects {
+		switch p.Name {
+		case localProjects[1].Name:
+			m.Projects[i].Name, m.Projects[i].Formerly = renamed[0].Name, renamed[0].Formerly
+		case localProjects[2].Name:
+			m.Projects[i].Name, m.Projects[i].Path, m.Projects[i].FormerPath = renamed[1].Name, renamed[1].Path, renamed[1].FormerPath
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := project.PlanUpdateUniverse(fake.X, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, op := range plan.Operations {
+		if op.OldProject != "" {
+			got = append(got, fmt.Sprintf("%s %s->%s", op.Kind, op.OldProject, op.Project))
+		}
+	}
+	sort.Strings(got)
+	want := []string{"move " + localProjects[2].Name + "->renamed-2", "update " + localProjects[1].Name + "->renamed-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got plan %v, want %v", got, want)
+	}
+
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(localProjects[2].Path); !os.IsNotExist(err) {
+		t.Errorf("project %q was not moved from %q", localProjects[2].Name, localProjects[2].Path)
+	}
+	for _, p := range renamed {
+		checkReadme(t, fake.X, p, "initial readme")
+		branches, _, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(p.Path)).GetBranches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"feature", "master"}; !reflect.DeepEqual(branches, want) {
+			t.Errorf("project %q: got branches %v, want %v", p.Name, branches, want)
+		}
+		if _, err := os.Stat(filepath.Join(p.Path, state)); err != nil {
+			t.Errorf("project %q lost its state: %v", p.Name, err)
+		}
+		local, err := project.ProjectAtPath(fake.X, p.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.Name != p.Name || local.Path != p.Path {
+			t.Errorf("got metadata name %q and path %q, want %q and %q", local.Name, local.Path, p.Name, p.Path)
+		}
+	}
+	projects, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProjectsMatchPaths(t, projects, []string{localProjects[0].Path, renamed[0].Path, renamed[1].Path, filepath.Join(fake.X.Root, "manifest")})
+}
+
 // TestUpdateUniverseDeletedProject checks that UpdateUniverse will delete a
 // project iff gc=true.
 func TestUpdateUniverseDeletedProject(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	s := fake.X.NewSeq()
+	s := fake.X.NewSeq()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete project 1.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			continue
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse() with gc=false does not delete the local copy
+	// of the project.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssertDirExists(localProjects[1].Path).Done(); err != nil {
+		t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[1].Name, localProjects[1].Path)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+	// Check that UpdateUniverse() with gc=true does delete the local copy of
+	// the project.
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssertDirExists(localProjects[1].Path).Done(); err == nil {
+		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, localProjects[3].Path)
+	}
+}
+
+// TestUpdateUniverseNewProjectSamePath checks that UpdateUniverse can handle a
+// new project with the same path as a deleted project, but a different path.
+func TestUpdateUniverseNewProjectSamePath(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete a project 1 and create a new one with a different name but the
+	// same path.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProjectName := "new-project-name"
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Path == localProjects[1].Path {
+			p.Name = newProjectName
+		}
+		projects = append(projects, p)
+	}
+	localProjects[1].Name = newProjectName
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse() does not fail.
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdateUniverseRemoteBranch checks that UpdateUniverse can pull from a
+// non-master remote branch.
+func TestUpdateUniverseRemoteBranch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	s := fake.X.NewSeq()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit to master branch of a project 1.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
+	// Create and checkout a new branch of project 1 and make a new commit.
+	git := gitutil.New(s, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	if err := git.CreateAndCheckoutBranch("non-master"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
+	// Point the manifest to the new non-master branch.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.RemoteBranch = "non-master"
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Check that UpdateUniverse pulls the commit from the non-master branch.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[1], "non-master commit")
+}
+
+// TestUpdateUniverseParallel checks that UpdateUniverse can create projects
+// concurrently, including projects nested within other new projects.
+func TestUpdateUniverseParallel(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	// Add a project nested within project 0, and one nested within that.
+	for _, path := range []string{"nested", filepath.Join("nested", "deeper")} {
+		name := strings.Replace(path, string(filepath.Separator), "-", -1)
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, fake.Projects[name], "initial readme")
+		p := project.Project{
+			Name:   name,
+			Path:   filepath.Join(localProjects[0].Path, path),
+			Remote: fake.Projects[name],
+			Nested: true,
+		}
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+		localProjects = append(localProjects, p)
+	}
+	if err := project.UpdateUniverse(fake.X, false, project.JobsOpt(4)); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+}
+
+// TestUpdateUniverseParallelFailure checks that a failure to update one
+// project doesn't prevent the other projects from being updated, and that the
+// failure is reported.
+func TestUpdateUniverseParallelFailure(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	bad := project.Project{
+		Name:   "bad-project",
+		Path:   filepath.Join(fake.X.Root, "bad-project"),
+		Remote: filepath.Join(fake.X.Root, "does-not-exist"),
+	}
+	if err := fake.AddProject(bad); err != nil {
+		t.Fatal(err)
+	}
+	err := project.UpdateUniverse(fake.X, false, project.JobsOpt(4))
+	if got, want := fmt.Sprint(err), `error updating project "bad-project"`; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+}
+
+// TestUpdateUniverseRollback checks that a failed update with RollbackOpt
+// returns the projects it touched to the latest update history snapshot.
+func TestUpdateUniverseRollback(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.WriteUpdateHistorySnapshot(fake.X, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advance project 1 remotely, add a new project, and add a project that
+	// can't be created.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new revision")
+	if err := fake.CreateRemoteProject("new-project"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["new-project"], "initial readme")
+	created := project.Project{
+		Name:   "new-project",
+		Path:   filepath.Join(fake.X.Root, "new-project"),
+		Remote: fake.Projects["new-project"],
+	}
+	if err := fake.AddProject(created); err != nil {
+		t.Fatal(err)
+	}
+	bad := project.Project{
+		Name:   "bad-project",
+		Path:   filepath.Join(fake.X.Root, "bad-project"),
+		Remote: filepath.Join(fake.X.Root, "does-not-exist"),
+	}
+	if err := fake.AddProject(bad); err != nil {
+		t.Fatal(err)
+	}
+	err := project.UpdateUniverse(fake.X, false, project.JobsOpt(4), project.RollbackOpt(true))
+	if got, want := fmt.Sprint(err), `error updating project "bad-project"`; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+	if strings.Contains(fmt.Sprint(err), "rollback failed") {
+		t.Errorf("got error %v, want successful rollback", err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+	if _, err := os.Stat(created.Path); !os.IsNotExist(err) {
+		t.Errorf("got %v, want project %v created by the update to be deleted", err, created.Name)
+	}
+}
+
+// TestPruneSnapshots checks that PruneSnapshots keeps the snapshots selected
+// by the retention policy, along with those that symlinks point to.
+func TestPruneSnapshots(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	dir := filepath.Join(jirix.Root, "snapshots")
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	date := func(month time.Month, day, hour int) string {
+		return time.Date(2016, month, day, hour, 0, 0, 0, time.Local).Format(time.RFC3339)
+	}
+	// 2016-03-07 is a Monday, so the snapshots span three days of two weeks.
+	names := []string{recent, date(3, 7, 10), date(3, 7, 9), date(3, 6, 12), date(3, 1, 12), date(2, 20, 12)}
+	link := filepath.Join(jirix.Root, "latest")
+	setup := func() {
+		s := jirix.NewSeq().RemoveAll(dir).MkdirAll(dir, 0755)
+		for _, name := range names {
+			s.WriteFile(filepath.Join(dir, name), []byte("<manifest/>"), 0644)
+		}
+		// The oldest snapshot has a symlink pointing to it, and the one before
+		// has patches.
+		if err := s.MkdirAll(project.SnapshotPatchDir(filepath.Join(dir, names[4])), 0755).
+			RemoveAll(link).Symlink(filepath.Join(dir, names[5]), link).
+			Symlink(names[0], filepath.Join(dir, "second-latest")).Done(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		policy project.RetentionPolicy
+		kept   []int
+	}{
+		{project.RetentionPolicy{KeepLast: 2}, []int{0, 1}},
+		{project.RetentionPolicy{KeepWithin: "2h"}, []int{0}},
+		{project.RetentionPolicy{KeepDaily: 3}, []int{0, 1, 3}},
+		{project.RetentionPolicy{KeepWeekly: 3}, []int{0, 1, 3}},
+		{project.RetentionPolicy{KeepLast: 1, KeepWeekly: 4}, []int{0, 1, 3, 5}},
+	}
+	for _, test := range tests {
+		setup()
+		var want []string
+		for i, name := range names {
+			kept := i == 5
+			for _, k := range test.kept {
+				kept = kept || k == i
+			}
+			if !kept {
+				want = append(want, filepath.Join(dir, name))
+			}
+		}
+		// A dry run doesn't remove anything.
+		got, err := project.PruneSnapshots(jirix, dir, []string{link}, test.policy, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got dry run %v, want %v", test.policy, got, want)
+		}
+		if infos, err := ioutil.ReadDir(dir); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(infos), len(names)+2; got != want {
+			t.Errorf("%v: dry run left %d files, want %d", test.policy, got, want)
+		}
+		got, err = project.PruneSnapshots(jirix, dir, []string{link}, test.policy, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", test.policy, got, want)
+		}
+		for _, file := range want {
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("%v: %v wasn't removed", test.policy, file)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "second-latest")); err != nil {
+			t.Errorf("%v: %v", test.policy, err)
+		}
+		if _, err := os.Stat(link); err != nil {
+			t.Errorf("%v: %v", test.policy, err)
+		}
+	}
+	// The patches of a removed snapshot are removed along with it.
+	if _, err := os.Stat(project.SnapshotPatchDir(filepath.Join(dir, names[4]))); !os.IsNotExist(err) {
+		t.Errorf("patches of %v weren't removed", names[4])
+	}
+
+	if _, err := project.PruneSnapshots(jirix, dir, nil, project.RetentionPolicy{}, true); err == nil {
+		t.Errorf("PruneSnapshots succeeded with an empty policy")
+	}
+}
+
+// TestPlanUpdateUniverse checks that PlanUpdateUniverse reports the operations
+// and hooks that UpdateUniverse would carry out, without carrying them out.
+func TestPlanUpdateUniverse(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advance project 1 remotely, and add a new project with a hook.
+	oldRev, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(localProjects[1].Path)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new revision")
+	newRev, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(fake.Projects[localProjects[1].Name])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("new-project"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["new-project"], "initial readme")
+	writeReadme(t, fake.X, fake.Projects["new-project"], "initial readme")
+	newProject := project.Project{
+		Name:    "new-project",
+		Path:    filepath.Join(fake.X.Root, "new-project"),
+		Remote:  fake.Projects["new-project"],
+		RunHook: "hook",
+	}
+	if err := fake.AddProject(newProject); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := project.PlanUpdateUniverse(fake.X, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := map[string]project.PlannedOperation{}
+	for _, op := range plan.Operations {
+		ops[op.Project] = op
+	}
+	for _, p := range []project.Project{localProjects[0], localProjects[2]} {
+		if op, ok := ops[p.Name]; ok {
+			t.Errorf("got operation %v for up-to-date project %v", op, p.Name)
+		}
+	}
+	if got, want := ops[localProjects[1].Name], (project.PlannedOperation{
+		Kind:        "update",
+		Project:     localProjects[1].Name,
+		Remote:      localProjects[1].Remote,
+		OldPath:     localProjects[1].Path,
+		NewPath:     localProjects[1].Path,
+		OldRevision: oldRev,
+		NewRevision: newRev,
+	}); got != want {
+		t.Errorf("got operation %#v, want %#v", got, want)
+	}
+	if got, want := ops["new-project"].Kind, "create"; got != want {
+		t.Errorf("got kind %q for new project, want %q", got, want)
+	}
+	if got, want := len(plan.Hooks), 1; got != want {
+		t.Fatalf("got %v hooks, want %v", got, want)
+	}
+	if got, want := plan.Hooks[0].Project, "new-project"; got != want {
+		t.Errorf("got hook for project %q, want %q", got, want)
+	}
+
+	// Check that nothing was changed.
+	if err := fake.X.NewSeq().AssertDirExists(newProject.Path).Done(); err == nil {
+		t.Errorf("expected project %q not to exist", newProject.Path)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+}
+
+// TestUpdateUniverseGroups checks that only the projects selected by groups are
+// checked out, and that projects excluded by groups are never deleted.
+func TestUpdateUniverseGroups(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	server := project.Project{
+		Name:   "server",
+		Path:   filepath.Join(fake.X.Root, "server"),
+		Groups: "server,backend",
+	}
+	if err := fake.CreateRemoteProject(server.Name); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[server.Name], "initial readme")
+	server.Remote = fake.Projects[server.Name]
+	if err := fake.AddProject(server); err != nil {
+		t.Fatal(err)
+	}
+	checkExists := func(p project.Project, want bool) {
+		err := fake.X.NewSeq().AssertDirExists(p.Path).Done()
+		if got := err == nil; got != want {
+			t.Errorf("project %v: got exists %v, want %v", p.Name, got, want)
+		}
+	}
+
+	// Exclude the server group.
+	if err := project.UpdateUniverse(fake.X, true, project.GroupsOpt("-server")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+	checkExists(server, false)
+	manifest, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := manifest.Groups, "-server"; got != want {
+		t.Errorf("got .jiri_manifest groups %q, want %q", got, want)
+	}
+	projects, _, err := project.LoadManifest(fake.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projects.FindUnique(server.Name); err == nil {
+		t.Errorf("LoadManifest returned excluded project %v", server.Name)
+	}
+
+	// Select only the backend group.  The other projects must not be deleted,
+	// even with gc.
+	if err := project.UpdateUniverse(fake.X, true, project.GroupsOpt("+backend")); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, server, "initial readme")
+	for _, p := range localProjects {
+		checkExists(p, true)
+	}
+	states, err := project.GetProjectStates(fake.X, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(states), 1; got != want {
+		t.Errorf("got %v project states, want %v", got, want)
+	}
+	for _, state := range states {
+		if got, want := state.Project.Name, server.Name; got != want {
+			t.Errorf("got project state for %v, want %v", got, want)
+		}
+	}
+	snapshot := filepath.Join(fake.X.Root, "snapshot")
+	if err := project.CreateSnapshot(fake.X, snapshot, ""); err != nil {
+		t.Fatal(err)
+	}
+	snapshotProjects, _, err := project.LoadSnapshotFile(fake.X, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(snapshotProjects), 1; got != want {
+		t.Errorf("got %v projects in snapshot, want %v", got, want)
+	}
+
+	// Selecting all projects again updates the excluded projects.
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "new revision")
+	if err := project.UpdateUniverse(fake.X, true, project.GroupsOpt("")); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[0], "new revision")
+	checkReadme(t, fake.X, server, "initial readme")
+}
+
+// TestUpdateUniverseOverrides checks that overrides in .jiri_manifest replace
+// the attributes of projects, and that removing them restores the projects.
+func TestUpdateUniverseOverrides(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	pinned, forked := localProjects[0], localProjects[1]
+	oldRev, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(fake.Projects[pinned.Name])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[pinned.Name], "new revision")
+	if err := fake.CreateRemoteProject("fork"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["fork"], "fork readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, pinned, "new revision")
+	checkReadme(t, fake.X, forked, "initial readme")
+
+	setOverrides := func(overrides ...project.Override) {
+		manifest, err := fake.ReadJiriManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Overrides = overrides
+		if err := fake.WriteJiriManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setOverrides(
+		project.Override{Project: pinned.Name, Revision: oldRev},
+		project.Override{Project: string(forked.Key()), Remote: fake.Projects["fork"]},
+	)
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, pinned, "initial readme")
+	checkReadme(t, fake.X, forked, "fork readme")
+	states, err := project.GetProjectStates(fake.X, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overridden := map[string]bool{}
+	for _, state := range states {
+		if state.Overridden {
+			overridden[state.Project.Name] = true
+		}
+	}
+	if want := map[string]bool{pinned.Name: true, forked.Name: true}; !reflect.DeepEqual(overridden, want) {
+		t.Errorf("got overridden projects %v, want %v", overridden, want)
+	}
+
+	// Overriding a project that doesn't exist is an error.
+	setOverrides(project.Override{Project: "missing", Revision: oldRev})
+	if err := fake.UpdateUniverse(false); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got error %v, want an error about the missing project", err)
+	}
+
+	// Removing the overrides restores the projects in place.
+	setOverrides()
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, pinned, "new revision")
+	checkReadme(t, fake.X, forked, "initial readme")
+	remote, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(forked.Path)).RemoteUrl("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remote, forked.Remote; got != want {
+		t.Errorf("got remote %v, want %v", got, want)
+	}
+}
+
+// TestUpdateUniverseLocked checks that updates with LockedOpt check out the
+// revisions pinned in the lock file.
+func TestUpdateUniverseLocked(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	locked := project.LockedOpt(true)
+	if err := project.UpdateUniverse(fake.X, false, locked); err == nil {
+		t.Errorf("locked update without a lock file didn't fail")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.WriteLockFile(fake.X); err != nil {
+		t.Fatal(err)
+	}
+	lockProjects, _, err := project.LoadSnapshotFile(fake.X, fake.X.JiriManifestLockFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockProjects.FindUnique("manifest"); err != nil {
+		t.Errorf("manifest project not pinned: %v", err)
+	}
+
+	// A locked update ignores new remote revisions.
+	for _, p := range localProjects {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "new revision")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(fake.X, false, locked); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+
+	// Refreshing the lock pins the new remote revisions, without updating the
+	// local projects.
+	if err := project.RefreshLockFile(fake.X); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+		writeReadme(t, fake.X, fake.Projects[p.Name], "newer revision")
+	}
+	if err := project.UpdateUniverse(fake.X, false, locked); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "new revision")
+	}
+
+	// The manifest project of the remote import is pinned by a refresh even
+	// if the manifest no longer declares it.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var projects []project.Project
+	for _, p := range m.Projects {
+		if p.Name != "manifest" {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.RefreshLockFile(fake.X); err != nil {
+		t.Fatal(err)
+	}
+	lockProjects, _, err = project.LoadSnapshotFile(fake.X, fake.X.JiriManifestLockFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestProject, err := lockProjects.FindUnique("manifest")
+	if err != nil {
+		t.Fatalf("manifest project not pinned: %v", err)
+	}
+	if got, want := manifestProject.Path, filepath.Join(fake.X.Root, "manifest"); got != want {
+		t.Errorf("got manifest project path %v, want %v", got, want)
+	}
+	if manifestProject.Revision == "HEAD" {
+		t.Errorf("manifest project not pinned to a revision")
+	}
+}
+
+// TestUpdateUniverseLocal checks that a local update resolves the manifest and
+// resets the projects to the revisions that were already fetched, without
+// contacting the remotes, and that it fails before changing any project if a
+// revision isn't available locally.
+func TestUpdateUniverseLocal(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advance project 0, move project 1, and pin project 2 to a new revision.
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "new revision")
+	writeReadme(t, fake.X, fake.Projects[localProjects[2].Name], "pinned revision")
+	pinned, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(fake.Projects[localProjects[2].Name])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath := localProjects[1].Path
+	localProjects[1].Path = filepath.Join(fake.X.Root, "new-project-path")
+	for i, p := range m.Projects {
+		switch p.Name {
+		case localProjects[1].Name:
+			m.Projects[i].Path = localProjects[1].Path
+		case localProjects[2].Name:
+			m.Projects[i].Revision = pinned
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch the manifest and project 0, and make the remotes unavailable.
+	fetch := func(dir string) {
+		if err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(dir)).Fetch("origin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetch(filepath.Join(fake.X.Root, "manifest"))
+	fetch(localProjects[0].Path)
+	remoteDir := filepath.Dir(fake.Projects[localProjects[0].Name])
+	hide := func() {
+		if err := os.Rename(remoteDir, remoteDir+".unavailable"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unhide := func() {
+		if err := os.Rename(remoteDir+".unavailable", remoteDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hide()
+	local := project.LocalOpt(true)
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatalf("update without the remotes didn't fail")
+	}
+	err = project.UpdateUniverse(fake.X, false, local)
+	if err == nil || !strings.Contains(err.Error(), "not available locally") || !strings.Contains(err.Error(), localProjects[2].Name) {
+		t.Errorf("got error %v, want revision of %q not available locally", err, localProjects[2].Name)
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("failed local update moved project %q: %v", localProjects[1].Name, err)
+	}
+
+	// Once the pinned revision is fetched, the local update succeeds.
+	unhide()
+	fetch(localProjects[2].Path)
+	hide()
+	if err := project.UpdateUniverse(fake.X, false, local); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("project %q was not moved from %q", localProjects[1].Name, oldPath)
+	}
+	checkReadme(t, fake.X, localProjects[0], "new revision")
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+	checkReadme(t, fake.X, localProjects[2], "pinned revision")
+
+	// New projects can't be created by a local update.
+	unhide()
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{Name: "new", Path: filepath.Join(fake.X.Root, "new"), Remote: fake.Projects["new"]}); err != nil {
+		t.Fatal(err)
+	}
+	fetch(filepath.Join(fake.X.Root, "manifest"))
+	hide()
+	defer unhide()
+	if err := project.UpdateUniverse(fake.X, false, local); err == nil || !strings.Contains(err.Error(), "cannot create project") {
+		t.Errorf("got error %v, want project %q can't be created", err, "new")
+	}
+}
+
+// TestUpdateUniverseRebase checks that UpdateUniverse brings the local
+// branches up to date with the updated master branch, leaving the branches
+// that conflict as they were.
+func TestUpdateUniverseRebase(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	dir := localProjects[0].Path
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(dir))
+	// commitOnBranch creates the given branch from start, and commits the
+	// given file to it.
+	commitOnBranch := func(branch, start, file string, deps ...string) {
+		if err := git.CreateBranchWithUpstream(branch, start); err != nil {
+			t.Fatal(err)
+		}
+		if err := git.CheckoutBranch(branch); err != nil {
+			t.Fatal(err)
+		}
+		if file == "README" {
+			writeReadme(t, fake.X, dir, "conflicting readme")
+		} else {
+			if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			commitFile(t, fake.X, dir, file, "creating "+file)
+		}
+		if len(deps) > 0 {
+			metadataDir := filepath.Join(dir, jiri.ProjectMetaDir, branch)
+			if err := fake.X.NewSeq().MkdirAll(metadataDir, 0755).WriteFile(filepath.Join(metadataDir, ".dependency_path"), []byte(strings.Join(deps, "\n")), 0644).Done(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	commitOnBranch("tracked", "origin/master", "tracked-file")
+	commitOnBranch("conflict", "origin/master", "README")
+	commitOnBranch("untracked", "master", "untracked-file")
+	commitOnBranch("cl-1", "master", "cl-1-file", "master")
+	commitOnBranch("cl-2", "cl-1", "cl-2-file", "master", "cl-1")
+	before, err := git.CurrentRevisionOfBranch("conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// behind returns the number of commits on master that are not on the
+	// given branch.
+	behind := func(branch string) int {
+		n, err := git.CountCommits("master", branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "new revision")
+	var stdout bytes.Buffer
+	jirix := fake.X.Clone(tool.ContextOpts{Stdout: &stdout})
+	if err := project.UpdateUniverse(jirix, false, project.RebaseTracked); err != nil {
+		t.Fatal(err)
+	}
+	for _, branch := range []string{"tracked", "cl-1", "cl-2"} {
+		if n := behind(branch); n != 0 {
+			t.Errorf("branch %q is %d commits behind master", branch, n)
+		}
+	}
+	if n := behind("untracked"); n == 0 {
+		t.Errorf("branch %q was updated", "untracked")
+	}
+	if after, err := git.CurrentRevisionOfBranch("conflict"); err != nil || after != before {
+		t.Errorf("branch %q changed from %v to %v (%v)", "conflict", before, after, err)
+	}
+	if current, err := git.CurrentBranchName(); err != nil || current != "cl-2" {
+		t.Errorf("got current branch %q (%v), want %q", current, err, "cl-2")
+	}
+	for _, line := range []string{
+		`tracked\s+updated\s+rebased onto "master"`,
+		`conflict\s+needs manual resolution\s+conflicts with "master"`,
+		`cl-1\s+updated\s+merged "master"`,
+		`cl-2\s+updated\s+merged "cl-1"`,
+	} {
+		if !regexp.MustCompile(localProjects[0].Name + `\s+` + line).MatchString(stdout.String()) {
+			t.Errorf("summary %q doesn't match %q", stdout.String(), line)
+		}
+	}
+
+	// With RebaseAll, untracked branches are rebased as well, and branches
+	// that are up to date are reported as such.
+	writeReadme(t, fake.X, fake.Projects[localProjects[0].Name], "newer revision")
+	if err := git.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if err := project.UpdateUniverse(jirix, false, project.RebaseAll); err != nil {
+		t.Fatal(err)
+	}
+	if n := behind("untracked"); n != 0 {
+		t.Errorf("branch %q is %d commits behind master", "untracked", n)
+	}
+	if !regexp.MustCompile(`untracked\s+updated`).MatchString(stdout.String()) {
+		t.Errorf("summary %q doesn't report branch %q as updated", stdout.String(), "untracked")
+	}
+}
+
+// TestUpdateUniverseGitConfig checks that the git configuration and remotes
+// declared by a project are applied on each update, and that those removed from
+// the manifest are removed from the repository.
+func TestUpdateUniverseGitConfig(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	upstream := fake.Projects[localProjects[1].Name]
+	// setProject changes the git configuration and remotes of the first
+	// project in the remote manifest, and updates the universe.
+	setProject := func(configs []project.GitConfig, remotes []project.GitRemote) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range m.Projects {
+			if m.Projects[i].Name == localProjects[0].Name {
+				m.Projects[i].GitConfigs, m.Projects[i].GitRemotes = configs, remotes
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(localProjects[0].Path))
+	checkConfig := func(key string, want ...string) {
+		got, err := git.ConfigValues(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v = %q, want %q", key, got, want)
+		}
+	}
+
+	configs := []project.GitConfig{
+		{Key: "core.autocrlf", Value: "input"},
+		{Key: "pull.rebase", Value: "true"},
+	}
+	remotes := []project.GitRemote{
+		{Name: "upstream", URL: upstream},
+		{Name: "origin", PushURL: "https://example.com/push"},
+	}
+	setProject(configs, remotes)
+	checkConfig("core.autocrlf", "input")
+	checkConfig("pull.rebase", "true")
+	checkConfig("remote.upstream.url", upstream)
+	checkConfig("remote.origin.pushurl", "https://example.com/push")
+	checkConfig("remote.origin.url", fake.Projects[localProjects[0].Name])
+	states, err := project.GetProjectStates(fake.X, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := states[localProjects[0].Key()].Project; !reflect.DeepEqual(got.GitConfigs, configs) || !reflect.DeepEqual(got.GitRemotes, remotes) {
+		t.Errorf("got project info %v %v, want %v %v", got.GitConfigs, got.GitRemotes, configs, remotes)
+	}
+
+	// Local changes to declared settings are reverted, settings removed from
+	// the manifest are removed, and other settings are left alone.
+	if err := git.SetConfig("core.autocrlf", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.SetConfig("user.name", "me"); err != nil {
+		t.Fatal(err)
+	}
+	setProject(configs[:1], nil)
+	checkConfig("core.autocrlf", "input")
+	checkConfig("pull.rebase")
+	checkConfig("remote.upstream.url")
+	checkConfig("remote.origin.pushurl")
+	checkConfig("remote.origin.url", fake.Projects[localProjects[0].Name])
+	checkConfig("user.name", "me")
+
+	// The global configuration neither stops a declared setting from being
+	// written to the repository, nor is removed along with it.
+	globalConfig := filepath.Join(fake.X.Root, "gitconfig")
+	if err := ioutil.WriteFile(globalConfig, []byte("[pull]\n\tff = only\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldGlobalConfig, ok := os.LookupEnv("GIT_CONFIG_GLOBAL")
+	if err := os.Setenv("GIT_CONFIG_GLOBAL", globalConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if ok {
+			os.Setenv("GIT_CONFIG_GLOBAL", oldGlobalConfig)
+		} else {
+			os.Unsetenv("GIT_CONFIG_GLOBAL")
+		}
+	}()
+	setProject([]project.GitConfig{{Key: "pull.ff", Value: "only"}}, nil)
+	checkConfig("pull.ff", "only")
+	setProject(nil, nil)
+	checkConfig("pull.ff")
+}
+
+// TestUpdateUniverseHooks checks that every hook runs even if others fail or
+// time out, that post-update hooks run once after all projects are updated,
+// and that the outcome of every hook is summarized.
+func TestUpdateUniverseHooks(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-
-	// Delete project 1.
+	writeScript := func(path, script string) {
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The runhooks are relative to the jiri root, and the post-update hook
+	// is relative to its project.
+	writeScript(filepath.Join(fake.X.Root, "fail.sh"), "exit 1")
+	writeScript(filepath.Join(fake.X.Root, "slow.sh"), "sleep 10")
+	remote := fake.Projects[localProjects[0].Name]
+	writeScript(filepath.Join(remote, "post.sh"), `echo "$1" >> ../post-update.out`)
+	commitFile(t, fake.X, remote, "post.sh", "adding post-update hook")
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			continue
+	for i := range m.Projects {
+		switch m.Projects[i].Name {
+		case localProjects[1].Name:
+			m.Projects[i].RunHook = "fail.sh"
+		case localProjects[2].Name:
+			m.Projects[i].RunHook = "slow.sh"
 		}
-		projects = append(projects, p)
 	}
-	m.Projects = projects
+	m.Hooks = []project.Hook{
+		{Name: "post", Project: localProjects[0].Name, Action: "post.sh"},
+		{Name: "missing", Project: "missing-project", Action: "post.sh"},
+	}
 	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	// Check that UpdateUniverse() with gc=false does not delete the local copy
-	// of the project.
+	// Advance the projects with runhooks, so that their hooks run.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new revision")
+	writeReadme(t, fake.X, fake.Projects[localProjects[2].Name], "new revision")
+
+	plan, err := project.PlanUpdateUniverse(fake.X, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plan.Hooks[len(plan.Hooks)-1], (project.PlannedHook{Project: localProjects[0].Name, Hook: "post", Kind: "post-update"}); got != want {
+		t.Errorf("got last planned hook %#v, want %#v", got, want)
+	}
+
+	var stdout bytes.Buffer
+	jirix := fake.X.Clone(tool.ContextOpts{Stdout: &stdout})
+	err = project.UpdateUniverse(jirix, false, project.HookTimeoutOpt(time.Second), project.ParallelHooksOpt(true))
+	if err == nil || !strings.Contains(err.Error(), "2 of 4 hooks failed") {
+		t.Fatalf("got error %v, want 2 of 4 hooks to fail", err)
+	}
+	// The projects are updated, and the post-update hook runs, regardless.
+	checkReadme(t, fake.X, localProjects[1], "new revision")
+	checkReadme(t, fake.X, localProjects[2], "new revision")
+	if data, err := ioutil.ReadFile(filepath.Join(fake.X.Root, "post-update.out")); err != nil || string(data) != "post-update\n" {
+		t.Errorf("got post-update hook output %q (%v), want %q", data, err, "post-update\n")
+	}
+	for _, line := range []string{
+		localProjects[1].Name + `\s+fail.sh\s+update\s+failed`,
+		localProjects[2].Name + `\s+slow.sh\s+update\s+timed out\s+\S+\s+killed after 1s`,
+		localProjects[0].Name + `\s+post\s+post-update\s+ok`,
+		`missing-project\s+missing\s+post-update\s+skipped\s+-\s+project "missing-project" is not checked out`,
+	} {
+		if !regexp.MustCompile(line).MatchString(stdout.String()) {
+			t.Errorf("summary %q doesn't match %q", stdout.String(), line)
+		}
+	}
+
+	// Locked updates and snapshot checkouts run the post-update hooks that
+	// the lock file and the snapshot record.
+	if err := project.WriteLockFile(fake.X); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(fake.X, false, project.LockedOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(fake.X.Root, "snapshot")
+	if err := project.CreateSnapshot(fake.X, snapshot, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.CheckoutSnapshot(fake.X, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("post-update\n", 3)
+	if data, err := ioutil.ReadFile(filepath.Join(fake.X.Root, "post-update.out")); err != nil || string(data) != want {
+		t.Errorf("got post-update hook output %q (%v), want %q", data, err, want)
+	}
+}
+
+// TestUpdateUniverseShallow checks that projects with a depth are cloned
+// shallow, and that checking out a snapshot fetches a revision beyond the
+// shallow boundary.
+func TestUpdateUniverseShallow(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("shallow"); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := fake.Projects["shallow"]
+	writeReadme(t, fake.X, remoteDir, "revision 1")
+	oldRev, err := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(remoteDir)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, remoteDir, "revision 2")
+	writeReadme(t, fake.X, remoteDir, "revision 3")
+	// Local clones ignore the depth, so use a file:// url.
+	shallow := project.Project{
+		Name:   "shallow",
+		Path:   filepath.Join(fake.X.Root, "shallow"),
+		Remote: "file://" + remoteDir,
+		Depth:  1,
+	}
+	if err := fake.AddProject(shallow); err != nil {
+		t.Fatal(err)
+	}
 	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
-	if err := s.AssertDirExists(localProjects[1].Path).Done(); err != nil {
-		t.Fatalf("expected project %q at path %q to exist but it did not", localProjects[1].Name, localProjects[1].Path)
+	checkReadme(t, fake.X, shallow, "revision 3")
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(shallow.Path))
+	if isShallow, err := git.IsShallow(); err != nil || !isShallow {
+		t.Errorf("got shallow %v, %v, want true", isShallow, err)
 	}
-	checkReadme(t, fake.X, localProjects[1], "initial readme")
-	// Check that UpdateUniverse() with gc=true does delete the local copy of
-	// the project.
-	if err := fake.UpdateUniverse(true); err != nil {
+	if git.IsRevisionAvailable(oldRev) {
+		t.Errorf("revision %v is available in the shallow clone", oldRev)
+	}
+
+	// Check out a snapshot with the old revision.
+	shallow.Revision = oldRev
+	snapshot := filepath.Join(fake.X.Root, "snapshot")
+	if err := (&project.Manifest{Projects: []project.Project{shallow}}).ToFile(fake.X, snapshot); err != nil {
 		t.Fatal(err)
 	}
-	if err := s.AssertDirExists(localProjects[1].Path).Done(); err == nil {
-		t.Fatalf("expected project %q at path %q not to exist but it did", localProjects[1].Name, localProjects[3].Path)
+	if err := project.CheckoutSnapshot(fake.X, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, shallow, "revision 1")
+
+	// The default depth applies to new projects that don't specify one, but
+	// isn't recorded in their metadata.
+	dflt := project.Project{
+		Name:   "default-depth",
+		Path:   filepath.Join(fake.X.Root, "default-depth"),
+		Remote: "file://" + remoteDir,
+	}
+	if err := fake.AddProject(dflt); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(fake.X, false, project.DepthOpt(1)); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, dflt, "revision 3")
+	git = gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(dflt.Path))
+	if isShallow, err := git.IsShallow(); err != nil || !isShallow {
+		t.Errorf("got shallow %v, %v, want true", isShallow, err)
+	}
+	local, err := project.ProjectAtPath(fake.X, dflt.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Depth != 0 {
+		t.Errorf("got depth %d in the metadata, want 0", local.Depth)
 	}
 }
 
-// TestUpdateUniverseNewProjectSamePath checks that UpdateUniverse can handle a
-// new project with the same path as a deleted project, but a different path.
-func TestUpdateUniverseNewProjectSamePath(t *testing.T) {
+// TestUpdateUniverseNested checks that projects may only be nested within
+// other projects when allowed, and that nested projects are excluded from the
+// enclosing project.
+func TestUpdateUniverseNested(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	if err := fake.UpdateUniverse(false); err != nil {
+	if err := fake.CreateRemoteProject("nested"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["nested"], "nested readme")
+	nested := project.Project{
+		Name:   "nested",
+		Path:   filepath.Join(localProjects[0].Path, "nested"),
+		Remote: fake.Projects["nested"],
+	}
+	if err := fake.AddProject(nested); err != nil {
 		t.Fatal(err)
 	}
+	err := fake.UpdateUniverse(false)
+	if want := `nested in project "project-0"`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("got error %v, want it to contain %q", err, want)
+	}
 
-	// Delete a project 1 and create a new one with a different name but the
-	// same path.
+	// Allow the project to be nested.
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	newProjectName := "new-project-name"
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Path == localProjects[1].Path {
-			p.Name = newProjectName
+	for index := range m.Projects {
+		if m.Projects[index].Name == nested.Name {
+			m.Projects[index].Nested = true
 		}
-		projects = append(projects, p)
 	}
-	localProjects[1].Name = newProjectName
-	m.Projects = projects
 	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	// Check that UpdateUniverse() does not fail.
-	if err := fake.UpdateUniverse(true); err != nil {
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	checkReadme(t, fake.X, nested, "nested readme")
+	checkMetadataIsIgnored(t, fake.X, localProjects[0])
+	git := gitutil.New(fake.X.NewSeq(), gitutil.RootDirOpt(localProjects[0].Path))
+	if untracked, err := git.HasUntrackedFiles(); err != nil || untracked {
+		t.Errorf("got untracked files %v, %v in the enclosing project, want none", untracked, err)
+	}
+	// Updating again doesn't add the nested project to the exclude file twice.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(localProjects[0].Path, ".git", "info", "exclude"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(data), "/nested/\n"), 1; got != want {
+		t.Errorf("got %d exclusions of the nested project, want %d:\n%s", got, want, data)
+	}
 }
 
-// TestUpdateUniverseRemoteBranch checks that UpdateUniverse can pull from a
-// non-master remote branch.
-func TestUpdateUniverseRemoteBranch(t *testing.T) {
+// TestUpdateUniverseCache tests that projects are cloned with references to
+// mirrors in the cache, and that unused mirrors are pruned.
+func TestUpdateUniverseCache(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
-	s := fake.X.NewSeq()
-	if err := fake.UpdateUniverse(false); err != nil {
+	cacheDir, err := fake.X.NewSeq().TempDir("", "jiri-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.X.NewSeq().RemoveAll(cacheDir)
+	// The context environment replaces the process environment, so copy it.
+	env := map[string]string{jiri.CacheEnv: cacheDir}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 && kv[:i] != jiri.CacheEnv {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	jirix := fake.X.Clone(tool.ContextOpts{Env: env})
+	if err := project.UpdateUniverse(jirix, false); err != nil {
 		t.Fatal(err)
 	}
+	for _, p := range localProjects {
+		checkReadme(t, jirix, p, "initial readme")
+		alternates := filepath.Join(p.Path, ".git", "objects", "info", "alternates")
+		if _, err := jirix.NewSeq().Stat(alternates); err != nil {
+			t.Errorf("project %v doesn't use the cache: %v", p.Name, err)
+		}
+	}
+	if removed, err := project.PruneCache(jirix); err != nil || len(removed) != 0 {
+		t.Fatalf("got %v, %v, want no mirrors removed", removed, err)
+	}
 
-	// Commit to master branch of a project 1.
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "master commit")
-	// Create and checkout a new branch of project 1 and make a new commit.
-	git := gitutil.New(s, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	if err := git.CreateAndCheckoutBranch("non-master"); err != nil {
+	// Fetches go through the mirror.
+	writeReadme(t, jirix, fake.Projects[localProjects[0].Name], "new revision")
+	if err := project.UpdateUniverse(jirix, false); err != nil {
 		t.Fatal(err)
 	}
-	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "non-master commit")
-	// Point the manifest to the new non-master branch.
+	checkReadme(t, jirix, localProjects[0], "new revision")
+
+	// Remove project 1, and check that only its mirror is pruned.
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
 	projects := []project.Project{}
 	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.RemoteBranch = "non-master"
+		if p.Name != localProjects[1].Name {
+			projects = append(projects, p)
 		}
-		projects = append(projects, p)
 	}
 	m.Projects = projects
 	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	// Check that UpdateUniverse pulls the commit from the non-master branch.
-	if err := fake.UpdateUniverse(false); err != nil {
+	if err := project.UpdateUniverse(jirix, true); err != nil {
 		t.Fatal(err)
 	}
-	checkReadme(t, fake.X, localProjects[1], "non-master commit")
+	// The mirror isn't pruned while another update holds its lock.
+	mirrors, err := filepath.Glob(filepath.Join(cacheDir, localProjects[1].Name+"_*.git"))
+	if err != nil || len(mirrors) != 1 {
+		t.Fatalf("got mirrors %v, %v, want the mirror of %v", mirrors, err, localProjects[1].Name)
+	}
+	lockFile, err := os.OpenFile(mirrors[0]+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := project.PruneCache(jirix); err != nil || len(removed) != 0 {
+		t.Fatalf("got %v, %v, want no mirrors removed", removed, err)
+	}
+	lockFile.Close()
+	removed, err := project.PruneCache(jirix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || !strings.HasPrefix(filepath.Base(removed[0]), localProjects[1].Name+"_") {
+		t.Errorf("got removed mirrors %v, want the mirror of %v", removed, localProjects[1].Name)
+	}
+	checkReadme(t, jirix, localProjects[0], "new revision")
+
+	// Change the remote of project 0, and check that the mirror it was cloned
+	// with is kept, since the clone still borrows objects from it.
+	for i, p := range m.Projects {
+		if p.Name == localProjects[0].Name {
+			m.Projects[i].Remote = p.Remote + "/"
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.UpdateUniverse(jirix, true); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := project.PruneCache(jirix); err != nil || len(removed) != 0 {
+		t.Fatalf("got %v, %v, want no mirrors removed", removed, err)
+	}
+	writeReadme(t, jirix, fake.Projects[localProjects[0].Name], "newer revision")
+	if err := project.UpdateUniverse(jirix, true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, jirix, localProjects[0], "newer revision")
 }
 
 func TestFileImportCycle(t *testing.T) {
@@ -608,18 +1867,252 @@ func TestFileAndRemoteImportCycle(t *testing.T) {
 	if err := manifestC.ToFile(fake.X, fileC); err != nil {
 		t.Fatal(err)
 	}
-	if err := manifestD.ToFile(fake.X, fileD); err != nil {
-		t.Fatal(err)
+	if err := manifestD.ToFile(fake.X, fileD); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, remote1, fileA, "commit A")
+	commitFile(t, fake.X, remote2, fileB, "commit B")
+	commitFile(t, fake.X, remote2, fileC, "commit C")
+	commitFile(t, fake.X, remote1, fileD, "commit D")
+
+	// The update should complain about the cycle.
+	err := project.UpdateUniverse(fake.X, false)
+	if got, want := fmt.Sprint(err), "import cycle detected"; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+}
+
+// writeArchive writes a gzipped tarball with the given files to path, and
+// returns its sha256.
+func writeArchive(t *testing.T, path string, files map[string]string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// TestUpdateUniverseArchive checks that UpdateUniverse can create and update
+// projects that use the archive protocol.
+func TestUpdateUniverseArchive(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	archiveDir, err := fake.X.NewSeq().TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.X.NewSeq().RemoveAll(archiveDir)
+	checkArchive := func(p project.Project, want string) {
+		file := filepath.Join(p.Path, "README")
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&0222 != 0 {
+			t.Errorf("got mode %v for %v, want read-only", fi.Mode(), file)
+		}
+	}
+
+	// Create the archive project.
+	remote := filepath.Join(archiveDir, "archive-1.0.tar.gz")
+	p := project.Project{
+		Name:     "archive",
+		Path:     filepath.Join(fake.X.Root, "archive"),
+		Protocol: "archive",
+		Remote:   remote,
+		Revision: writeArchive(t, remote, map[string]string{"archive-1.0/README": "version 1.0"}),
+	}
+	if err := fake.AddProject(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(p, "version 1.0")
+	projects, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := projects[p.Key()].Revision, p.Revision; got != want {
+		t.Errorf("got revision %v, want %v", got, want)
+	}
+
+	// Update the archive project to a new revision.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			m.Projects[i].Revision = writeArchive(t, remote, map[string]string{"archive-1.1/README": "version 1.1"})
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(p, "version 1.1")
+
+	// Move the archive project and update it to a new revision at once.
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			p.Path = filepath.Join(fake.X.Root, "moved-archive")
+			m.Projects[i].Path = p.Path
+			m.Projects[i].Revision = writeArchive(t, remote, map[string]string{"archive-moved/README": "moved"})
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(p, "moved")
+
+	// Check that an archive with the wrong sha256 is rejected.
+	writeArchive(t, remote, map[string]string{"archive-1.2/README": "version 1.2"})
+	m.Projects = append(m.Projects, project.Project{
+		Name:     "bad-archive",
+		Path:     filepath.Join(fake.X.Root, "bad-archive"),
+		Protocol: "archive",
+		Remote:   remote,
+		Revision: p.Revision,
+	})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	err = fake.UpdateUniverse(false)
+	if got, want := fmt.Sprint(err), "has sha256"; !strings.Contains(got, want) {
+		t.Errorf("got error %v, want substr %v", got, want)
+	}
+
+	// Check that archive projects are deleted with -gc.
+	var remaining []project.Project
+	for _, mp := range m.Projects {
+		if mp.Protocol != "archive" {
+			remaining = append(remaining, mp)
+		}
+	}
+	m.Projects = remaining
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.Path); !os.IsNotExist(err) {
+		t.Errorf("got %v, want archive project %v to be deleted", err, p.Path)
+	}
+}
+
+// TestUpdateUniverseArchiveEscape checks that archives whose entries would be
+// written outside of the project are rejected.
+func TestUpdateUniverseArchiveEscape(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	archiveDir, err := fake.X.NewSeq().TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.X.NewSeq().RemoveAll(archiveDir)
+	tests := []struct {
+		headers []*tar.Header
+		want    string
+	}{
+		{
+			// The second symlink is lexically within the project, but
+			// resolves to its parent through the first one.
+			headers: []*tar.Header{
+				{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "p", Typeflag: tar.TypeSymlink, Linkname: "x/.."},
+				{Name: "p/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			want: "outside",
+		},
+		{
+			headers: []*tar.Header{
+				{Name: "README", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "link", Typeflag: tar.TypeLink, Linkname: "README"},
+			},
+			want: "hard link",
+		},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range test.headers {
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		remote := filepath.Join(archiveDir, fmt.Sprintf("archive-%d.tar", i))
+		if err := ioutil.WriteFile(remote, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		p := project.Project{
+			Name:     fmt.Sprintf("archive-%d", i),
+			Path:     filepath.Join(fake.X.Root, fmt.Sprintf("archive-%d", i)),
+			Protocol: "archive",
+			Remote:   remote,
+			Revision: hex.EncodeToString(sum[:]),
+		}
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+		err := fake.UpdateUniverse(false)
+		if got := fmt.Sprint(err); !strings.Contains(got, test.want) {
+			t.Errorf("%d: got error %v, want substr %v", i, got, test.want)
+		}
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var remaining []project.Project
+		for _, mp := range m.Projects {
+			if mp.Name != p.Name {
+				remaining = append(remaining, mp)
+			}
+		}
+		m.Projects = remaining
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
 	}
-	commitFile(t, fake.X, remote1, fileA, "commit A")
-	commitFile(t, fake.X, remote2, fileB, "commit B")
-	commitFile(t, fake.X, remote2, fileC, "commit C")
-	commitFile(t, fake.X, remote1, fileD, "commit D")
-
-	// The update should complain about the cycle.
-	err := project.UpdateUniverse(fake.X, false)
-	if got, want := fmt.Sprint(err), "import cycle detected"; !strings.Contains(got, want) {
-		t.Errorf("got error %v, want substr %v", got, want)
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want no escaped file", err)
 	}
 }
 
@@ -855,6 +2348,12 @@ func TestManifestToFromBytes(t *testing.T) {
 						Remote:       "remote2",
 						RemoteBranch: "branch2",
 						Revision:     "rev2",
+						GitConfigs: []project.GitConfig{
+							{Key: "core.autocrlf", Value: "input"},
+						},
+						GitRemotes: []project.GitRemote{
+							{Name: "upstream", URL: "upstream2"},
+						},
 					},
 				},
 				Tools: []project.Tool{
@@ -864,6 +2363,13 @@ func TestManifestToFromBytes(t *testing.T) {
 						Project: "toolproject",
 					},
 				},
+				Hooks: []project.Hook{
+					{
+						Name:    "hook",
+						Project: "project1",
+						Action:  "path/to/hook",
+					},
+				},
 			},
 			`<manifest>
   <imports>
@@ -873,11 +2379,111 @@ func TestManifestToFromBytes(t *testing.T) {
   </imports>
   <projects>
     <project name="project1" path="path1" remote="remote1" gerrithost="https://test-review.googlesource.com" githooks="path/to/githooks" runhook="path/to/hook"/>
-    <project name="project2" path="path2" remote="remote2" remotebranch="branch2" revision="rev2"/>
+    <project name="project2" path="path2" remote="remote2" remotebranch="branch2" revision="rev2">
+      <gitconfig key="core.autocrlf" value="input"/>
+      <remote name="upstream" url="upstream2"/>
+    </project>
   </projects>
   <tools>
     <tool data="tooldata" name="tool" project="toolproject"/>
   </tools>
+  <hooks>
+    <hook name="hook" project="project1" action="path/to/hook"/>
+  </hooks>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Hosts: []project.Host{
+					{
+						Name:       "vanadium",
+						Remote:     "https://vanadium.googlesource.com",
+						GerritHost: "https://vanadium-review.googlesource.com",
+					},
+				},
+				Defaults: &project.Defaults{
+					RemoteBranch: "develop",
+				},
+				Imports: []project.Import{
+					{
+						Manifest:     "public",
+						Name:         "manifest",
+						Protocol:     "git",
+						Remote:       "https://vanadium.googlesource.com/manifest",
+						RemoteBranch: "master",
+					},
+				},
+				Projects: []project.Project{
+					{
+						Name:         "project1",
+						Path:         "path1",
+						Protocol:     "git",
+						Remote:       "https://vanadium.googlesource.com/go.ref",
+						RemoteBranch: "develop",
+						Revision:     "HEAD",
+						GerritHost:   "https://vanadium-review.googlesource.com",
+					},
+					{
+						Name:         "project2",
+						Path:         "path2",
+						Protocol:     "git",
+						Remote:       "https://github.com/myorg/foo",
+						RemoteBranch: "master",
+						Revision:     "HEAD",
+					},
+				},
+			},
+			`<manifest>
+  <hosts>
+    <host name="vanadium" remote="https://vanadium.googlesource.com" gerrithost="https://vanadium-review.googlesource.com"/>
+  </hosts>
+  <defaults remotebranch="develop"/>
+  <imports>
+    <import manifest="public" name="manifest" remote="vanadium:manifest"/>
+  </imports>
+  <projects>
+    <project name="project1" path="path1" remote="vanadium:go.ref"/>
+    <project name="project2" path="path2" remote="https://github.com/myorg/foo" remotebranch="master"/>
+  </projects>
+</manifest>
+`,
+		},
+		{
+			project.Manifest{
+				Hosts: []project.Host{
+					{
+						Name:   "vanadium",
+						Remote: "https://vanadium.googlesource.com",
+					},
+				},
+				Overrides: []project.Override{
+					{
+						Project:  "project1",
+						Path:     "path1",
+						Revision: "ed42c05d8688ab23",
+					},
+					{
+						Project:      "project2=https://github.com/myorg/foo",
+						Remote:       "https://vanadium.googlesource.com/foo",
+						RemoteBranch: "fork",
+					},
+				},
+				Retention: &project.RetentionPolicy{
+					KeepLast:   10,
+					KeepWithin: "720h",
+					KeepWeekly: 4,
+				},
+			},
+			`<manifest>
+  <hosts>
+    <host name="vanadium" remote="https://vanadium.googlesource.com"/>
+  </hosts>
+  <overrides>
+    <override project="project1" path="path1" revision="ed42c05d8688ab23"/>
+    <override project="project2=https://github.com/myorg/foo" remote="vanadium:foo" remotebranch="fork"/>
+  </overrides>
+  <retention keeplast="10" keepwithin="720h" keepweekly="4"/>
 </manifest>
 `,
 		},
@@ -900,6 +2506,383 @@ func TestManifestToFromBytes(t *testing.T) {
 	}
 }
 
+// TestManifestHostInheritance checks that imported manifests inherit the hosts
+// and defaults of the importing manifest, and may override them.
+func TestManifestHostInheritance(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	files := map[string]string{
+		jirix.JiriManifestFile(): `<manifest>
+  <hosts>
+    <host name="vanadium" remote="https://vanadium.example.com" gerrithost="https://vanadium-review.example.com"/>
+  </hosts>
+  <defaults remotebranch="develop"/>
+  <imports>
+    <localimport file="A"/>
+    <localimport file="B"/>
+  </imports>
+  <projects>
+    <project name="root" path="root" remote="vanadium:root"/>
+  </projects>
+</manifest>
+`,
+		filepath.Join(jirix.Root, "A"): `<manifest>
+  <projects>
+    <project name="a" path="a" remote="vanadium:a"/>
+  </projects>
+</manifest>
+`,
+		filepath.Join(jirix.Root, "B"): `<manifest>
+  <hosts>
+    <host name="vanadium" remote="https://mirror.example.com/"/>
+  </hosts>
+  <defaults remotebranch="release"/>
+  <projects>
+    <project name="b" path="b" remote="vanadium:b" remotebranch="master"/>
+    <project name="c" path="c" remote="vanadium:c"/>
+  </projects>
+</manifest>
+`,
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	projects, _, err := project.LoadManifest(jirix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, remote, remoteBranch, gerritHost string
+	}{
+		{"root", "https://vanadium.example.com/root", "develop", "https://vanadium-review.example.com"},
+		{"a", "https://vanadium.example.com/a", "develop", "https://vanadium-review.example.com"},
+		{"b", "https://mirror.example.com/b", "master", ""},
+		{"c", "https://mirror.example.com/c", "release", ""},
+	}
+	for _, test := range tests {
+		p, err := projects.FindUnique(test.name)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if got, want := p.Remote, test.remote; got != want {
+			t.Errorf("project %v: got remote %q, want %q", test.name, got, want)
+		}
+		if got, want := p.RemoteBranch, test.remoteBranch; got != want {
+			t.Errorf("project %v: got remote branch %q, want %q", test.name, got, want)
+		}
+		if got, want := p.GerritHost, test.gerritHost; got != want {
+			t.Errorf("project %v: got gerrit host %q, want %q", test.name, got, want)
+		}
+	}
+
+	// Writing a manifest must preserve its own hosts and aliases.
+	m, err := project.ManifestFromFile(jirix, filepath.Join(jirix.Root, "B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), files[filepath.Join(jirix.Root, "B")]; got != want {
+		t.Errorf("ToBytes got\n%v\nwant\n%v", got, want)
+	}
+}
+
+// TestManifestProvenance checks that duplicate definitions are reported with
+// both of their locations, and that the source of each project attribute is
+// recorded.
+func TestManifestProvenance(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	files := map[string]string{
+		jirix.JiriManifestFile(): `<manifest>
+  <hosts>
+    <host name="vanadium" remote="https://vanadium.example.com" gerrithost="https://vanadium-review.example.com"/>
+  </hosts>
+  <defaults remotebranch="develop"/>
+  <imports>
+    <localimport file="A"/>
+    <localimport file="B"/>
+  </imports>
+  <overrides>
+    <override project="b" revision="ed42c05d8688ab23"/>
+  </overrides>
+</manifest>
+`,
+		filepath.Join(jirix.Root, "A"): `<manifest>
+  <projects>
+    <project name="a" path="a" remote="vanadium:a"/>
+    <project name="b" path="b" remote="vanadium:b" groups="mobile"/>
+  </projects>
+  <tools>
+    <tool name="tool" package="tool" project="a"/>
+  </tools>
+</manifest>
+`,
+		filepath.Join(jirix.Root, "B"): `<manifest>
+  <projects>
+
+    <project name="b" path="b" remote="vanadium:b" groups="server"/>
+  </projects>
+</manifest>
+`,
+	}
+	writeFiles := func() {
+		for file, data := range files {
+			if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFiles()
+	p, prov, err := project.ExplainProject(jirix, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Groups, "mobile,server"; got != want {
+		t.Errorf("got groups %q, want %q", got, want)
+	}
+	if got, want := prov.String(), "A:4 (imported via .jiri_manifest)"; got != want {
+		t.Errorf("got provenance %q, want %q", got, want)
+	}
+	want := []project.AttributeSource{
+		{"name", "b", "A:4"},
+		{"path", filepath.Join(jirix.Root, "b"), "A:4"},
+		{"protocol", "git", "default"},
+		{"remote", "https://vanadium.example.com/b", "A:4"},
+		{"remotebranch", "develop", "<defaults>"},
+		{"revision", "ed42c05d8688ab23", "override at .jiri_manifest:11"},
+		{"gerrithost", "https://vanadium-review.example.com", `default of host "vanadium"`},
+		{"groups", "mobile,server", "definitions at A:4 and B:4"},
+	}
+	if got := prov.Attributes; !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes %#v, want %#v", got, want)
+	}
+
+	// Conflicting definitions are reported with both locations.
+	files[filepath.Join(jirix.Root, "B")] = `<manifest>
+  <projects>
+    <project name="b" path="other" remote="vanadium:b"/>
+  </projects>
+  <tools>
+    <tool name="tool" package="other" project="a"/>
+  </tools>
+</manifest>
+`
+	writeFiles()
+	_, _, err = project.LoadManifest(jirix)
+	for _, want := range []string{"A:4 (imported via .jiri_manifest)", `path="b"`, "B:3 (imported via .jiri_manifest)", `path="other"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to contain %q", err, want)
+		}
+	}
+	files[filepath.Join(jirix.Root, "B")] = `<manifest>
+  <tools>
+    <tool name="tool" package="other" project="a"/>
+  </tools>
+</manifest>
+`
+	writeFiles()
+	_, _, err = project.LoadManifest(jirix)
+	for _, want := range []string{`duplicate tool "tool"`, "A:7", `package="tool"`, "B:3", `package="other"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+// TestManifestValidation checks that manifests are validated against the
+// manifest schema, with the positions of the errors.
+func TestManifestValidation(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	file := filepath.Join(jirix.Root, "manifest")
+	data := `<manifest>
+  <imports>
+    <import manifest="m" remote="https://example.com/m" root="../r"/>
+  </imports>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a" remotebrach="develop" formerpath="../a"/>
+    <project path="b" remote="https://example.com/b"/>
+    <project name="c" path="/c" remote="https://example.com/c" protocol="svn"/>
+    <project name="d" path="x/../a" remote="https://example.com/d" depth="-1"/>
+  </projects>
+  <tool name="tool"/>
+  <hooks>
+    <hook name="h" action="/h.sh"/>
+  </hooks>
+  <retention keeplast="-1" keepwithin="30d"/>
+</manifest>
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := project.ManifestFromFile(jirix, file)
+	if err == nil {
+		t.Fatalf("ManifestFromFile succeeded, want errors")
+	}
+	want := []string{
+		file + `:3:57: root "../r" of <import> is outside the jiri root`,
+		file + `:6:63: unknown attribute "remotebrach" in <project>`,
+		file + `:6:85: formerpath "../a" of project "a" is outside the jiri root`,
+		file + `:7:5: <project> must specify name`,
+		file + `:8:23: path "/c" of project "c" must be relative to the jiri root`,
+		file + `:8:64: unsupported protocol: svn`,
+		file + `:9:23: project "d" has the same path "x/../a" as project "a" at line 6`,
+		file + `:9:68: depth "-1" of project "d" must be a non-negative integer`,
+		file + `:11:3: unknown element <tool> in <manifest>`,
+		file + `:13:5: <hook> must specify name, project and action`,
+		file + `:13:20: action "/h.sh" of hook "h" must be relative to the project`,
+		file + `:15:14: keeplast "-1" of <retention> must be a non-negative integer`,
+		file + `:15:28: keepwithin "30d" of <retention> must be a non-negative duration, e.g. "720h"`,
+	}
+	if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A retention policy must keep some snapshots.
+	data = `<manifest>
+  <retention keeplast="0"/>
+</manifest>
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = project.ManifestFromFile(jirix, file)
+	if want := file + ":2:3: <retention> keeps no snapshots"; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got error %v, want it to start with %q", err, want)
+	}
+
+	// Projects of different manifests may not have the same path.
+	files := map[string]string{
+		jirix.JiriManifestFile(): `<manifest>
+  <imports>
+    <localimport file="A"/>
+  </imports>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a"/>
+  </projects>
+</manifest>
+`,
+		filepath.Join(jirix.Root, "A"): `<manifest>
+  <projects>
+    <project name="b" path="a/" remote="https://example.com/b"/>
+  </projects>
+</manifest>
+`,
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = project.LoadManifest(jirix)
+	for _, want := range []string{"have the same path", ".jiri_manifest:6", "A:3 (imported via .jiri_manifest)"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+// TestManifestConditions checks that imports and projects whose condition
+// doesn't hold are skipped, along with the tools of skipped projects.
+func TestManifestConditions(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	manifest := fmt.Sprintf(`<manifest>
+  <imports>
+    <import manifest="internal" name="internal" remote="https://example.com/internal" if="env:JIRI_TEST_INTERNAL"/>
+  </imports>
+  <projects>
+    <project name="a" path="a" remote="https://example.com/a" if="os=%[1]s|plan9"/>
+    <project name="b" path="b" remote="https://example.com/b" if="!os=%[1]s"/>
+  </projects>
+  <tools>
+    <tool name="tool" package="tool" project="b"/>
+  </tools>
+</manifest>
+`, runtime.GOOS)
+	if err := ioutil.WriteFile(jirix.JiriManifestFile(), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	projects, tools, err := project.LoadManifest(jirix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projects.FindUnique("a"); err != nil {
+		t.Errorf("project a was not loaded: %v", err)
+	}
+	if got, want := len(projects), 1; got != want {
+		t.Errorf("got %d projects, want %d", got, want)
+	}
+	if got, want := len(tools), 0; got != want {
+		t.Errorf("got %d tools, want %d", got, want)
+	}
+	skipped, err := project.SkippedElements(jirix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range skipped {
+		got = append(got, e.String())
+	}
+	want := []string{
+		`skipped import "internal" at .jiri_manifest:3: condition "env:JIRI_TEST_INTERNAL" doesn't hold, since JIRI_TEST_INTERNAL is not set`,
+		fmt.Sprintf(`skipped project "b" at .jiri_manifest:7: condition "!os=%[1]s" doesn't hold, since the host os is "%[1]s"`, runtime.GOOS),
+		`skipped tool "tool" at .jiri_manifest:10: project "b" was skipped`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got skipped elements:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// With the environment variable set, the import is used.
+	env := map[string]string{"JIRI_TEST_INTERNAL": "1"}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	_, _, err = project.LoadManifest(jirix.Clone(tool.ContextOpts{Env: env}))
+	if want := "can't resolve remote import"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want it to contain %q", err, want)
+	}
+
+	// Bad conditions are reported.
+	for _, cond := range []string{"host=x", "os=linx", "arch=amd46|arm", "target=amd64-linx"} {
+		data := fmt.Sprintf(`<manifest><projects><project name="c" path="c" remote="c" if="%s"/></projects></manifest>`, cond)
+		if _, err := project.ManifestFromBytes([]byte(data)); err == nil || !strings.Contains(err.Error(), "bad condition") {
+			t.Errorf("%v: got error %v, want a bad condition", cond, err)
+		}
+	}
+
+	// Projects whose conditions are mutually exclusive may share a path.
+	manifest = fmt.Sprintf(`<manifest>
+  <projects>
+    <project name="tc-host" path="prebuilt/tc" remote="https://example.com/tc-host" if="os=%[1]s"/>
+    <project name="tc-other" path="prebuilt/tc" remote="https://example.com/tc-other" if="!os=%[1]s"/>
+  </projects>
+</manifest>
+`, runtime.GOOS)
+	if err := ioutil.WriteFile(jirix.JiriManifestFile(), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	projects, _, err = project.LoadManifest(jirix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projects.FindUnique("tc-host"); err != nil || len(projects) != 1 {
+		t.Errorf("got projects %v, %v, want only tc-host", projects, err)
+	}
+}
+
 func TestProjectToFromFile(t *testing.T) {
 	jirix, cleanup := jiritest.NewX(t)
 	defer cleanup()
@@ -0,0 +1,248 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"v.io/jiri"
+	"v.io/jiri/gitutil"
+	"v.io/jiri/runutil"
+)
+
+// Protocol is implemented by each protocol that projects can use to retrieve
+// their contents, as identified by the Protocol field of Project.  Except for
+// Clone, the methods operate on the local project at project.Path.
+//
+// Implementations must not depend on the current working directory, since
+// operations on different projects may run concurrently.
+type Protocol interface {
+	// Clone creates a local copy of the project in dir, which is later moved
+	// to project.Path.
+	Clone(jirix *jiri.X, project Project, dir string) error
+	// Fetch retrieves the latest changes from the project remote, without
+	// changing the local project contents.
+	Fetch(jirix *jiri.X, project Project) error
+	// Reset changes the local project contents to project.Revision, or to the
+	// latest fetched revision of project.RemoteBranch if the revision is
+	// "HEAD".
+	Reset(jirix *jiri.X, project Project) error
+	// IsRevisionAvailable returns true if Reset can change the local project
+	// contents without contacting the project remote, which "jiri update
+	// -local" requires.
+	IsRevisionAvailable(jirix *jiri.X, project Project) (bool, error)
+	// CurrentRevision returns the revision of the local project, which is
+	// recorded in snapshots.
+	CurrentRevision(jirix *jiri.X, project Project) (string, error)
+	// IsLocalProject returns true if project.Path contains a local copy of
+	// the project.
+	IsLocalProject(jirix *jiri.X, project Project) (bool, error)
+	// HasLocalChanges returns true if the local project has work that would
+	// be lost by deleting it, such as uncommitted changes.
+	HasLocalChanges(jirix *jiri.X, project Project) (bool, error)
+	// SwitchToMaster prepares the local project for Reset, and returns a
+	// function that undoes the preparation.
+	SwitchToMaster(jirix *jiri.X, project Project) (func() error, error)
+	// Poll returns the changes that exist remotely but not locally.
+	Poll(jirix *jiri.X, project Project) ([]CL, error)
+}
+
+var protocols = map[string]Protocol{
+	"archive": archiveProtocol{},
+	"git":     gitProtocol{},
+}
+
+// RegisterProtocol makes the given protocol available to projects under the
+// given name, replacing any protocol previously registered under that name.
+// It is not safe to call RegisterProtocol concurrently with operations on
+// projects.
+func RegisterProtocol(name string, protocol Protocol) {
+	protocols[name] = protocol
+}
+
+// lookupProtocol returns the protocol registered under the given name.
+func lookupProtocol(name string) (Protocol, error) {
+	if protocol, ok := protocols[name]; ok {
+		return protocol, nil
+	}
+	return nil, UnsupportedProtocolErr(name)
+}
+
+// gitProtocol implements Protocol for git repositories.
+type gitProtocol struct{}
+
+func (gitProtocol) Clone(jirix *jiri.X, project Project, dir string) error {
+	opts, err := cacheCloneOpts(jirix, project)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, gitutil.DepthOpt(project.Depth), gitutil.FilterOpt(project.Filter))
+	return gitutil.New(jirix.NewSeq()).Clone(project.Remote, dir, opts...)
+}
+
+func (gitProtocol) Fetch(jirix *jiri.X, project Project) error {
+	if project.Remote == "" {
+		return fmt.Errorf("project %q does not have a remote", project.Name)
+	}
+	// Update the mirror first, so that clones that borrow objects from it
+	// don't need to fetch them again.
+	if err := withMirrorLock(jirix, project, func() error {
+		_, err := updateMirror(jirix, project.Remote)
+		return err
+	}); err != nil {
+		return err
+	}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	if err := git.SetRemoteUrl("origin", project.Remote); err != nil {
+		return err
+	}
+	opts, err := gitFetchOpts(git, project)
+	if err != nil {
+		return err
+	}
+	return git.Fetch("origin", opts...)
+}
+
+// gitFetchOpts returns the options for fetching the given project.  The depth
+// is only used for shallow clones, so that fetching never truncates the
+// history of a complete clone.
+func gitFetchOpts(git *gitutil.Git, project Project) ([]gitutil.FetchOpt, error) {
+	if project.Depth == 0 {
+		return nil, nil
+	}
+	shallow, err := git.IsShallow()
+	if err != nil || !shallow {
+		return nil, err
+	}
+	return []gitutil.FetchOpt{gitutil.DepthOpt(project.Depth)}, nil
+}
+
+// fetchGitRevision fetches the given revision of a project, which may be
+// missing from a shallow clone, or may not be reachable from any of the
+// fetched remote branches.
+func fetchGitRevision(git *gitutil.Git, project Project) error {
+	opts, err := gitFetchOpts(git, project)
+	if err != nil {
+		return err
+	}
+	if err := git.FetchRefspec("origin", project.Revision, opts...); err == nil {
+		return nil
+	}
+	// Not all servers allow fetching a commit by its revision, so fall back on
+	// fetching the complete history.
+	shallow, err := git.IsShallow()
+	if err != nil || !shallow {
+		return err
+	}
+	return git.Fetch("origin", gitutil.UnshallowOpt(true))
+}
+
+func (gitProtocol) Reset(jirix *jiri.X, project Project) error {
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	// Having a specific revision trumps everything else.
+	if project.Revision != "HEAD" {
+		if !git.IsRevisionAvailable(project.Revision) {
+			if err := fetchGitRevision(git, project); err != nil {
+				return err
+			}
+		}
+		return git.Reset(project.Revision)
+	}
+	// If no revision, reset to the configured remote branch.
+	return git.Reset("origin/" + project.RemoteBranch)
+}
+
+func (gitProtocol) IsRevisionAvailable(jirix *jiri.X, project Project) (bool, error) {
+	revision := project.Revision
+	if revision == "HEAD" {
+		revision = "origin/" + project.RemoteBranch
+	}
+	return gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path)).IsRevisionAvailable(revision), nil
+}
+
+func (gitProtocol) CurrentRevision(jirix *jiri.X, project Project) (string, error) {
+	return gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path)).CurrentRevisionOfBranch("master")
+}
+
+func (gitProtocol) IsLocalProject(jirix *jiri.X, project Project) (bool, error) {
+	if _, err := jirix.NewSeq().Stat(filepath.Join(project.Path, ".git")); err != nil {
+		if runutil.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (gitProtocol) HasLocalChanges(jirix *jiri.X, project Project) (bool, error) {
+	// Non-master branches, uncommitted work and untracked content all count
+	// as local changes.
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	branches, _, err := git.GetBranches()
+	if err != nil {
+		return false, err
+	}
+	uncommitted, err := git.HasUncommittedChanges()
+	if err != nil {
+		return false, err
+	}
+	untracked, err := git.HasUntrackedFiles()
+	if err != nil {
+		return false, err
+	}
+	return len(branches) != 1 || uncommitted || untracked, nil
+}
+
+func (gitProtocol) SwitchToMaster(jirix *jiri.X, project Project) (func() error, error) {
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	branch, err := git.CurrentBranchName()
+	if err != nil {
+		return nil, err
+	}
+	stashed, err := git.Stash()
+	if err != nil {
+		return nil, err
+	}
+	if err := git.CheckoutBranch("master"); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if err := git.CheckoutBranch(branch); err != nil {
+			return err
+		}
+		if stashed {
+			return git.StashPop()
+		}
+		return nil
+	}, nil
+}
+
+func (gitProtocol) Poll(jirix *jiri.X, project Project) ([]CL, error) {
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	// Fetch the latest from origin.
+	if err := git.FetchRefspec("origin", project.RemoteBranch); err != nil {
+		return nil, err
+	}
+	// Collect commits visible from FETCH_HEAD that aren't visible from master.
+	commitsText, err := git.Log("FETCH_HEAD", "master", "%an%n%ae%n%B")
+	if err != nil {
+		return nil, err
+	}
+	// Format those commits and add them to the results.
+	cls := []CL{}
+	for _, commitText := range commitsText {
+		if got, want := len(commitText), 3; got < want {
+			return nil, fmt.Errorf("Unexpected length of %v: got %v, want at least %v", commitText, got, want)
+		}
+		cls = append(cls, CL{
+			Author:      commitText[0],
+			Email:       commitText[1],
+			Description: strings.Join(commitText[2:], "\n"),
+		})
+	}
+	return cls, nil
+}
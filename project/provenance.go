@@ -0,0 +1,259 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"v.io/jiri"
+)
+
+// Provenance describes where a project or tool of a loaded manifest was
+// defined.
+type Provenance struct {
+	// File is the manifest file with the definition, relative to the jiri root
+	// if it is under the root.
+	File string
+	// Line is the line of the definition in File, or 0 if unknown.
+	Line int
+	// Imports is the chain of manifest files that led to File, starting with
+	// $JIRI_ROOT/.jiri_manifest.
+	Imports []string
+	// Attributes lists the attributes of a project that are set, along with
+	// their sources.
+	Attributes []AttributeSource
+}
+
+// AttributeSource describes the source of the value of a project attribute.
+type AttributeSource struct {
+	Name, Value, Source string
+}
+
+// Location returns the file and line of the definition.
+func (p Provenance) Location() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+func (p Provenance) String() string {
+	if len(p.Imports) == 0 {
+		return p.Location()
+	}
+	return fmt.Sprintf("%s (imported via %s)", p.Location(), strings.Join(p.Imports, " -> "))
+}
+
+// setAttribute sets the value and source of the named attribute.
+func (p *Provenance) setAttribute(name, value, source string) {
+	for index := range p.Attributes {
+		if p.Attributes[index].Name == name {
+			p.Attributes[index].Value, p.Attributes[index].Source = value, source
+			return
+		}
+	}
+	p.Attributes = append(p.Attributes, AttributeSource{name, value, source})
+}
+
+// manifestLines holds the line numbers of the elements of a manifest file, in
+// document order.
+type manifestLines struct {
+	imports, projects, tools, hooks, overrides []int
+}
+
+// lineAt returns the line number at index in lines, or 0 if it is unknown.
+func lineAt(lines []int, index int) int {
+	if index < len(lines) {
+		return lines[index]
+	}
+	return 0
+}
+
+// scanManifestLines returns the line numbers of the import, project, tool, hook
+// and override elements of the manifest in data.
+func scanManifestLines(data []byte) (manifestLines, error) {
+	var lines manifestLines
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var path []string
+	for {
+		// Each element starts at the offset following the previous token,
+		// since whitespace is returned as a token of its own.
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return manifestLines{}, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			line := 1 + bytes.Count(data[:offset], newlineBytes)
+			switch strings.Join(path, ">") {
+			case "manifest>imports>import":
+				lines.imports = append(lines.imports, line)
+			case "manifest>projects>project":
+				lines.projects = append(lines.projects, line)
+			case "manifest>tools>tool":
+				lines.tools = append(lines.tools, line)
+			case "manifest>hooks>hook":
+				lines.hooks = append(lines.hooks, line)
+			case "manifest>overrides>override":
+				lines.overrides = append(lines.overrides, line)
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		}
+	}
+}
+
+// newProvenance returns the provenance of a definition at the given line of
+// the manifest file being loaded.
+func (ld *loader) newProvenance(jirix *jiri.X, file string, line int) Provenance {
+	p := Provenance{File: shortFileName(jirix.Root, file), Line: line}
+	for _, c := range ld.cycleStack[:len(ld.cycleStack)-1] {
+		p.Imports = append(p.Imports, shortFileName(jirix.Root, c.file))
+	}
+	return p
+}
+
+// projectAttributes returns the attributes of the loaded project that are
+// set, with their sources, given the project as written in the manifest, and
+// the hosts and defaults of the manifest.
+func projectAttributes(raw, project Project, d *manifestDefaults, location string) []AttributeSource {
+	itoa := func(i int) string {
+		if i == 0 {
+			return ""
+		}
+		return strconv.Itoa(i)
+	}
+	btoa := func(b bool) string {
+		if !b {
+			return ""
+		}
+		return strconv.FormatBool(b)
+	}
+	var result []AttributeSource
+	for _, attr := range []struct{ name, raw, value string }{
+		{"name", raw.Name, project.Name},
+		{"path", raw.Path, project.Path},
+		{"protocol", raw.Protocol, project.Protocol},
+		{"remote", raw.Remote, project.Remote},
+		{"remotebranch", raw.RemoteBranch, project.RemoteBranch},
+		{"revision", raw.Revision, project.Revision},
+		{"gerrithost", raw.GerritHost, project.GerritHost},
+		{"githooks", raw.GitHooks, project.GitHooks},
+		{"runhook", raw.RunHook, project.RunHook},
+		{"groups", raw.Groups, project.Groups},
+		{"depth", itoa(raw.Depth), itoa(project.Depth)},
+		{"filter", raw.Filter, project.Filter},
+		{"nested", btoa(raw.Nested), btoa(project.Nested)},
+		{"formerly", raw.Formerly, project.Formerly},
+		{"formerpath", raw.FormerPath, project.FormerPath},
+	} {
+		var source string
+		switch {
+		case attr.value == "":
+			continue
+		case attr.name == "groups" && attr.raw != attr.value:
+			source = "importing manifests"
+			if attr.raw != "" {
+				source = location + " and importing manifests"
+			}
+		case attr.raw != "":
+			source = location
+		default:
+			source = d.defaultSource(project.Remote, attr.name)
+		}
+		result = append(result, AttributeSource{attr.name, attr.value, source})
+	}
+	return result
+}
+
+// defaultSource describes where the default value of the named attribute of a
+// project with the given remote comes from.
+func (d *manifestDefaults) defaultSource(remote, name string) string {
+	var hostValue, defaultsValue string
+	host, ok := d.hostOf(remote)
+	switch name {
+	case "gerrithost":
+		hostValue, defaultsValue = host.GerritHost, d.defaults.GerritHost
+	case "githooks":
+		hostValue, defaultsValue = host.GitHooks, d.defaults.GitHooks
+	case "remotebranch":
+		hostValue, defaultsValue = host.RemoteBranch, d.defaults.RemoteBranch
+	}
+	switch {
+	case ok && hostValue != "":
+		return fmt.Sprintf("default of host %q", host.Name)
+	case defaultsValue != "":
+		return "<defaults>"
+	default:
+		return "default"
+	}
+}
+
+// duplicateProjectError returns the error for two different definitions of
+// the project with the given key.
+func duplicateProjectError(jirix *jiri.X, key ProjectKey, p1 Project, prov1 Provenance, p2 Project, prov2 Provenance) error {
+	return fmt.Errorf("duplicate project %q with different attributes:\n  %v: %s\n  %v: %s", key, prov1, projectXML(jirix, p1), prov2, projectXML(jirix, p2))
+}
+
+// duplicateToolError returns the error for two different definitions of the
+// tool with the given name.
+func duplicateToolError(name string, t1 Tool, prov1 Provenance, t2 Tool, prov2 Provenance) error {
+	return fmt.Errorf("duplicate tool %q with different attributes:\n  %v: %s\n  %v: %s", name, prov1, elementXML(t1, "tool"), prov2, elementXML(t2, "tool"))
+}
+
+// duplicateHookError returns the error for two different definitions of the
+// hook with the given name.
+func duplicateHookError(name string, h1 Hook, prov1 Provenance, h2 Hook, prov2 Provenance) error {
+	return fmt.Errorf("duplicate hook %q with different attributes:\n  %v: %s\n  %v: %s", name, prov1, elementXML(h1, "hook"), prov2, elementXML(h2, "hook"))
+}
+
+// projectXML returns the loaded project as an XML element, with paths relative
+// to the jiri root.
+func projectXML(jirix *jiri.X, project Project) string {
+	project.relativizePaths(jirix.Root)
+	return elementXML(project, "project")
+}
+
+// elementXML returns v, which is marshaled as the XML element with the given
+// name, as a short XML element.
+func elementXML(v interface{}, name string) string {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	if bytes.Count(data, []byte("</")) > 1 {
+		// The element has child elements.
+		return string(data)
+	}
+	return string(bytes.Replace(data, []byte("></"+name+">"), endElemSoloBytes, 1))
+}
+
+// ExplainProject loads the manifest and returns the project with the given key
+// or name, along with its provenance, regardless of the group selection.
+func ExplainProject(jirix *jiri.X, keyOrName string) (Project, Provenance, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return Project{}, Provenance{}, err
+	}
+	ld := newManifestLoader(localProjects, false)
+	if err := ld.Load(jirix, "", jirix.JiriManifestFile(), ""); err != nil {
+		return Project{}, Provenance{}, err
+	}
+	project, err := ld.Projects.FindUnique(keyOrName)
+	if err != nil {
+		return Project{}, Provenance{}, err
+	}
+	return project, ld.provenance[project.Key()], nil
+}
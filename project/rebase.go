@@ -0,0 +1,234 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"v.io/jiri"
+	"v.io/jiri/collect"
+	"v.io/jiri/gitutil"
+	"v.io/jiri/runutil"
+)
+
+// RebaseOpt determines which local branches of the projects advanced by
+// UpdateUniverse are brought up to date with their new master branch.
+type RebaseOpt string
+
+func (RebaseOpt) updateOpt() {}
+
+const (
+	// RebaseTracked updates the branches that track master or its remote
+	// branch, and the CL branches created by "jiri cl new".
+	RebaseTracked = RebaseOpt("tracked")
+	// RebaseAll updates all local branches.
+	RebaseAll = RebaseOpt("all")
+)
+
+// DependencyPathFileName is the name of the file in the metadata directory of
+// a branch where "jiri cl new" records the branches the CL depends on, as a
+// newline-separated list that starts with the remote branch of the CL.
+const DependencyPathFileName = ".dependency_path"
+
+// The statuses of a branchUpdate.
+const (
+	branchUpdated  = "updated"
+	branchUpToDate = "up to date"
+	branchConflict = "needs manual resolution"
+)
+
+// branchUpdate describes the outcome of bringing a local branch up to date.
+type branchUpdate struct {
+	project, branch string
+	status, detail  string
+}
+
+// rebaseCandidate is a local branch that is brought up to date with its
+// parent, which is master or the branch it depends on.
+type rebaseCandidate struct {
+	branch, parent string
+	// depth is the number of branches between the branch and master, so that
+	// parents are updated before the branches that depend on them.
+	depth int
+	// merge determines whether the parent is merged into the branch, as "jiri
+	// cl sync" does for CL branches, rather than the branch being rebased.
+	merge bool
+}
+
+// rebaseBranches brings the local branches of the projects advanced by the
+// given operations up to date with their master branch, according to the
+// given mode, and prints a summary of the outcome for each branch.
+func rebaseBranches(jirix *jiri.X, ops operations, mode RebaseOpt) error {
+	if mode == "" {
+		return nil
+	}
+	var updates []branchUpdate
+	for _, op := range ops {
+		if kind := op.Kind(); kind != "update" && kind != "move" {
+			continue
+		}
+		if op.Project().Protocol != "git" {
+			continue
+		}
+		projectUpdates, err := rebaseProjectBranches(jirix, op.Project(), mode)
+		if err != nil {
+			return fmt.Errorf("error updating the branches of project %q: %v", op.Project().Name, err)
+		}
+		updates = append(updates, projectUpdates...)
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(jirix.Stdout(), 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tBRANCH\tSTATUS\tDETAILS")
+	for _, u := range updates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.project, u.branch, u.status, u.detail)
+	}
+	return w.Flush()
+}
+
+// byDepth sorts rebase candidates by their depth.
+type byDepth []rebaseCandidate
+
+func (c byDepth) Len() int           { return len(c) }
+func (c byDepth) Less(i, j int) bool { return c[i].depth < c[j].depth }
+func (c byDepth) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// findRebaseCandidates returns the local branches of the project that are
+// brought up to date in the given mode, with parents before their dependents.
+func findRebaseCandidates(jirix *jiri.X, project Project, branches []string, mode RebaseOpt) ([]rebaseCandidate, error) {
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	exists := map[string]bool{}
+	for _, branch := range branches {
+		exists[branch] = true
+	}
+	var candidates []rebaseCandidate
+	for _, branch := range branches {
+		if branch == "master" {
+			continue
+		}
+		chain, err := dependencyPath(jirix, project, branch)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) > 0 {
+			if chain[0] != project.RemoteBranch {
+				// The CL is for another remote branch.
+				continue
+			}
+			// Branches of the chain may have been deleted once their CLs
+			// were submitted.
+			candidate := rebaseCandidate{branch: branch, parent: "master", merge: true}
+			for _, dep := range chain[1:] {
+				if exists[dep] {
+					candidate.parent = dep
+					candidate.depth++
+				}
+			}
+			candidates = append(candidates, candidate)
+			continue
+		}
+		upstream, err := git.Upstream(branch)
+		if err != nil {
+			return nil, err
+		}
+		if mode == RebaseAll || upstream == "master" || upstream == "origin/"+project.RemoteBranch {
+			candidates = append(candidates, rebaseCandidate{branch: branch, parent: "master"})
+		}
+	}
+	sort.Stable(byDepth(candidates))
+	return candidates, nil
+}
+
+// dependencyPath returns the dependency path that "jiri cl new" recorded for
+// the given branch, or nil if the branch is not a CL branch.
+func dependencyPath(jirix *jiri.X, project Project, branch string) ([]string, error) {
+	file := filepath.Join(project.Path, jiri.ProjectMetaDir, branch, DependencyPathFileName)
+	data, err := jirix.NewSeq().ReadFile(file)
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n"), nil
+}
+
+// rebaseProjectBranches brings the local branches of the project up to date
+// with its master branch.  A branch that can't be updated automatically is
+// left as it was, and reported as needing manual resolution, along with the
+// branches that depend on it.  The current branch is restored when done.
+func rebaseProjectBranches(jirix *jiri.X, project Project, mode RebaseOpt) (_ []branchUpdate, e error) {
+	if err := project.fillDefaults(); err != nil {
+		return nil, err
+	}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	branches, current, err := git.GetBranches()
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := findRebaseCandidates(jirix, project, branches, mode)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+	var updates []branchUpdate
+	result := func(c rebaseCandidate, status, format string, args ...interface{}) {
+		updates = append(updates, branchUpdate{project.Name, c.branch, status, fmt.Sprintf(format, args...)})
+	}
+	uncommitted, err := git.HasUncommittedChanges()
+	if err != nil {
+		return nil, err
+	}
+	if uncommitted {
+		for _, c := range candidates {
+			result(c, branchConflict, "branch %q has uncommitted changes", current)
+		}
+		return updates, nil
+	}
+	defer collect.Error(func() error { return git.CheckoutBranch(current) }, &e)
+	failed := map[string]bool{}
+	for _, c := range candidates {
+		if failed[c.parent] {
+			failed[c.branch] = true
+			result(c, branchConflict, "depends on branch %q", c.parent)
+			continue
+		}
+		behind, err := git.CountCommits(c.parent, c.branch)
+		if err != nil {
+			return nil, err
+		}
+		if behind == 0 {
+			result(c, branchUpToDate, "")
+			continue
+		}
+		if err := git.CheckoutBranch(c.branch); err != nil {
+			return nil, err
+		}
+		if c.merge {
+			// Merge resets the branch if the merge fails.
+			if err := git.Merge(c.parent); err != nil {
+				failed[c.branch] = true
+				result(c, branchConflict, "conflicts with %q, run \"git merge %s\"", c.parent, c.parent)
+				continue
+			}
+			result(c, branchUpdated, "merged %q", c.parent)
+			continue
+		}
+		if err := git.Rebase(c.parent); err != nil {
+			if err := git.RebaseAbort(); err != nil {
+				return nil, err
+			}
+			failed[c.branch] = true
+			result(c, branchConflict, "conflicts with %q, run \"git rebase %s\"", c.parent, c.parent)
+			continue
+		}
+		result(c, branchUpdated, "rebased onto %q", c.parent)
+	}
+	return updates, nil
+}
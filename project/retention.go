@@ -0,0 +1,179 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"v.io/jiri"
+	"v.io/jiri/runutil"
+)
+
+// RetentionPolicy determines the snapshots that PruneSnapshots keeps.  A
+// snapshot is kept if any of the rules of the policy keeps it.  The policy in
+// $JIRI_ROOT/.jiri_manifest determines the update history snapshots that "jiri
+// update" keeps.
+type RetentionPolicy struct {
+	// KeepLast is the number of newest snapshots that are kept.
+	KeepLast int `xml:"keeplast,attr,omitempty"`
+	// KeepWithin is a duration, e.g. "720h", such that the snapshots newer
+	// than that are kept.
+	KeepWithin string `xml:"keepwithin,attr,omitempty"`
+	// KeepDaily and KeepWeekly are the number of most recent days and weeks
+	// with snapshots for which the newest snapshot is kept.
+	KeepDaily  int      `xml:"keepdaily,attr,omitempty"`
+	KeepWeekly int      `xml:"keepweekly,attr,omitempty"`
+	XMLName    struct{} `xml:"retention"`
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("keeplast=%d keepwithin=%q keepdaily=%d keepweekly=%d", p.KeepLast, p.KeepWithin, p.KeepDaily, p.KeepWeekly)
+}
+
+// validate checks that the policy is well-formed, and that it doesn't remove
+// every snapshot.
+func (p RetentionPolicy) validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 {
+		return fmt.Errorf("invalid retention policy %v: counts must be non-negative", p)
+	}
+	if p.KeepWithin != "" {
+		if d, err := time.ParseDuration(p.KeepWithin); err != nil || d < 0 {
+			return fmt.Errorf("invalid retention policy %v: keepwithin must be a non-negative duration, e.g. \"720h\"", p)
+		}
+	}
+	if p.KeepLast == 0 && p.KeepWithin == "" && p.KeepDaily == 0 && p.KeepWeekly == 0 {
+		return fmt.Errorf("retention policy %v keeps no snapshots", p)
+	}
+	return nil
+}
+
+// LoadRetentionPolicy returns the retention policy of the update history in
+// $JIRI_ROOT/.jiri_manifest, or nil if there is none.
+func LoadRetentionPolicy(jirix *jiri.X) (*RetentionPolicy, error) {
+	m, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m.Retention, nil
+}
+
+// datedSnapshot is a snapshot file along with the time it was created.
+type datedSnapshot struct {
+	file string
+	time time.Time
+}
+
+// byNewest sorts snapshots from newest to oldest.
+type byNewest []datedSnapshot
+
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Less(i, j int) bool { return s[i].time.After(s[j].time) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// listSnapshots returns the snapshot files in dir from newest to oldest.  The
+// time of a snapshot is parsed from its name if it is in RFC3339 format, which
+// is the default for both labels and the update history, and is its
+// modification time otherwise.
+func listSnapshots(jirix *jiri.X, dir string) ([]datedSnapshot, error) {
+	infos, err := jirix.NewSeq().ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []datedSnapshot
+	for _, info := range infos {
+		// Skip the symlinks of the update history, and the directories of
+		// bundles and patches.
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, info.Name())
+		if err != nil {
+			t = info.ModTime()
+		}
+		snapshots = append(snapshots, datedSnapshot{filepath.Join(dir, info.Name()), t})
+	}
+	sort.Stable(byNewest(snapshots))
+	return snapshots, nil
+}
+
+// PruneSnapshots removes the snapshot files in dir that the policy doesn't
+// keep, along with their bundles and patches, and returns the removed files
+// from newest to oldest.  The snapshots that the given symlinks point to are
+// always kept, and the symlinks themselves are never removed.  If dryRun is
+// true, the files that would be removed are returned, but nothing is removed.
+// Snapshots are dated like in listSnapshots.
+func PruneSnapshots(jirix *jiri.X, dir string, links []string, policy RetentionPolicy, dryRun bool) ([]string, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	snapshots, err := listSnapshots(jirix, dir)
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{}
+	for _, link := range links {
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		keep[target] = true
+	}
+	var within time.Duration
+	if policy.KeepWithin != "" {
+		within, _ = time.ParseDuration(policy.KeepWithin)
+	}
+	days, weeks := map[string]bool{}, map[string]bool{}
+	now := time.Now()
+	s := jirix.NewSeq()
+	var removed []string
+	for i, snapshot := range snapshots {
+		kept := i < policy.KeepLast || (policy.KeepWithin != "" && now.Sub(snapshot.time) <= within)
+		if day := snapshot.time.Format("2006-01-02"); !days[day] && len(days) < policy.KeepDaily {
+			days[day] = true
+			kept = true
+		}
+		year, week := snapshot.time.ISOWeek()
+		if key := fmt.Sprintf("%d-%d", year, week); !weeks[key] && len(weeks) < policy.KeepWeekly {
+			weeks[key] = true
+			kept = true
+		}
+		if target, err := filepath.EvalSymlinks(snapshot.file); err == nil && keep[target] {
+			kept = true
+		}
+		if kept {
+			continue
+		}
+		removed = append(removed, snapshot.file)
+		if dryRun {
+			continue
+		}
+		if err := s.RemoveAll(snapshot.file).RemoveAll(SnapshotPatchDir(snapshot.file)).Done(); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// PruneUpdateHistory removes the snapshots of the update history that the
+// policy doesn't keep, like PruneSnapshots.  The "latest" and "second-latest"
+// snapshots are always kept, so that "jiri update rollback" keeps working.
+func PruneUpdateHistory(jirix *jiri.X, policy RetentionPolicy, dryRun bool) ([]string, error) {
+	dir := jirix.UpdateHistoryDir()
+	if exists, err := jirix.NewSeq().IsDir(dir); err != nil || !exists {
+		return nil, err
+	}
+	links := []string{jirix.UpdateHistoryLatestLink(), jirix.UpdateHistorySecondLatestLink()}
+	return PruneSnapshots(jirix, dir, links, policy, dryRun)
+}
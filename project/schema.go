@@ -0,0 +1,375 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"v.io/jiri"
+)
+
+// schemaElement describes the attributes and child elements allowed in an
+// element of a manifest.
+type schemaElement struct {
+	attrs    map[string]bool
+	children map[string]*schemaElement
+}
+
+// manifestSchema is the schema of the <manifest> element, derived from the
+// xml tags of Manifest, so that it always matches what jiri reads and writes.
+var manifestSchema = newSchemaElement(reflect.TypeOf(Manifest{}))
+
+// newSchemaElement returns the schema of the element that unmarshals into a
+// value of type t.
+func newSchemaElement(t reflect.Type) *schemaElement {
+	e := &schemaElement{attrs: map[string]bool{}, children: map[string]*schemaElement{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("xml")
+		if field.Name == "XMLName" || tag == "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name, flags := parts[0], parts[1:]
+		if len(flags) > 0 && flags[0] == "attr" {
+			e.attrs[name] = true
+			continue
+		}
+		if len(flags) > 0 || name == "" {
+			// Character data, comments and inner xml are ignored.
+			continue
+		}
+		elemType := field.Type
+		for elemType.Kind() == reflect.Ptr || elemType.Kind() == reflect.Slice {
+			elemType = elemType.Elem()
+		}
+		parent := e
+		names := strings.Split(name, ">")
+		for _, wrapper := range names[:len(names)-1] {
+			if parent.children[wrapper] == nil {
+				parent.children[wrapper] = &schemaElement{attrs: map[string]bool{}, children: map[string]*schemaElement{}}
+			}
+			parent = parent.children[wrapper]
+		}
+		parent.children[names[len(names)-1]] = newSchemaElement(elemType)
+	}
+	return e
+}
+
+// manifestError describes an error at a position in a manifest file.
+type manifestError struct {
+	file         string
+	line, column int
+	msg          string
+}
+
+func (e manifestError) Error() string {
+	var pos []string
+	if e.file != "" {
+		pos = append(pos, e.file)
+	}
+	if e.line > 0 {
+		pos = append(pos, strconv.Itoa(e.line))
+		if e.column > 0 {
+			pos = append(pos, strconv.Itoa(e.column))
+		}
+	}
+	if len(pos) == 0 {
+		return e.msg
+	}
+	return strings.Join(pos, ":") + ": " + e.msg
+}
+
+// manifestErrors is the list of errors of a manifest file, one per line.
+type manifestErrors []manifestError
+
+func (errs manifestErrors) Error() string {
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// inFile returns the errors, attributed to the given manifest file.
+func (errs manifestErrors) inFile(file string) manifestErrors {
+	result := make(manifestErrors, len(errs))
+	for index, err := range errs {
+		err.file = file
+		result[index] = err
+	}
+	return result
+}
+
+// checkManifest checks the manifest in data against the manifest schema.  It
+// reports unknown elements and attributes, which xml.Unmarshal silently
+// ignores, along with attribute values that are invalid regardless of the
+// importing manifests, e.g. projects without a name or with a path outside the
+// jiri root.  The returned error, if any, is a manifestErrors.
+func checkManifest(data []byte) error {
+	var errs manifestErrors
+	position := func(offset int) (int, int) {
+		line := 1 + bytes.Count(data[:offset], newlineBytes)
+		return line, offset - bytes.LastIndex(data[:offset], newlineBytes)
+	}
+	type frame struct {
+		name   string
+		schema *schemaElement
+	}
+	var stack []frame
+	// projectPaths maps the paths of the projects seen so far to their
+	// names and lines.
+	type pathInfo struct {
+		name string
+		line int
+	}
+	projectPaths := map[string]pathInfo{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		// Each element starts at the offset following the previous token,
+		// since whitespace is returned as a token of its own.
+		start := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+				errs = append(errs, manifestError{line: syntaxErr.Line, msg: syntaxErr.Msg})
+			} else {
+				errs = append(errs, manifestError{msg: err.Error()})
+			}
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := data[start:decoder.InputOffset()]
+			line, column := position(start)
+			// report adds an error at the given attribute of the element, or
+			// at the element itself if attr is empty.
+			report := func(attr, format string, args ...interface{}) {
+				l, c := line, column
+				if attr != "" {
+					re := regexp.MustCompile(`\s` + regexp.QuoteMeta(attr) + `\s*=`)
+					if loc := re.FindIndex(element); loc != nil {
+						l, c = position(start + loc[0] + 1)
+					}
+				}
+				errs = append(errs, manifestError{line: l, column: c, msg: fmt.Sprintf(format, args...)})
+			}
+			var schema *schemaElement
+			switch {
+			case len(stack) == 0:
+				if t.Name.Local != "manifest" {
+					report("", "unknown element <%s>, expected <manifest>", t.Name.Local)
+				} else {
+					schema = manifestSchema
+				}
+			case stack[len(stack)-1].schema != nil:
+				parent := stack[len(stack)-1]
+				if schema = parent.schema.children[t.Name.Local]; schema == nil {
+					report("", "unknown element <%s> in <%s>", t.Name.Local, parent.name)
+				}
+			}
+			stack = append(stack, frame{t.Name.Local, schema})
+			if schema == nil {
+				// Don't report the contents of unknown elements.
+				continue
+			}
+			attrs := map[string]string{}
+			for _, attr := range t.Attr {
+				name := attr.Name.Local
+				if attr.Name.Space != "" {
+					name = attr.Name.Space + ":" + name
+				}
+				if !schema.attrs[name] {
+					report(name, "unknown attribute %q in <%s>", name, t.Name.Local)
+					continue
+				}
+				attrs[name] = attr.Value
+			}
+			var names []string
+			for _, f := range stack {
+				names = append(names, f.name)
+			}
+			switch strings.Join(names, ">") {
+			case "manifest>hosts>host":
+				if attrs["name"] == "" || attrs["remote"] == "" {
+					report("", "<host> must specify name and remote")
+				}
+			case "manifest>imports>import":
+				if attrs["manifest"] == "" || attrs["remote"] == "" {
+					report("", "<import> must specify manifest and remote")
+				}
+				if msg := checkRelativePath(attrs["root"]); msg != "" {
+					report("root", "root %q of <import> %s", attrs["root"], msg)
+				}
+				if cond, ok := attrs["if"]; ok {
+					if _, err := parseCondition(cond); err != nil {
+						report("if", "%v", err)
+					}
+				}
+			case "manifest>imports>localimport":
+				if attrs["file"] == "" {
+					report("", "<localimport> must specify file")
+				}
+			case "manifest>projects>project":
+				name, path := attrs["name"], attrs["path"]
+				switch {
+				case name == "":
+					report("", "<project> must specify name")
+				case strings.Contains(name, projectKeySeparator):
+					report("name", "name %q of <project> cannot contain %q", name, projectKeySeparator)
+				}
+				if path == "" {
+					report("", "<project> must specify path")
+				} else if msg := checkRelativePath(path); msg != "" {
+					report("path", "path %q of project %q %s", path, name, msg)
+				} else if _, ok := attrs["if"]; ok {
+					// Projects whose conditions are mutually exclusive may
+					// share a path, which checkProjectPaths checks once the
+					// conditions are evaluated.
+				} else if dup, ok := projectPaths[filepath.Clean(path)]; ok {
+					report("path", "project %q has the same path %q as project %q at line %d", name, path, dup.name, dup.line)
+				} else {
+					projectPaths[filepath.Clean(path)] = pathInfo{name, line}
+				}
+				if formerly, ok := attrs["formerly"]; ok && strings.Contains(formerly, projectKeySeparator) {
+					report("formerly", "formerly %q of project %q cannot contain %q", formerly, name, projectKeySeparator)
+				}
+				if formerPath, ok := attrs["formerpath"]; ok {
+					if msg := checkRelativePath(formerPath); msg != "" {
+						report("formerpath", "formerpath %q of project %q %s", formerPath, name, msg)
+					}
+				}
+				if protocol, ok := attrs["protocol"]; ok {
+					if _, err := lookupProtocol(protocol); err != nil {
+						report("protocol", "%v", err)
+					}
+				}
+				if cond, ok := attrs["if"]; ok {
+					if _, err := parseCondition(cond); err != nil {
+						report("if", "%v", err)
+					}
+				}
+				if nested, ok := attrs["nested"]; ok {
+					if _, err := strconv.ParseBool(nested); err != nil {
+						report("nested", "nested %q of project %q must be true or false", nested, name)
+					}
+				}
+				if depth, ok := attrs["depth"]; ok {
+					if n, err := strconv.Atoi(depth); err != nil || n < 0 {
+						report("depth", "depth %q of project %q must be a non-negative integer", depth, name)
+					}
+				}
+			case "manifest>projects>project>gitconfig":
+				if attrs["key"] == "" {
+					report("", "<gitconfig> must specify key")
+				}
+			case "manifest>projects>project>remote":
+				switch name := attrs["name"]; {
+				case name == "":
+					report("", "<remote> must specify name")
+				case name == "origin":
+					if _, ok := attrs["url"]; ok {
+						report("url", "url of <remote> \"origin\" cannot be set, since it is the remote of the project")
+					}
+				case attrs["url"] == "":
+					report("", "<remote> %q must specify url", name)
+				}
+			case "manifest>tools>tool":
+				if attrs["name"] == "" {
+					report("", "<tool> must specify name")
+				}
+			case "manifest>hooks>hook":
+				if attrs["name"] == "" || attrs["project"] == "" || attrs["action"] == "" {
+					report("", "<hook> must specify name, project and action")
+				}
+				if action, ok := attrs["action"]; ok && filepath.IsAbs(action) {
+					report("action", "action %q of hook %q must be relative to the project", action, attrs["name"])
+				}
+			case "manifest>retention":
+				for _, attr := range []string{"keeplast", "keepdaily", "keepweekly"} {
+					if value, ok := attrs[attr]; ok {
+						if n, err := strconv.Atoi(value); err != nil || n < 0 {
+							report(attr, "%s %q of <retention> must be a non-negative integer", attr, value)
+						}
+					}
+				}
+				if within, ok := attrs["keepwithin"]; ok {
+					if d, err := time.ParseDuration(within); err != nil || d < 0 {
+						report("keepwithin", "keepwithin %q of <retention> must be a non-negative duration, e.g. \"720h\"", within)
+					}
+				}
+				keeps := attrs["keepwithin"] != ""
+				for _, attr := range []string{"keeplast", "keepdaily", "keepweekly"} {
+					if n, err := strconv.Atoi(attrs[attr]); err == nil && n > 0 {
+						keeps = true
+					}
+				}
+				if !keeps {
+					report("", "<retention> keeps no snapshots, it must specify keeplast, keepwithin, keepdaily or keepweekly")
+				}
+			case "manifest>overrides>override":
+				if attrs["project"] == "" {
+					report("", "<override> must specify project")
+				}
+				if path, ok := attrs["path"]; ok {
+					if msg := checkRelativePath(path); msg != "" {
+						report("path", "path %q of <override> %s", path, msg)
+					}
+				}
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkRelativePath returns a message describing why the given path is not a
+// valid path relative to the jiri root, or the empty string if it is valid.
+func checkRelativePath(path string) string {
+	clean := filepath.Clean(path)
+	switch {
+	case filepath.IsAbs(path):
+		return "must be relative to the jiri root"
+	case clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)):
+		return "is outside the jiri root"
+	}
+	return ""
+}
+
+// checkProjectPaths returns an error if multiple loaded projects have the
+// same path.
+func (ld *loader) checkProjectPaths(jirix *jiri.X) error {
+	var keys ProjectKeys
+	for key := range ld.Projects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	paths := map[string]ProjectKey{}
+	for _, key := range keys {
+		path := filepath.Clean(ld.Projects[key].Path)
+		if dup, ok := paths[path]; ok {
+			return fmt.Errorf("projects %q at %v and %q at %v have the same path %q", dup, ld.provenance[dup], key, ld.provenance[key], shortFileName(jirix.Root, path))
+		}
+		paths[path] = key
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+// Copyright 2016 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"v.io/jiri"
+	"v.io/jiri/gitutil"
+)
+
+// ProjectChange describes how a project differs between two snapshots.
+type ProjectChange struct {
+	// Kind is "added", "removed", "moved" or "changed".  Projects that are
+	// moved may also have changed revisions.
+	Kind    string `json:"kind"`
+	Project string `json:"project"`
+	// OldProject is the former name of a renamed project.
+	OldProject  string `json:"old_project,omitempty"`
+	OldPath     string `json:"old_path,omitempty"`
+	NewPath     string `json:"new_path,omitempty"`
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision,omitempty"`
+	// Log lists the commits from the old to the new revision, newest first,
+	// if requested.  LogError explains why the log is missing, e.g. because
+	// the project isn't checked out locally.
+	Log      []string `json:"log,omitempty"`
+	LogError string   `json:"log_error,omitempty"`
+}
+
+func (c ProjectChange) String() string {
+	name := c.Project
+	if c.OldProject != "" {
+		name = fmt.Sprintf("%s (formerly %s)", c.Project, c.OldProject)
+	}
+	switch c.Kind {
+	case "added":
+		return fmt.Sprintf("added project %q in %q at %q", name, c.NewPath, fmtRevision(c.NewRevision))
+	case "removed":
+		return fmt.Sprintf("removed project %q from %q at %q", name, c.OldPath, fmtRevision(c.OldRevision))
+	case "moved":
+		if c.OldRevision == c.NewRevision {
+			return fmt.Sprintf("moved project %q from %q to %q at %q", name, c.OldPath, c.NewPath, fmtRevision(c.NewRevision))
+		}
+		return fmt.Sprintf("moved project %q from %q to %q and changed it from %q to %q", name, c.OldPath, c.NewPath, fmtRevision(c.OldRevision), fmtRevision(c.NewRevision))
+	default:
+		return fmt.Sprintf("changed project %q in %q from %q to %q", name, c.NewPath, fmtRevision(c.OldRevision), fmtRevision(c.NewRevision))
+	}
+}
+
+// byProjectName sorts project changes by project name.
+type byProjectName []ProjectChange
+
+func (c byProjectName) Len() int           { return len(c) }
+func (c byProjectName) Less(i, j int) bool { return c[i].Project < c[j].Project }
+func (c byProjectName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// DiffSnapshots returns the projects that differ between the old and new
+// snapshot files, sorted by name.  Projects are matched by key, or by their
+// former name or path like in UpdateUniverse.  If log is true, the commit log
+// from the old to the new revision of each changed git project is read from
+// its local clone.
+func DiffSnapshots(jirix *jiri.X, oldFile, newFile string, log bool) ([]ProjectChange, error) {
+	oldProjects, _, err := LoadSnapshotFile(jirix, oldFile)
+	if err != nil {
+		return nil, err
+	}
+	newProjects, _, err := LoadSnapshotFile(jirix, newFile)
+	if err != nil {
+		return nil, err
+	}
+	var localProjects Projects
+	if log {
+		if localProjects, err = LocalProjects(jirix, FastScan); err != nil {
+			return nil, err
+		}
+	}
+	oldProjects = matchRemoteChanges(oldProjects, newProjects)
+	var changes []ProjectChange
+	for key, p := range newProjects {
+		old, ok := oldProjects[key]
+		if !ok {
+			changes = append(changes, ProjectChange{Kind: "added", Project: p.Name, NewPath: p.Path, NewRevision: p.Revision})
+			continue
+		}
+		change := ProjectChange{
+			Kind:        "changed",
+			Project:     p.Name,
+			OldPath:     old.Path,
+			NewPath:     p.Path,
+			OldRevision: old.Revision,
+			NewRevision: p.Revision,
+		}
+		if old.Name != p.Name {
+			change.OldProject = old.Name
+		}
+		switch {
+		case old.Path != p.Path:
+			change.Kind = "moved"
+		case old.Revision == p.Revision && old.Name == p.Name:
+			continue
+		}
+		if log && old.Revision != p.Revision {
+			change.Log, change.LogError = changeLog(jirix, localProjects, p, old.Revision)
+		}
+		changes = append(changes, change)
+	}
+	for key, p := range oldProjects {
+		if _, ok := newProjects[key]; !ok {
+			changes = append(changes, ProjectChange{Kind: "removed", Project: p.Name, OldPath: p.Path, OldRevision: p.Revision})
+		}
+	}
+	sort.Sort(byProjectName(changes))
+	return changes, nil
+}
+
+// changeLog returns the commits from oldRevision to the revision of the
+// project, read from its local clone, or the reason why they can't be read.
+func changeLog(jirix *jiri.X, localProjects Projects, project Project, oldRevision string) ([]string, string) {
+	if project.Protocol != "git" {
+		return nil, fmt.Sprintf("project %q doesn't use git", project.Name)
+	}
+	local, ok := localProjects[project.Key()]
+	if !ok {
+		return nil, fmt.Sprintf("project %q is not checked out locally", project.Name)
+	}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(local.Path))
+	for _, revision := range []string{oldRevision, project.Revision} {
+		if !git.IsRevisionAvailable(revision) {
+			return nil, fmt.Sprintf("revision %q is not available locally, run \"jiri update\" to fetch it", revision)
+		}
+	}
+	commits, err := git.Log(project.Revision, oldRevision, "%h %s")
+	if err != nil {
+		return nil, err.Error()
+	}
+	var log []string
+	for _, commit := range commits {
+		log = append(log, commit...)
+	}
+	return log, ""
+}
+
+// SnapshotOpt is an option of CreateSnapshot.
+type SnapshotOpt interface {
+	snapshotOpt()
+}
+
+// IncludeBranchesOpt determines whether a snapshot records the current branch
+// and revision of git projects that are not on master, along with a bundle of
+// the commits of the branch that are not on master.
+type IncludeBranchesOpt bool
+
+func (IncludeBranchesOpt) snapshotOpt() {}
+
+// IncludeDirtyOpt determines whether a snapshot records the uncommitted
+// changes of git projects as patches.  Without IncludeBranchesOpt, the patches
+// are relative to master, so that they also contain the commits of the current
+// branch.  Untracked files are not recorded.
+type IncludeDirtyOpt bool
+
+func (IncludeDirtyOpt) snapshotOpt() {}
+
+type snapshotOpts struct {
+	includeBranches bool
+	includeDirty    bool
+}
+
+func newSnapshotOpts(opts []SnapshotOpt) snapshotOpts {
+	so := snapshotOpts{}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case IncludeBranchesOpt:
+			so.includeBranches = bool(typedOpt)
+		case IncludeDirtyOpt:
+			so.includeDirty = bool(typedOpt)
+		}
+	}
+	return so
+}
+
+// SnapshotPatchDir returns the directory that holds the bundles and patches
+// of the given snapshot file.
+func SnapshotPatchDir(file string) string {
+	return file + ".patches"
+}
+
+// recordLocalState records the current branches and uncommitted changes of
+// the git projects of the snapshot manifest, as requested by the options.
+// Bundles and patches are written to the patch directory of the snapshot file.
+func recordLocalState(jirix *jiri.X, manifest *Manifest, file string, opts snapshotOpts) error {
+	if !opts.includeBranches && !opts.includeDirty {
+		return nil
+	}
+	s := jirix.NewSeq()
+	dir, err := filepath.Abs(SnapshotPatchDir(file))
+	if err != nil {
+		return err
+	}
+	if err := s.MkdirAll(dir, 0755).Done(); err != nil {
+		return err
+	}
+	for i, project := range manifest.Projects {
+		if project.Protocol != "git" {
+			continue
+		}
+		git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+		// name is the base name of the bundle and patch of the project.  It is
+		// escaped, so that the names of different paths never collide.
+		name := project.Name
+		if rel, err := filepath.Rel(jirix.Root, project.Path); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+		name = url.PathEscape(name)
+		base := "master"
+		if opts.includeBranches {
+			branch, err := git.CurrentBranchName()
+			if err != nil {
+				return err
+			}
+			// A detached head has no branch to restore, and is recorded like
+			// master.
+			if branch != "master" && branch != "HEAD" {
+				revision, err := git.CurrentRevision()
+				if err != nil {
+					return err
+				}
+				project.LocalBranch, project.LocalRevision = branch, revision
+				base = "HEAD"
+				ahead, err := git.CountCommits(branch, "master")
+				if err != nil {
+					return err
+				}
+				if ahead > 0 {
+					bundle := filepath.Join(dir, name+".bundle")
+					if err := git.CreateBundle(bundle, "master.."+branch); err != nil {
+						return err
+					}
+					project.Bundle = relativeToSnapshot(file, bundle)
+				}
+			}
+		}
+		if opts.includeDirty {
+			patch := filepath.Join(dir, name+".patch")
+			if err := git.DiffToFile(base, patch); err != nil {
+				return err
+			}
+			fi, err := s.Stat(patch)
+			if err != nil {
+				return err
+			}
+			if fi.Size() == 0 {
+				if err := s.RemoveAll(patch).Done(); err != nil {
+					return err
+				}
+			} else {
+				project.Patch = relativeToSnapshot(file, patch)
+			}
+			if untracked, err := git.HasUntrackedFiles(); err != nil {
+				return err
+			} else if untracked {
+				fmt.Fprintf(jirix.Stderr(), "WARNING: the untracked files of project %q are not included in the snapshot\n", project.Name)
+			}
+		}
+		manifest.Projects[i] = project
+	}
+	// Don't leave an empty patch directory behind.
+	if infos, err := s.ReadDir(dir); err != nil {
+		return err
+	} else if len(infos) == 0 {
+		return s.RemoveAll(dir).Done()
+	}
+	return nil
+}
+
+// relativeToSnapshot returns the path of the given bundle or patch relative to
+// the directory of the snapshot file.
+func relativeToSnapshot(file, path string) string {
+	return filepath.Join(filepath.Base(SnapshotPatchDir(file)), filepath.Base(path))
+}
+
+// takeLocalState returns the projects that have a branch or uncommitted
+// changes recorded by CreateSnapshot, and clears them from the given projects,
+// so that they aren't recorded in the project metadata.
+func takeLocalState(projects Projects) []Project {
+	var keys []string
+	for key, project := range projects {
+		if project.LocalBranch != "" || project.Patch != "" {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	var result []Project
+	for _, key := range keys {
+		project := projects[ProjectKey(key)]
+		result = append(result, project)
+		project.LocalBranch, project.LocalRevision, project.Bundle, project.Patch = "", "", "", ""
+		projects[ProjectKey(key)] = project
+	}
+	return result
+}
+
+// restoreLocalState restores the branches and uncommitted changes recorded in
+// the given snapshot file for the given projects.  Projects that fail to be
+// restored, e.g. because they have uncommitted changes or because their branch
+// already exists at another revision, are left as they are and reported.
+func restoreLocalState(jirix *jiri.X, projects []Project, file string) error {
+	if len(projects) == 0 {
+		return nil
+	}
+	// The bundles and patches are relative to the snapshot file, rather than
+	// to the label symlink that may point to it.
+	if evaled, err := filepath.EvalSymlinks(file); err == nil {
+		file = evaled
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	var failures []string
+	for _, project := range projects {
+		if err := restoreProjectState(jirix, project, dir); err != nil {
+			failures = append(failures, fmt.Sprintf("project %q: %v", project.Name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to restore the local state of %d of %d projects:\n%v", len(failures), len(projects), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// restoreProjectState checks out the branch recorded for the project, creating
+// it from its bundle if necessary, and applies its patch.  The patch of a
+// project without a branch is applied to master.
+func restoreProjectState(jirix *jiri.X, project Project, dir string) error {
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(project.Path))
+	if dirty, err := git.HasUncommittedChanges(); err != nil {
+		return err
+	} else if dirty {
+		return fmt.Errorf("uncommitted changes would be overwritten, commit or stash them first")
+	}
+	branch := "master"
+	if project.LocalBranch != "" {
+		branch = project.LocalBranch
+		if project.Bundle != "" {
+			if err := git.FetchRefspec(filepath.Join(dir, project.Bundle), "refs/heads/"+branch); err != nil {
+				return err
+			}
+		}
+		if !git.IsRevisionAvailable(project.LocalRevision) {
+			return fmt.Errorf("revision %q of branch %q is not available", project.LocalRevision, branch)
+		}
+		if git.BranchExists(branch) {
+			revision, err := git.CurrentRevisionOfBranch(branch)
+			if err != nil {
+				return err
+			}
+			if revision != project.LocalRevision {
+				return fmt.Errorf("branch %q already exists at revision %q rather than %q", branch, revision, project.LocalRevision)
+			}
+		} else if err := git.CreateBranchWithUpstream(branch, project.LocalRevision); err != nil {
+			return err
+		}
+	}
+	if err := git.CheckoutBranch(branch); err != nil {
+		return err
+	}
+	if project.Patch != "" {
+		if err := git.ApplyPatch(filepath.Join(dir, project.Patch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotQuery selects a snapshot of a label.  Only one of its fields may be
+// set.
+type SnapshotQuery struct {
+	// At selects the snapshot in effect at the given time, which is the newest
+	// snapshot taken at or before that time.
+	At time.Time
+	// Nth selects the Nth most recent snapshot, where 1 is the latest one.
+	Nth int
+	// Project and Revision select the newest snapshot in which the project,
+	// given by key or name, is at the revision or one of its descendants.  The
+	// revisions are compared in the local clone of the project.
+	Project, Revision string
+}
+
+// FindSnapshot returns the snapshot file in dir, e.g. the "labels/<label>"
+// directory of a snapshot label, that is selected by the query.  Snapshots are
+// dated like in listSnapshots.
+func FindSnapshot(jirix *jiri.X, dir string, query SnapshotQuery) (string, error) {
+	snapshots, err := listSnapshots(jirix, dir)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !query.At.IsZero():
+		for _, snapshot := range snapshots {
+			if !snapshot.time.After(query.At) {
+				return snapshot.file, nil
+			}
+		}
+		return "", fmt.Errorf("no snapshot in %v was in effect at %v", dir, query.At.Format(time.RFC3339))
+	case query.Nth > 0:
+		if query.Nth > len(snapshots) {
+			return "", fmt.Errorf("there are only %d snapshots in %v", len(snapshots), dir)
+		}
+		return snapshots[query.Nth-1].file, nil
+	case query.Project != "":
+		return findSnapshotWithRevision(jirix, snapshots, query.Project, query.Revision)
+	}
+	return "", fmt.Errorf("invalid snapshot query %+v", query)
+}
+
+// findSnapshotWithRevision returns the newest of the given snapshots in which
+// the project is at the given revision or one of its descendants.
+func findSnapshotWithRevision(jirix *jiri.X, snapshots []datedSnapshot, name, revision string) (string, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return "", err
+	}
+	local, err := localProjects.FindUnique(name)
+	if err != nil {
+		return "", err
+	}
+	if local.Protocol != "git" {
+		return "", fmt.Errorf("project %q doesn't use git", local.Name)
+	}
+	git := gitutil.New(jirix.NewSeq(), gitutil.RootDirOpt(local.Path))
+	if !git.IsRevisionAvailable(revision) {
+		return "", fmt.Errorf("revision %q of project %q is not available locally, run \"jiri update\" to fetch it", revision, local.Name)
+	}
+	for _, snapshot := range snapshots {
+		projects, _, err := LoadSnapshotFile(jirix, snapshot.file)
+		if err != nil {
+			return "", err
+		}
+		project, ok := projects[local.Key()]
+		if !ok {
+			continue
+		}
+		if !git.IsRevisionAvailable(project.Revision) {
+			return "", fmt.Errorf("revision %q of project %q in snapshot %v is not available locally, run \"jiri update\" to fetch it", project.Revision, local.Name, snapshot.file)
+		}
+		if git.IsAncestor(revision, project.Revision) {
+			return snapshot.file, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot has project %q at or after revision %q", local.Name, revision)
+}
+
+// SnapshotsBetween returns the snapshot files from good to bad, both included,
+// in the order they were taken, which may go back in time if bad is older than
+// good.  Both snapshots must be in the same directory, e.g. the
+// "labels/<label>" directory of a label or the update history, possibly via
+// symlinks.  Snapshots are dated like in listSnapshots.
+func SnapshotsBetween(jirix *jiri.X, good, bad string) ([]string, error) {
+	var files []string
+	for _, file := range []string{good, bad} {
+		evaled, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return nil, err
+		}
+		if evaled, err = filepath.Abs(evaled); err != nil {
+			return nil, err
+		}
+		files = append(files, evaled)
+	}
+	dir := filepath.Dir(files[0])
+	if filepath.Dir(files[1]) != dir {
+		return nil, fmt.Errorf("snapshots %v and %v are not in the same directory", good, bad)
+	}
+	snapshots, err := listSnapshots(jirix, dir)
+	if err != nil {
+		return nil, err
+	}
+	goodIndex, badIndex := -1, -1
+	for i, snapshot := range snapshots {
+		switch snapshot.file {
+		case files[0]:
+			goodIndex = i
+		case files[1]:
+			badIndex = i
+		}
+	}
+	switch {
+	case goodIndex < 0 || badIndex < 0:
+		return nil, fmt.Errorf("snapshots %v and %v are not both snapshots of %v", good, bad, dir)
+	case goodIndex == badIndex:
+		return nil, fmt.Errorf("snapshots %v and %v are the same snapshot", good, bad)
+	}
+	// The snapshots are listed from newest to oldest.
+	var result []string
+	if goodIndex > badIndex {
+		for i := goodIndex; i >= badIndex; i-- {
+			result = append(result, snapshots[i].file)
+		}
+	} else {
+		for i := goodIndex; i <= badIndex; i++ {
+			result = append(result, snapshots[i].file)
+		}
+	}
+	return result, nil
+}
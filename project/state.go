@@ -24,7 +24,32 @@ type ProjectState struct {
 	CurrentBranch  string
 	HasUncommitted bool
 	HasUntracked   bool
-	Project        Project
+	// Overridden is true if the project is overridden in
+	// $JIRI_ROOT/.jiri_manifest.
+	Overridden bool
+	Project    Project
+}
+
+// loadOverrides returns the overrides in $JIRI_ROOT/.jiri_manifest.
+func loadOverrides(jirix *jiri.X) ([]Override, error) {
+	m, err := ManifestFromFile(jirix, jirix.JiriManifestFile())
+	if err != nil {
+		if runutil.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m.Overrides, nil
+}
+
+// isOverridden returns true if any of the overrides applies to the project.
+func isOverridden(overrides []Override, project Project) bool {
+	for _, override := range overrides {
+		if override.overrides(project) {
+			return true
+		}
+	}
+	return false
 }
 
 func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch chan<- error) {
@@ -66,8 +91,11 @@ func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch cha
 			}
 		}
 	default:
-		ch <- UnsupportedProtocolErr(state.Project.Protocol)
-		return
+		// Other protocols don't have branches or local changes.
+		if _, err := lookupProtocol(state.Project.Protocol); err != nil {
+			ch <- err
+			return
+		}
 	}
 	ch <- nil
 }
@@ -77,11 +105,19 @@ func GetProjectStates(jirix *jiri.X, checkDirty bool) (map[ProjectKey]*ProjectSt
 	if err != nil {
 		return nil, err
 	}
+	if projects, err = selectLocalProjects(jirix, projects); err != nil {
+		return nil, err
+	}
+	overrides, err := loadOverrides(jirix)
+	if err != nil {
+		return nil, err
+	}
 	states := make(map[ProjectKey]*ProjectState, len(projects))
 	sem := make(chan error, len(projects))
 	for key, project := range projects {
 		state := &ProjectState{
-			Project: project,
+			Overridden: isOverridden(overrides, project),
+			Project:    project,
 		}
 		states[key] = state
 		// jirix is not threadsafe, so we make a clone for each goroutine.
@@ -101,11 +137,19 @@ func GetProjectState(jirix *jiri.X, key ProjectKey, checkDirty bool) (*ProjectSt
 	if err != nil {
 		return nil, err
 	}
+	if projects, err = selectLocalProjects(jirix, projects); err != nil {
+		return nil, err
+	}
+	overrides, err := loadOverrides(jirix)
+	if err != nil {
+		return nil, err
+	}
 	sem := make(chan error, 1)
 	for k, project := range projects {
 		if k == key {
 			state := &ProjectState{
-				Project: project,
+				Overridden: isOverridden(overrides, project),
+				Project:    project,
 			}
 			setProjectState(jirix, state, checkDirty, sem)
 			return state, <-sem
@@ -32,6 +32,11 @@ const (
 	// non-empty value, causes jiri tools to use the existing PATH variable,
 	// rather than mutating it.
 	PreservePathEnv = "JIRI_PRESERVE_PATH"
+
+	// CacheEnv is the name of the environment variable that holds the path of
+	// a directory with mirrors of project repositories, which can be shared by
+	// multiple jiri roots to avoid downloading projects from scratch.
+	CacheEnv = "JIRI_CACHE"
 )
 
 // X holds the execution environment for the jiri tool and related tools.  This
@@ -143,6 +148,11 @@ func (x *X) JiriManifestFile() string {
 	return filepath.Join(x.Root, JiriManifestFile)
 }
 
+// JiriManifestLockFile returns the path to the .jiri_manifest.lock file.
+func (x *X) JiriManifestLockFile() string {
+	return x.JiriManifestFile() + ".lock"
+}
+
 // BinDir returns the path to the bin directory.
 func (x *X) BinDir() string {
 	return filepath.Join(x.RootMetaDir(), "bin")
@@ -168,6 +178,12 @@ func (x *X) ProfilesRootDir() string {
 	return filepath.Join(x.RootMetaDir(), "profiles")
 }
 
+// CacheDir returns the path to the directory with mirrors of project
+// repositories, or the empty string if no such directory is configured.
+func (x *X) CacheDir() string {
+	return x.Env()[CacheEnv]
+}
+
 // UpdateHistoryLatestLink returns the path to a symlink that points to the
 // latest update in the update history directory.
 func (x *X) UpdateHistoryLatestLink() string {